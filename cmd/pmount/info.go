@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	mm "github.com/larsks/pmount/internal/mountmanager"
+)
+
+// runInfo prints the partition table of a device or image and the profiles
+// that would accept it
+func runInfo(source string) error {
+	// Progress messages go to stderr so that they do not mix with the report
+	manager, err := mm.NewMountManager(source, "", options.format, options.nbdDevice, "default",
+		mm.WithBackend(options.backend),
+		mm.WithLogger(log.New(os.Stderr, "[pmount] ", log.LstdFlags)))
+	if err != nil {
+		return err
+	}
+
+	info, err := manager.Inspect()
+	if err != nil {
+		return err
+	}
+
+	if options.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	fmt.Printf("Source: %s\n", info.Source)
+	if info.Label == "none" {
+		fmt.Printf("Table:  none (filesystem on the whole device)\n")
+	} else {
+		fmt.Printf("Table:  %s, id %s, %d-byte sectors\n", info.Label, info.ID, info.SectorSize)
+	}
+	for _, warning := range info.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	fmt.Println()
+
+	// Partition extents are shown in sectors, as partitioning tools do
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NUMBER\tDEVICE\tSTART\tEND\tSIZE\tTYPE\tFSTYPE\tLABEL\tUUID")
+	sectorSize := int64(info.SectorSize)
+	for _, partition := range info.Partitions {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			partition.Number, orDash(partition.Device),
+			partition.Start/sectorSize, (partition.Start+partition.Size)/sectorSize-1,
+			partition.HumanSize(), partition.Type, orDash(partition.FSType),
+			orDash(partition.Label), orDash(partition.UUID))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tVALID\tREASON")
+	for _, profile := range info.Profiles {
+		valid := "yes"
+		if !profile.Valid {
+			valid = "no"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", profile.Name, valid, orDash(profile.Reason))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\nThe auto profile would use: %s\n", info.AutoProfile)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	mm "github.com/larsks/pmount/internal/mountmanager"
+)
+
+// runList prints active pmount sessions
+func runList() error {
+	sessions, err := mm.ListSessions(mm.ExecRunner{}, mm.DefaultStateDir)
+	if err != nil {
+		return err
+	}
+
+	if options.json {
+		if sessions == nil {
+			sessions = []mm.Session{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sessions)
+	}
+
+	if len(sessions) == 0 {
+		fmt.Println("no active pmount sessions")
+		return nil
+	}
+
+	// Each session is followed by one row per partition, indented under
+	// the session's device and target directory
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tDEVICE\tPROFILE\tMOUNTPOINT\tSTATUS")
+	for _, session := range sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			orDash(session.Source), orDash(session.Device), orDash(session.Profile),
+			orDash(session.TargetDir), sessionStatus(session))
+		for _, partition := range session.Partitions {
+			state := "mounted"
+			if !partition.Mounted {
+				state = "not mounted"
+			}
+			fmt.Fprintf(w, "\t  %s\t\t  %s\t%s\n", partition.Device, partition.Mountpoint, state)
+		}
+	}
+	return w.Flush()
+}
+
+func sessionStatus(session mm.Session) string {
+	switch {
+	case !session.Active():
+		return "stale"
+	case !session.Recorded:
+		return "unrecorded"
+	default:
+		return "active"
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"os/user"
 
 	"github.com/spf13/pflag"
@@ -16,7 +18,27 @@ type (
 		unmount   bool
 		format    string
 		nbdDevice string
+		backend   string
 		profile   string
+		dryRun    bool
+		keepGoing bool
+		readOnly  bool
+		options   []string
+		partOpts  []string
+		fsOpts    []string
+		include   []string
+		exclude   []string
+		only      []string
+		template  string
+		unlock    bool
+		keyFiles  []string
+		snapshot  bool
+		loadSnap  string
+		delta     string
+		overlay   bool
+		upperDir  string
+		export    string
+		json      bool
 		help      bool
 		version   bool
 	}
@@ -25,8 +47,12 @@ type (
 var options Options
 
 func printUsage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] <device_or_image> <target_directory>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] <device_or_image>... <target_directory>\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "       %s --unmount <target_directory>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s exec [OPTIONS] <device_or_image>... <target_directory> -- <command>...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s shell [OPTIONS] <device_or_image>... <target_directory>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s list [--json]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s info [--json] [OPTIONS] <device_or_image>\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "       %s (--version | --help)\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "\nExamples:\n")
@@ -34,10 +60,29 @@ func printUsage() {
 	fmt.Fprintf(os.Stderr, "  %s disk.img /mnt/image\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s --format qcow2 disk.qcow2 /mnt/image\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s --nbd-device /dev/nbd2 disk.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --backend nbd disk.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --read-only /dev/sdb /mnt/evidence\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --load-snapshot before-upgrade vm.qcow2 /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --delta edits.qcow2 golden.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s -o noatime --fs-opts vfat=umask=022 --part-opts 1=uid=1000 disk.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --partitions 1,3-5 --exclude-partitions 4 disk.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --only fstype=ext4 disk.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --name-template '{label}' disk.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --unlock encrypted.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s raid-disk1.img raid-disk2.img /mnt/raid\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --overlay --profile single rootfs.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --unmount --export-changes changes.tar /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --key-file 0e3a4b8c-5d1f-4c2a-9b7e-3f6d8a1c2e4b=data.key encrypted.img /mnt/image\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s --profile single single-partition.img /mnt/image\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s --profile raspberrypi raspios.img /mnt/rpi\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --profile auto unknown.img /mnt/image\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --dry-run --profile raspberrypi raspios.img /mnt/rpi\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s --unmount --profile single /mnt/image\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s --unmount /mnt/usb\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s exec --profile single rootfs.img /mnt/image -- apt-get update\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s shell --profile raspberrypi raspios.img /mnt/rpi\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s list --json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s info raspios.img\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nOptions:\n")
 	pflag.PrintDefaults()
 }
@@ -48,7 +93,27 @@ func init() {
 	pflag.BoolVarP(&options.unmount, "umount", "", false, "unmount partitions and clean up")
 	pflag.StringVarP(&options.format, "format", "f", "", "image format for qemu-nbd (e.g., qcow2, raw, vmdk)")
 	pflag.StringVarP(&options.nbdDevice, "nbd-device", "d", "", "specify NBD device to use (e.g., /dev/nbd1)")
-	pflag.StringVarP(&options.profile, "profile", "p", "default", "mount profile to use (default, single, raspberrypi)")
+	pflag.StringVarP(&options.backend, "backend", "b", "auto", "how to attach images: auto, nbd, or loop (raw images only)")
+	pflag.StringVarP(&options.profile, "profile", "p", "default", "mount profile to use (auto, default, single, raspberrypi, or a user-defined profile)")
+	pflag.BoolVarP(&options.dryRun, "dry-run", "n", false, "print the actions that would be performed without executing them")
+	pflag.StringArrayVarP(&options.options, "options", "o", nil, "mount options applied to every partition (e.g., noatime,nodev)")
+	pflag.StringArrayVarP(&options.partOpts, "part-opts", "", nil, "mount options for one partition (e.g., 1=uid=1000,gid=1000)")
+	pflag.StringArrayVarP(&options.fsOpts, "fs-opts", "", nil, "mount options for one filesystem type (e.g., vfat=umask=022)")
+	pflag.StringArrayVarP(&options.include, "partitions", "", nil, "only mount these partitions (e.g., 1,3-5)")
+	pflag.StringArrayVarP(&options.exclude, "exclude-partitions", "", nil, "do not mount these partitions (e.g., 2,5-6)")
+	pflag.StringArrayVarP(&options.only, "only", "", nil, "only mount partitions matching fstype, label, partlabel, type, uuid or partuuid (e.g., fstype=ext4)")
+	pflag.StringVarP(&options.template, "name-template", "", mm.DefaultNameTemplate, "name partition directories after {number}, {label}, {partlabel}, {uuid}, {partuuid} or {fstype}")
+	pflag.BoolVarP(&options.unlock, "unlock", "", false, "unlock LUKS encrypted partitions, asking for passphrases on the terminal")
+	pflag.StringArrayVarP(&options.keyFiles, "key-file", "", nil, "unlock LUKS encrypted partitions with a key file, or UUID=PATH for one partition (implies --unlock)")
+	pflag.BoolVarP(&options.snapshot, "snapshot", "", false, "attach the image with qemu-nbd --snapshot, discarding writes when it is detached")
+	pflag.StringVarP(&options.loadSnap, "load-snapshot", "", "", "attach a qcow2 internal snapshot of the image, read-only")
+	pflag.StringVarP(&options.delta, "delta", "", "", "attach a qcow2 delta backed by the image, creating it if needed, so that writes go to it")
+	pflag.BoolVarP(&options.overlay, "overlay", "", false, "mount partitions beneath overlays, so that changes go to a tmpfs and never reach the source")
+	pflag.StringVarP(&options.upperDir, "overlay-dir", "", "", "keep overlay changes in this directory instead of a tmpfs (implies --overlay)")
+	pflag.StringVarP(&options.export, "export-changes", "", "", "on unmount, save the changes made through overlays to a tar archive (.tar, .tar.gz)")
+	pflag.BoolVarP(&options.readOnly, "read-only", "r", false, "attach and mount everything read-only")
+	pflag.BoolVarP(&options.keepGoing, "keep-going", "k", false, "mount what can be mounted instead of rolling back on failure")
+	pflag.BoolVarP(&options.json, "json", "", false, "produce JSON output (list, info)")
 	pflag.BoolVarP(&options.help, "help", "h", false, "show this help message")
 	pflag.BoolVarP(&options.version, "version", "", false, "show version")
 }
@@ -70,7 +135,56 @@ func main() {
 	// Get positional arguments
 	args := pflag.Args()
 
+	if len(args) == 1 && args[0] == "list" {
+		if err := runList(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(args) > 0 && args[0] == "info" {
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Error: info requires exactly one argument (device or image)\n")
+			printUsage()
+			os.Exit(1)
+		}
+		if err := runInfo(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// exec and shell mount like a plain mount; exec takes the command to run
+	// after "--"
+	var command []string
+	subcommand := ""
+	if len(args) > 0 && (args[0] == "exec" || args[0] == "shell") {
+		subcommand = args[0]
+		if dash := pflag.CommandLine.ArgsLenAtDash(); dash >= 0 {
+			command = args[dash:]
+			args = args[:dash]
+		}
+		args = args[1:]
+		if subcommand == "exec" && len(command) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: exec requires a command after --\n")
+			printUsage()
+			os.Exit(1)
+		}
+		if subcommand == "shell" && len(command) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: shell does not take a command; use exec\n")
+			printUsage()
+			os.Exit(1)
+		}
+		if options.unmount {
+			fmt.Fprintf(os.Stderr, "Error: %s cannot be combined with --unmount\n", subcommand)
+			os.Exit(1)
+		}
+	}
+
 	var device, targetDir string
+	var additionalSources []string
 	if options.unmount {
 		// For unmount, only target directory is required
 		if len(args) != 1 {
@@ -81,14 +195,20 @@ func main() {
 		targetDir = args[0]
 		device = "" // Will be discovered from mount state
 	} else {
-		// For mount, both device and target directory are required
-		if len(args) != 2 {
-			fmt.Fprintf(os.Stderr, "Error: mount requires exactly two arguments (device and target directory)\n")
+		// For mount, a device and the target directory are required; more
+		// devices may hold further members of RAID arrays
+		if len(args) < 2 {
+			name := "mount"
+			if subcommand != "" {
+				name = subcommand
+			}
+			fmt.Fprintf(os.Stderr, "Error: %s requires at least two arguments (device and target directory)\n", name)
 			printUsage()
 			os.Exit(1)
 		}
 		device = args[0]
-		targetDir = args[1]
+		additionalSources = args[1 : len(args)-1]
+		targetDir = args[len(args)-1]
 	}
 
 	currentUser, userErr := user.Current()
@@ -96,22 +216,113 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error: failed to get current user: %v\n", userErr)
 		os.Exit(1)
 	}
-	if currentUser.Uid != "0" {
+	if currentUser.Uid != "0" && !options.dryRun {
 		fmt.Fprintf(os.Stderr, "Error: This program must be run as root\n")
 		os.Exit(1)
 	}
 
-	manager, err := mm.NewMountManager(device, targetDir, options.format, options.nbdDevice, options.profile)
+	mmOptions := []mm.Option{mm.WithBackend(options.backend), mm.WithNameTemplate(options.template)}
+	if options.dryRun {
+		mmOptions = append(mmOptions, mm.WithDryRun(os.Stdout))
+	}
+	if len(additionalSources) > 0 {
+		mmOptions = append(mmOptions, mm.WithAdditionalSources(additionalSources...))
+	}
+	if options.keepGoing {
+		mmOptions = append(mmOptions, mm.WithKeepGoing())
+	}
+	if options.readOnly {
+		mmOptions = append(mmOptions, mm.WithReadOnly())
+	}
+	if options.snapshot {
+		mmOptions = append(mmOptions, mm.WithNBDSnapshot())
+	}
+	if options.loadSnap != "" {
+		mmOptions = append(mmOptions, mm.WithLoadSnapshot(options.loadSnap))
+	}
+	if options.delta != "" {
+		mmOptions = append(mmOptions, mm.WithDelta(options.delta))
+	}
+	if options.overlay || options.upperDir != "" {
+		mmOptions = append(mmOptions, mm.WithOverlay(options.upperDir))
+	}
+	if options.export != "" {
+		if !options.unmount {
+			fmt.Fprintf(os.Stderr, "Error: --export-changes requires --unmount\n")
+			os.Exit(1)
+		}
+		mmOptions = append(mmOptions, mm.WithExportChanges(options.export))
+	}
+
+	partOpts, err := mm.ParsePartitionOptions(options.partOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fsOpts, err := mm.ParseFilesystemOptions(options.fsOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	mmOptions = append(mmOptions, mm.WithMountOptions(mm.MountOptions{
+		Global:     mm.ParseGlobalOptions(options.options),
+		Partition:  partOpts,
+		Filesystem: fsOpts,
+	}))
+
+	include, err := mm.ParsePartitionRanges(options.include)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	if options.unmount {
+	exclude, err := mm.ParsePartitionRanges(options.exclude)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	only, err := mm.ParsePartitionSelectors(options.only)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	mmOptions = append(mmOptions, mm.WithPartitionSelection(mm.PartitionSelection{
+		Include: include,
+		Exclude: exclude,
+		Only:    only,
+	}))
+
+	if options.unlock || len(options.keyFiles) > 0 {
+		keys, err := mm.ParseKeyFiles(options.keyFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if isTerminal(os.Stdin) {
+			keys.Passphrase = promptPassphrase
+		}
+		mmOptions = append(mmOptions, mm.WithLUKSKeys(keys))
+	}
+
+	manager, err := mm.NewMountManager(device, targetDir, options.format, options.nbdDevice, options.profile, mmOptions...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	switch {
+	case options.unmount:
 		err = manager.Unmount()
-	} else {
+	case subcommand != "":
+		err = manager.Exec(command)
+	default:
 		err = manager.Mount()
 	}
 
+	// The command's own exit status is passed on; it has already said
+	// whatever it had to say about failing
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		os.Exit(exitErr.ExitCode())
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
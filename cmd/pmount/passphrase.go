@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	mm "github.com/larsks/pmount/internal/mountmanager"
+)
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// promptPassphrase asks for the passphrase of a LUKS volume on the
+// terminal, without echoing it
+func promptPassphrase(volume mm.Partition) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return nil, err
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios) //nolint:errcheck
+
+	name := volume.Device
+	if volume.UUID != "" {
+		name = fmt.Sprintf("%s (UUID %s)", volume.Device, volume.UUID)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", name)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSuffix(line, "\n")), nil
+}
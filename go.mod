@@ -5,4 +5,6 @@ go 1.24.5
 require (
 	github.com/larsks/gobot v0.1.5
 	github.com/spf13/pflag v1.0.7
+	golang.org/x/sys v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,200 @@
+package mountmanager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// formatCommand renders a command line for display, quoting arguments
+// that would otherwise be ambiguous
+func formatCommand(name string, args ...string) string {
+	parts := []string{name}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$") {
+			arg = strconv.Quote(arg)
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// plan reports an action that would be performed in dry-run mode
+func (mm *MountManager) plan(name string, args ...string) {
+	fmt.Fprintln(mm.planOutput, formatCommand(name, args...))
+}
+
+// runAction runs a command that modifies system state. In dry-run mode the
+// command is printed instead of executed.
+func (mm *MountManager) runAction(name string, args ...string) ([]byte, error) {
+	if mm.dryRun {
+		mm.plan(name, args...)
+		return nil, nil
+	}
+	return mm.runner.CombinedOutput(name, args...)
+}
+
+// runActionWithInput is runAction for commands that read from standard
+// input. The input is never printed.
+func (mm *MountManager) runActionWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	if mm.dryRun {
+		mm.plan(name, args...)
+		return nil, nil
+	}
+	return mm.runner.CombinedOutputWithInput(input, name, args...)
+}
+
+// mkdirAll creates a directory and any missing parents. Directories that
+// are created are recorded in the mount state so they can be removed on
+// unmount.
+func (mm *MountManager) mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if mm.dryRun {
+		mm.plan("mkdir", "-p", dir)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		created := missing[i]
+		mm.recordDirectory(created)
+		mm.pushUndo("remove directory "+created, func() error {
+			return mm.removeDir(created)
+		})
+	}
+	return nil
+}
+
+// removeDir removes an empty directory
+func (mm *MountManager) removeDir(dir string) error {
+	if mm.dryRun {
+		mm.plan("rmdir", dir)
+		return nil
+	}
+	return os.Remove(dir)
+}
+
+// removeFile removes a file pmount created to mount something on
+func (mm *MountManager) removeFile(name string) error {
+	if mm.dryRun {
+		mm.plan("rm", name)
+		return nil
+	}
+	return os.Remove(name)
+}
+
+// mountPartition mounts a partition on the given directory. With an
+// overlay, the partition is mounted read-only elsewhere and the overlay over
+// it is mounted on the directory.
+func (mm *MountManager) mountPartition(partition Partition, dir string) error {
+	if mm.overlay {
+		lower, upper, work, err := mm.overlayDirs(partition)
+		if err != nil {
+			return err
+		}
+		if err := mm.mountFilesystem(partition, lower); err != nil {
+			return err
+		}
+		return mm.mountOverlay(partition, lower, upper, work, dir)
+	}
+	return mm.mountFilesystem(partition, dir)
+}
+
+// mountFilesystem mounts the filesystem on a partition on the given directory
+func (mm *MountManager) mountFilesystem(partition Partition, dir string) error {
+	// mount lets later options override earlier ones, so "ro" goes last
+	// where a user's "rw" cannot undo it
+	opts := slices.Clone(partition.MountOptions)
+	if mm.readOnly || partition.ReadOnly {
+		opts = append(opts, "ro")
+	}
+
+	var args []string
+	if len(opts) > 0 {
+		args = append(args, "-o", strings.Join(opts, ","))
+	}
+	args = append(args, partition.Device, dir)
+
+	if output, err := mm.runAction("mount", args...); err != nil {
+		return commandError(err, output)
+	}
+	mm.recordMount(partition, dir)
+	mm.pushUndo("unmount "+dir, func() error {
+		return mm.unmountDir(dir)
+	})
+	return nil
+}
+
+// unmountDir unmounts the filesystem mounted on the given directory
+func (mm *MountManager) unmountDir(dir string) error {
+	if output, err := mm.runAction("umount", dir); err != nil {
+		return commandError(err, output)
+	}
+	return nil
+}
+
+// unmountTree unmounts a recursive bind mount made by bindMount, together
+// with everything mounted beneath it
+func (mm *MountManager) unmountTree(dir string) error {
+	if output, err := mm.runAction("umount", "-R", dir); err != nil {
+		return commandError(err, output)
+	}
+	return nil
+}
+
+// commandError annotates a command failure with any output it produced
+func commandError(err error, output []byte) error {
+	if msg := strings.TrimSpace(string(output)); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
+
+// setReadOnly marks a block device read-only so that nothing, including
+// filesystem journal replay, can write to it. Devices that are already
+// read-only are left alone.
+func (mm *MountManager) setReadOnly(device string) error {
+	output, err := mm.runner.Output("blockdev", "--getro", device)
+	if err != nil {
+		return fmt.Errorf("failed to query read-only flag of %s: %w", device, err)
+	}
+	if strings.TrimSpace(string(output)) == "1" {
+		return nil
+	}
+
+	if output, err := mm.runAction("blockdev", "--setro", device); err != nil {
+		return fmt.Errorf("failed to set %s read-only: %w", device, commandError(err, output))
+	}
+	mm.logger.Printf("set %s read-only", device)
+	mm.recordReadOnly(device)
+	mm.pushUndo("make "+device+" writable", func() error {
+		return mm.setReadWrite(device)
+	})
+	return nil
+}
+
+// setReadWrite clears the read-only flag set by setReadOnly
+func (mm *MountManager) setReadWrite(device string) error {
+	if output, err := mm.runAction("blockdev", "--setrw", device); err != nil {
+		return fmt.Errorf("failed to make %s writable: %w", device, commandError(err, output))
+	}
+	mm.logger.Printf("made %s writable", device)
+	return nil
+}
@@ -0,0 +1,196 @@
+package mountmanager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProfileSelector is implemented by profiles that choose another profile
+// to do the work based on the discovered partitions
+type ProfileSelector interface {
+	SelectProfile(mm *MountManager, partitions []Partition) (MountProfile, error)
+}
+
+// AutoProfile picks the best-fitting profile for the discovered partitions:
+// - raspberrypi, if partition 1 is a FAT filesystem containing Raspberry Pi
+// firmware and partition 2 is an ext4 filesystem containing /boot/firmware
+// - a user-defined profile whose rules match every partition
+// - single, if there is exactly one partition
+// - default otherwise
+type AutoProfile struct{}
+
+func (p *AutoProfile) Name() string {
+	return "auto"
+}
+
+func (p *AutoProfile) Validate(partitions []Partition) error {
+	profile, err := p.SelectProfile(nil, partitions)
+	if err != nil {
+		return err
+	}
+	return profile.Validate(partitions)
+}
+
+func (p *AutoProfile) Mount(mm *MountManager, partitions []Partition) error {
+	profile, err := p.SelectProfile(mm, partitions)
+	if err != nil {
+		return err
+	}
+	return profile.Mount(mm, partitions)
+}
+
+// Unmount is only used when no state was recorded at mount time. The
+// layout is recognized from what is mounted on the target directory.
+func (p *AutoProfile) Unmount(mm *MountManager) error {
+	var profile MountProfile = &DefaultProfile{}
+	if device, _ := mm.findMountedDevice(filepath.Join(mm.targetDir, "boot", "firmware")); device != "" {
+		profile = &RaspberryPiProfile{}
+	} else if device, _ := mm.findMountedDevice(mm.targetDir); device != "" {
+		profile = &SingleProfile{}
+	}
+	mm.logger.Printf("auto: unmounting using %s profile", profile.Name())
+	return profile.Unmount(mm)
+}
+
+// SelectProfile chooses a profile for the partitions and logs why. When mm
+// is nil, or in dry-run mode, filesystem contents are not inspected.
+func (p *AutoProfile) SelectProfile(mm *MountManager, partitions []Partition) (MountProfile, error) {
+	logf := func(format string, args ...any) {
+		if mm != nil {
+			mm.logger.Printf("auto: "+format, args...)
+		}
+	}
+
+	if reason, ok := looksLikeRaspberryPi(mm, partitions); ok {
+		logf("selected raspberrypi profile: %s", reason)
+		return &RaspberryPiProfile{}, nil
+	} else if reason != "" {
+		logf("not raspberrypi: %s", reason)
+	}
+
+	userProfiles, err := LoadUserProfiles()
+	if err != nil {
+		return nil, err
+	}
+	if profile := bestUserProfile(userProfiles, partitions); profile != nil {
+		logf("selected %s profile: its rules match all %d partitions", profile.Name(), len(partitions))
+		return profile, nil
+	}
+
+	if len(partitions) == 1 {
+		logf("selected single profile: found exactly one partition")
+		return &SingleProfile{}, nil
+	}
+
+	logf("selected default profile: found %d partitions", len(partitions))
+	return &DefaultProfile{}, nil
+}
+
+// bestUserProfile returns the user-defined profile that validates against
+// the partitions and assigns a rule to every one of them. If several do,
+// the first by name is used.
+func bestUserProfile(userProfiles map[string]*UserProfile, partitions []Partition) *UserProfile {
+	if len(partitions) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(userProfiles))
+	for name := range userProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		profile := userProfiles[name]
+		assignments, err := profile.assign(partitions)
+		if err == nil && len(assignments) == len(partitions) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// looksLikeRaspberryPi checks for a Raspberry Pi OS layout. It returns a
+// reason describing the decision, which is empty if the partition layout
+// is not even close.
+func looksLikeRaspberryPi(mm *MountManager, partitions []Partition) (string, bool) {
+	if len(partitions) != 2 {
+		return "", false
+	}
+
+	var boot, root *Partition
+	for i := range partitions {
+		switch partitions[i].Number {
+		case 1:
+			boot = &partitions[i]
+		case 2:
+			root = &partitions[i]
+		}
+	}
+	if boot == nil || root == nil {
+		return "", false
+	}
+	if boot.FSType != "vfat" || root.FSType != "ext4" {
+		return fmt.Sprintf("partition 1 is %q and partition 2 is %q, not vfat and ext4", boot.FSType, root.FSType), false
+	}
+
+	if mm == nil || mm.dryRun {
+		return "partition 1 is vfat and partition 2 is ext4 (contents not inspected)", true
+	}
+
+	firmware, err := mm.inspectPartition(*boot, func(root string) bool {
+		if _, err := os.Stat(filepath.Join(root, "config.txt")); err == nil {
+			return true
+		}
+		matches, _ := filepath.Glob(filepath.Join(root, "start*.elf"))
+		return len(matches) > 0
+	})
+	if err != nil {
+		return fmt.Sprintf("could not inspect partition 1: %v", err), false
+	}
+	if !firmware {
+		return "partition 1 has no config.txt or start*.elf", false
+	}
+
+	bootFirmware, err := mm.inspectPartition(*root, func(root string) bool {
+		info, err := os.Stat(filepath.Join(root, "boot", "firmware"))
+		return err == nil && info.IsDir()
+	})
+	if err != nil {
+		return fmt.Sprintf("could not inspect partition 2: %v", err), false
+	}
+	if !bootFirmware {
+		return "partition 2 has no /boot/firmware directory", false
+	}
+
+	return "partition 1 contains Raspberry Pi firmware and partition 2 contains /boot/firmware", true
+}
+
+// inspectPartition temporarily mounts a partition read-only and reports the
+// result of check on the mounted filesystem. The mount is not recorded in
+// the mount state.
+func (mm *MountManager) inspectPartition(partition Partition, check func(root string) bool) (bool, error) {
+	dir, err := os.MkdirTemp("", "pmount-inspect-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(dir) //nolint:errcheck
+
+	// Avoid journal replay, which would write to the device
+	opts := []string{"ro"}
+	if strings.HasPrefix(partition.FSType, "ext") {
+		opts = append(opts, "noload")
+	}
+
+	if output, err := mm.runner.CombinedOutput("mount", "-o", strings.Join(opts, ","), partition.Device, dir); err != nil {
+		return false, commandError(err, output)
+	}
+	result := check(dir)
+	if output, err := mm.runner.CombinedOutput("umount", dir); err != nil {
+		return result, fmt.Errorf("failed to unmount %s: %w", dir, commandError(err, output))
+	}
+	return result, nil
+}
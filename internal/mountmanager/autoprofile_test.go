@@ -0,0 +1,182 @@
+package mountmanager
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeFilesystems handles mount and umount calls by populating the mount
+// directory with the given files for each device
+func fakeFilesystems(t *testing.T, runner *FakeRunner, contents map[string][]string) {
+	t.Helper()
+	runner.Handle("mount", func(args []string) ([]byte, error) {
+		device, dir := args[len(args)-2], args[len(args)-1]
+		for _, name := range contents[device] {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	runner.Handle("umount", func(args []string) ([]byte, error) {
+		entries, _ := os.ReadDir(args[0])
+		for _, entry := range entries {
+			os.RemoveAll(filepath.Join(args[0], entry.Name()))
+		}
+		return nil, nil
+	})
+}
+
+func raspiosRunner(t *testing.T) *FakeRunner {
+	t.Helper()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	return NewFakeRunner().
+		On("blkid -p -o export /dev/sdz1", "LABEL=bootfs\nTYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/sdz2", "LABEL=rootfs\nTYPE=ext4\n", nil)
+}
+
+func TestAutoProfileSelectsRaspberryPi(t *testing.T) {
+	fakeProfileDirs(t)
+	targetDir := t.TempDir()
+	// /boot/firmware exists in the root filesystem once it is mounted
+	if err := os.MkdirAll(filepath.Join(targetDir, "boot", "firmware"), 0755); err != nil {
+		t.Fatalf("Failed to create boot directory: %v", err)
+	}
+	stateDir := t.TempDir()
+
+	runner := raspiosRunner(t)
+	fakeFilesystems(t, runner, map[string][]string{
+		"/dev/sdz1": {"config.txt", "start4.elf"},
+		"/dev/sdz2": {"boot/firmware/.keep"},
+	})
+	mm := newTestManager(t, "/dev/sdz", targetDir, "auto", runner, WithStateDir(stateDir))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	if mm.profile.Name() != "raspberrypi" {
+		t.Errorf("Expected raspberrypi profile to be selected, got %s", mm.profile.Name())
+	}
+	states, err := LoadStates(stateDir)
+	if err != nil || len(states) != 1 {
+		t.Fatalf("Expected one recorded state, got %d (%v)", len(states), err)
+	}
+	if states[0].Profile != "raspberrypi" {
+		t.Errorf("Expected selected profile to be recorded, got %s", states[0].Profile)
+	}
+}
+
+func TestAutoProfileRejectsRaspberryPiWithoutFirmware(t *testing.T) {
+	fakeProfileDirs(t)
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+
+	runner := raspiosRunner(t)
+	fakeFilesystems(t, runner, map[string][]string{
+		"/dev/sdz1": {"EFI/BOOT/BOOTX64.EFI"},
+		"/dev/sdz2": {"boot/firmware/.keep"},
+	})
+	mm := newTestManager(t, "/dev/sdz", targetDir, "auto", runner)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if mm.profile.Name() != "default" {
+		t.Errorf("Expected default profile to be selected, got %s", mm.profile.Name())
+	}
+}
+
+func TestAutoProfileDryRunSkipsInspection(t *testing.T) {
+	fakeProfileDirs(t)
+	mm := newTestManager(t, "/dev/sdz", t.TempDir(), "auto", NewFakeRunner(), WithDryRun(io.Discard))
+
+	profile, err := (&AutoProfile{}).SelectProfile(mm, []Partition{
+		{Device: "/dev/sdz1", Number: 1, FSType: "vfat"},
+		{Device: "/dev/sdz2", Number: 2, FSType: "ext4"},
+	})
+	if err != nil {
+		t.Fatalf("SelectProfile() error = %v", err)
+	}
+	if profile.Name() != "raspberrypi" {
+		t.Errorf("Expected raspberrypi profile, got %s", profile.Name())
+	}
+	if len(mm.runner.(*FakeRunner).Calls) != 0 {
+		t.Error("Expected no commands to be run in dry-run mode")
+	}
+}
+
+func TestAutoProfileSelection(t *testing.T) {
+	systemDir, _ := fakeProfileDirs(t)
+	writeProfile(t, systemDir, "board.yaml", boardProfile)
+
+	tests := []struct {
+		name       string
+		partitions []Partition
+		want       string
+	}{
+		{
+			name:       "one partition",
+			partitions: []Partition{{Device: "/dev/sda1", Number: 1, FSType: "ext4"}},
+			want:       "single",
+		},
+		{
+			name: "user profile matches every partition",
+			partitions: []Partition{
+				{Device: "/dev/sda1", Number: 1, Label: "boot"},
+				{Device: "/dev/sda2", Number: 2},
+				{Device: "/dev/sda3", Number: 3, FSType: "swap"},
+			},
+			want: "board",
+		},
+		{
+			name: "user profile leaves a partition unmatched",
+			partitions: []Partition{
+				{Device: "/dev/sda1", Number: 1, Label: "boot"},
+				{Device: "/dev/sda2", Number: 2},
+				{Device: "/dev/sda3", Number: 3, FSType: "xfs"},
+			},
+			want: "default",
+		},
+		{
+			name:       "no partitions",
+			partitions: nil,
+			want:       "default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := (&AutoProfile{}).SelectProfile(nil, tt.partitions)
+			if err != nil {
+				t.Fatalf("SelectProfile() error = %v", err)
+			}
+			if profile.Name() != tt.want {
+				t.Errorf("SelectProfile() = %s, want %s", profile.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoProfileUnmountWithoutState(t *testing.T) {
+	targetDir := t.TempDir()
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+targetDir, findmntJSON(targetDir, "/dev/sdz1"), nil)
+	mm := newTestManager(t, "", targetDir, "auto", runner)
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + filepath.Join(targetDir, "boot", "firmware"),
+		"findmnt -J -M " + targetDir,
+		"findmnt -J -M " + targetDir,
+		"umount " + targetDir,
+	})
+}
@@ -0,0 +1,421 @@
+package mountmanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/larsks/pmount/internal/parttable"
+)
+
+// Backend makes a source available as a block device
+type Backend interface {
+	// Name returns the backend name, as recorded in the mount state
+	Name() string
+
+	// Attach makes the source available as a block device and returns the
+	// device path
+	Attach(mm *MountManager) (string, error)
+
+	// Partitions enumerates the partitions of an attached device
+	Partitions(mm *MountManager, device string) ([]Partition, error)
+
+	// Detach releases a device returned by Attach
+	Detach(mm *MountManager, device string) error
+
+	// Owns reports whether a device or partition was attached by this
+	// backend, and returns the attached device (e.g. /dev/nbd1p2 -> /dev/nbd1)
+	Owns(device string) (string, bool)
+}
+
+// findBackend returns the backend with the given name, or nil
+func (mm *MountManager) findBackend(name string) Backend {
+	for _, backend := range mm.backends {
+		if backend.Name() == name {
+			return backend
+		}
+	}
+	return nil
+}
+
+// selectBackend chooses how the source is attached. Block devices are used
+// directly; image files are attached with a loop device if they are raw and
+// loop devices are available, and with qemu-nbd otherwise, unless a backend
+// was requested explicitly.
+func (mm *MountManager) selectBackend() (Backend, error) {
+	nbd := mm.findBackend("nbd").(*NBDBackend)
+	if !mm.isImageFile() {
+		if nbd.snapshotting() {
+			return nil, fmt.Errorf("snapshots and deltas need an image file; %s is not one", mm.sourceDevice)
+		}
+		return mm.findBackend("direct"), nil
+	}
+
+	loop := mm.findBackend("loop").(*LoopBackend)
+	if nbd.snapshotting() {
+		if mm.backendName == "loop" {
+			return nil, fmt.Errorf("snapshots and deltas need the nbd backend")
+		}
+		return nbd, nil
+	}
+
+	switch mm.backendName {
+	case "loop":
+		if !mm.isRawImage() {
+			return nil, fmt.Errorf("the loop backend only supports raw images")
+		}
+		return loop, nil
+	case "nbd":
+		return nbd, nil
+	}
+
+	// An explicitly requested NBD device implies the NBD backend
+	if nbd.Device != "" {
+		return nbd, nil
+	}
+	if mm.isRawImage() && loop.controller.Available() {
+		return loop, nil
+	}
+	return nbd, nil
+}
+
+// attach makes the source available through the selected backend
+func (mm *MountManager) attach() error {
+	backend, err := mm.selectBackend()
+	if err != nil {
+		return err
+	}
+
+	device, err := backend.Attach(mm)
+	if err != nil {
+		return err
+	}
+	mm.backend = backend
+	mm.device = device
+	if mm.state != nil {
+		mm.state.Backend = backend.Name()
+	}
+	mm.pushUndo("detach "+device, mm.detach)
+	return nil
+}
+
+// AttachedSource records an additional source attached during a mount session
+type AttachedSource struct {
+	Source  string `json:"source"`
+	Backend string `json:"backend"`
+	Device  string `json:"device"`
+}
+
+// attachAdditionalSources attaches the sources given besides the main one
+// and returns the RAID members among their partitions. Their other
+// partitions are not mounted.
+func (mm *MountManager) attachAdditionalSources() ([]Partition, error) {
+	var members []Partition
+	for _, source := range mm.extraSources {
+		partitions, err := mm.attachAdditionalSource(source)
+		if err != nil {
+			return nil, err
+		}
+		for _, partition := range partitions {
+			if partition.FSType != "linux_raid_member" {
+				mm.logger.Printf("ignoring %s of %s, which is not a RAID member", partition.Device, source)
+				continue
+			}
+			members = append(members, partition)
+		}
+	}
+	return members, nil
+}
+
+// attachAdditionalSource attaches another source, through a copy of the
+// manager that differs only in its source, and returns its probed partitions
+func (mm *MountManager) attachAdditionalSource(source string) ([]Partition, error) {
+	other := *mm
+	other.sourceDevice = source
+	other.device = ""
+
+	// Only the main source uses an explicitly requested NBD device
+	other.backends = []Backend{&NBDBackend{}, mm.findBackend("loop"), mm.findBackend("direct")}
+	backend, err := other.selectBackend()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+
+	device, err := backend.Attach(&other)
+	if err != nil {
+		return nil, err
+	}
+	mm.recordSource(AttachedSource{Source: source, Backend: backend.Name(), Device: device})
+	mm.pushUndo("detach "+device, func() error {
+		return backend.Detach(mm, device)
+	})
+
+	partitions, err := backend.Partitions(&other, device)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	other.device = device
+	other.probePartitions(partitions)
+	return partitions, nil
+}
+
+// detach releases the attached device, if any
+func (mm *MountManager) detach() error {
+	if mm.backend == nil || mm.device == "" {
+		return nil
+	}
+	if err := mm.backend.Detach(mm, mm.device); err != nil {
+		return err
+	}
+	mm.device = ""
+	return nil
+}
+
+// lowerDevices returns the devices a device-mapper device is built on,
+// recursively (e.g. /dev/mapper/vg-root -> /dev/nbd0p2)
+func lowerDevices(device string) []string {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		resolved = device
+	}
+	slaves, _ := os.ReadDir(filepath.Join(sysBlockDir, filepath.Base(resolved), "slaves"))
+
+	var devices []string
+	for _, slave := range slaves {
+		lower := filepath.Join("/dev", slave.Name())
+		devices = append(devices, lower)
+		devices = append(devices, lowerDevices(lower)...)
+	}
+	return devices
+}
+
+// removeHolders removes the device-mapper devices (such as logical volumes)
+// and RAID arrays stacked on a device or its partitions, innermost first, so
+// that the device can be detached. This is only needed when no mount state
+// was recorded; otherwise exactly what was set up is torn down.
+func (mm *MountManager) removeHolders(device string) error {
+	return mm.removeHoldersOf(filepath.Join(sysBlockDir, filepath.Base(device)), make(map[string]bool))
+}
+
+// sysfsDirs returns the sysfs directory of a block device followed by those
+// of its partitions
+func sysfsDirs(deviceDir string) []string {
+	base := filepath.Base(deviceDir)
+	dirs := []string{deviceDir}
+	entries, _ := os.ReadDir(deviceDir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), base) {
+			dirs = append(dirs, filepath.Join(deviceDir, entry.Name()))
+		}
+	}
+	return dirs
+}
+
+// removeHoldersOf removes the device-mapper devices and RAID arrays holding
+// the block device whose sysfs directory is deviceDir, or its partitions,
+// after removing whatever holds them in turn
+func (mm *MountManager) removeHoldersOf(deviceDir string, removed map[string]bool) error {
+	for _, dir := range sysfsDirs(deviceDir) {
+		holders, _ := os.ReadDir(filepath.Join(dir, "holders"))
+		for _, holder := range holders {
+			if removed[holder.Name()] {
+				continue
+			}
+			holderDir := filepath.Join(sysBlockDir, holder.Name())
+			if err := mm.removeHoldersOf(holderDir, removed); err != nil {
+				return err
+			}
+			if err := mm.removeHolder(holderDir); err != nil {
+				return err
+			}
+			removed[holder.Name()] = true
+		}
+	}
+	return nil
+}
+
+// removeHolder removes a device-mapper device or stops a RAID array, given
+// its sysfs directory. Other kinds of holder are left alone.
+func (mm *MountManager) removeHolder(holderDir string) error {
+	if name, err := os.ReadFile(filepath.Join(holderDir, "dm", "name")); err == nil {
+		dmName := strings.TrimSpace(string(name))
+		if output, err := mm.runAction("dmsetup", "remove", dmName); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", dmName, commandError(err, output))
+		}
+		mm.logger.Printf("removed device-mapper device %s", dmName)
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(holderDir, "md")); err == nil {
+		array := filepath.Join("/dev", filepath.Base(holderDir))
+		if output, err := mm.runAction("mdadm", "--stop", array); err != nil {
+			return fmt.Errorf("failed to stop RAID array %s: %w", array, commandError(err, output))
+		}
+		mm.logger.Printf("stopped RAID array %s", array)
+	}
+	return nil
+}
+
+// findOwner looks for a backend that attached one of the known partitions,
+// or a device beneath one (as for a logical volume), and makes it the current
+// backend. It reports whether one was found.
+func (mm *MountManager) findOwner() bool {
+	var devices []string
+	for _, partition := range mm.partitions {
+		devices = append(devices, partition.Device)
+		devices = append(devices, lowerDevices(partition.Device)...)
+	}
+
+	for _, candidate := range devices {
+		for _, backend := range mm.backends {
+			if device, ok := backend.Owns(candidate); ok {
+				mm.logger.Printf("detected %s device: %s", backend.Name(), device)
+				mm.backend = backend
+				mm.device = device
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ownedDevice returns the whole device for a partition of a device named
+// with the given prefix, using the kernel's "p" separator for partitions
+// (e.g. /dev/nbd1p2 -> /dev/nbd1)
+func ownedDevice(device, prefix string) (string, bool) {
+	if !strings.HasPrefix(device, prefix) {
+		return "", false
+	}
+	if idx := strings.LastIndex(device, "p"); idx > len(prefix) {
+		return device[:idx], true
+	}
+	return device, true
+}
+
+// readPartitionTable reads the partition table of a block device or image
+// file. Tests replace it to avoid needing real devices.
+var readPartitionTable = parttable.ReadFile
+
+// partitionNode returns the device node the kernel creates for a partition
+// (e.g. /dev/sda + 1 -> /dev/sda1, /dev/nbd0 + 1 -> /dev/nbd0p1)
+func partitionNode(device string, number int) string {
+	if last := device[len(device)-1]; last >= '0' && last <= '9' || device == dryRunLoopDevice {
+		return fmt.Sprintf("%sp%d", device, number)
+	}
+	return fmt.Sprintf("%s%d", device, number)
+}
+
+// formatSize formats a size in bytes in human readable form
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.1fG", float64(size)/(1024*1024*1024))
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1fM", float64(size)/(1024*1024))
+	default:
+		return fmt.Sprintf("%dK", size/1024)
+	}
+}
+
+// listPartitions reads and records the partition table of a device. In
+// dry-run mode an image has not actually been attached, so the partition
+// table is read from the image itself and the partitions are named after the
+// nodes they would have on the attached device.
+func (mm *MountManager) listPartitions(device string) ([]Partition, error) {
+	source := device
+	if mm.dryRun && device != mm.sourceDevice {
+		source = mm.sourceDevice
+	}
+
+	table, err := readPartitionTable(source)
+	if errors.Is(err, parttable.ErrNoPartitionTable) || (err == nil && len(table.Partitions) == 0) {
+		if partition, ok := mm.wholeDevicePartition(device, source); ok {
+			mm.table = &parttable.Table{Label: "none", SectorSize: parttable.DefaultSectorSize}
+			return []Partition{partition}, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	for _, warning := range table.Warnings {
+		mm.logger.Printf("warning: %s: %s", source, warning)
+	}
+	mm.table = table
+	return tablePartitions(device, table), nil
+}
+
+// wholeDevicePartition looks for a filesystem (or anything else blkid
+// recognizes, such as a LUKS volume) taking up a whole device that has no
+// partitions, and returns it as a pseudo-partition numbered 1. The device
+// is probed through source, which is the image in dry-run mode.
+func (mm *MountManager) wholeDevicePartition(device, source string) (Partition, bool) {
+	values := mm.probeBlkid(source)
+	if values["TYPE"] == "" {
+		return Partition{}, false
+	}
+	mm.logger.Printf("no partitions on %s; using the %s filesystem on the whole device", source, values["TYPE"])
+
+	partition := Partition{
+		Device: device,
+		Number: 1,
+		FSType: values["TYPE"],
+		Label:  values["LABEL"],
+		UUID:   values["UUID"],
+	}
+	if f, err := os.Open(source); err == nil {
+		partition.Size, _ = f.Seek(0, io.SeekEnd)
+		f.Close() //nolint:errcheck
+	}
+	return partition, true
+}
+
+// tablePartitions returns the partitions listed in the partition table of a
+// device
+func tablePartitions(device string, table *parttable.Table) []Partition {
+	partitions := []Partition{}
+	for _, part := range table.Partitions {
+		partition := Partition{
+			Device:    partitionNode(device, part.Number),
+			Number:    part.Number,
+			Start:     part.Start,
+			Size:      part.Size,
+			Type:      part.Type,
+			PartLabel: part.Name,
+			PartUUID:  strings.ToLower(part.GUID),
+		}
+		if table.Label == "dos" {
+			// DOS partitions are identified by disk signature and number
+			// (e.g. 7351b90c-02)
+			partition.PartUUID = fmt.Sprintf("%s-%02x", strings.TrimPrefix(table.ID, "0x"), part.Number)
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions
+}
+
+// DirectBackend uses a block device as it is
+type DirectBackend struct{}
+
+func (DirectBackend) Name() string {
+	return "direct"
+}
+
+func (DirectBackend) Attach(mm *MountManager) (string, error) {
+	return mm.sourceDevice, nil
+}
+
+func (DirectBackend) Partitions(mm *MountManager, device string) ([]Partition, error) {
+	return mm.listPartitions(device)
+}
+
+func (DirectBackend) Detach(mm *MountManager, device string) error {
+	return nil
+}
+
+// Owns never claims a device, since there is nothing to tear down
+func (DirectBackend) Owns(device string) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,180 @@
+package mountmanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/larsks/pmount/internal/parttable"
+)
+
+func TestBackendOwns(t *testing.T) {
+	mm, err := NewMountManager("/dev/sda", "/mnt/test", "", "", "default")
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+
+	tests := []struct {
+		device  string
+		backend string
+		want    string
+	}{
+		{"/dev/nbd1p2", "nbd", "/dev/nbd1"},
+		{"/dev/nbd12", "nbd", "/dev/nbd12"},
+		{"/dev/loop3p1", "loop", "/dev/loop3"},
+		{"/dev/loop3", "loop", "/dev/loop3"},
+		{"/dev/sda1", "", ""},
+		{"/dev/mapper/vg-root", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.device, func(t *testing.T) {
+			var owner, device string
+			for _, backend := range mm.backends {
+				if d, ok := backend.Owns(tt.device); ok {
+					owner, device = backend.Name(), d
+					break
+				}
+			}
+			if owner != tt.backend || device != tt.want {
+				t.Errorf("owner of %s = %q (%q), want %q (%q)", tt.device, owner, device, tt.backend, tt.want)
+			}
+		})
+	}
+}
+
+func TestMountDirectBackend(t *testing.T) {
+	targetDir := t.TempDir()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if mm.backend.Name() != "direct" || mm.device != "/dev/sdz" {
+		t.Errorf("Expected direct backend on /dev/sdz, got %s on %s", mm.backend.Name(), mm.device)
+	}
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"mount /dev/sdz1 " + targetDir,
+	})
+}
+
+func TestPartitionNode(t *testing.T) {
+	tests := []struct {
+		device string
+		number int
+		want   string
+	}{
+		{"/dev/sda", 1, "/dev/sda1"},
+		{"/dev/vdb", 12, "/dev/vdb12"},
+		{"/dev/nbd0", 2, "/dev/nbd0p2"},
+		{"/dev/loop7", 5, "/dev/loop7p5"},
+		{"/dev/mmcblk0", 1, "/dev/mmcblk0p1"},
+		{"/dev/nvme0n1", 3, "/dev/nvme0n1p3"},
+	}
+	for _, tt := range tests {
+		if got := partitionNode(tt.device, tt.number); got != tt.want {
+			t.Errorf("partitionNode(%s, %d) = %s, want %s", tt.device, tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestListPartitionsFromImage(t *testing.T) {
+	// A DOS partition table with partitions 1 and 3
+	header := make([]byte, 1<<20)
+	for _, part := range []struct{ index, start, sectors int }{{0, 2048, 4096}, {2, 6144, 8192}} {
+		entry := header[446+part.index*16:]
+		entry[4] = 0x83
+		binary.LittleEndian.PutUint32(entry[8:], uint32(part.start))
+		binary.LittleEndian.PutUint32(entry[12:], uint32(part.sectors))
+	}
+	binary.LittleEndian.PutUint32(header[440:], 0x7351b90c)
+	header[510], header[511] = 0x55, 0xaa
+	image := writeImage(t, header)
+
+	var plan bytes.Buffer
+	mm := newTestManager(t, image, t.TempDir(), "default", NewFakeRunner(), WithDryRun(&plan))
+	setLoopController(mm, newFakeLoopController(2))
+	if err := mm.attach(); err != nil {
+		t.Fatalf("attach() error = %v", err)
+	}
+
+	partitions, err := mm.listPartitions(mm.device)
+	if err != nil {
+		t.Fatalf("listPartitions() error = %v", err)
+	}
+	if len(partitions) != 2 {
+		t.Fatalf("Expected 2 partitions, got %+v", partitions)
+	}
+	if partitions[0].Device != "/dev/loopNp1" || partitions[0].HumanSize() != "2.0M" {
+		t.Errorf("Unexpected first partition: %+v", partitions[0])
+	}
+	if partitions[1].Device != "/dev/loopNp3" || partitions[1].HumanSize() != "4.0M" {
+		t.Errorf("Unexpected second partition: %+v", partitions[1])
+	}
+
+	// Partitions keep their real numbers and extents
+	third := partitions[1]
+	if third.Number != 3 || third.Start != 6144*512 || third.Size != 8192*512 || third.Type != "83" {
+		t.Errorf("Unexpected extents for partition 3: %+v", third)
+	}
+	if third.PartUUID != "7351b90c-03" {
+		t.Errorf("Expected PARTUUID 7351b90c-03, got %q", third.PartUUID)
+	}
+}
+
+func TestListPartitionsGPT(t *testing.T) {
+	table := &parttable.Table{
+		Label: "gpt",
+		ID:    "5A3C1B2E-0000-4000-8000-0000000000AA",
+		Partitions: []parttable.Partition{{
+			Number: 2,
+			Start:  1 << 20,
+			Size:   64 << 20,
+			Type:   "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+			GUID:   "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+			Name:   "EFI System",
+		}},
+	}
+	fakeReadPartitionTable(t, "/dev/sdz", table, nil)
+	mm := newTestManager(t, "/dev/sdz", t.TempDir(), "default", NewFakeRunner())
+
+	partitions, err := mm.listPartitions("/dev/sdz")
+	if err != nil {
+		t.Fatalf("listPartitions() error = %v", err)
+	}
+	want := Partition{
+		Device:    "/dev/sdz2",
+		Number:    2,
+		Start:     1 << 20,
+		Size:      64 << 20,
+		Type:      "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+		PartLabel: "EFI System",
+		PartUUID:  "0fc63daf-8483-4772-8e79-3d69d8477de4",
+	}
+	if len(partitions) != 1 || !reflect.DeepEqual(partitions[0], want) {
+		t.Errorf("listPartitions() = %+v, want %+v", partitions, want)
+	}
+}
+
+func TestProbePartitions(t *testing.T) {
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz1", "DEVNAME=/dev/sdz1\nUUID=4B2C-19F0\nLABEL=bootfs\nTYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/sdz2", "", errors.New("exit status 2"))
+	mm := newTestManager(t, "/dev/sdz", t.TempDir(), "default", runner)
+
+	partitions := []Partition{{Device: "/dev/sdz1", Number: 1}, {Device: "/dev/sdz2", Number: 2}}
+	mm.probePartitions(partitions)
+
+	if p := partitions[0]; p.FSType != "vfat" || p.Label != "bootfs" || p.UUID != "4B2C-19F0" {
+		t.Errorf("Unexpected probe result for /dev/sdz1: %+v", p)
+	}
+	// Partitions without a recognisable filesystem are left blank
+	if p := partitions[1]; p.FSType != "" || p.Label != "" || p.UUID != "" {
+		t.Errorf("Expected no filesystem on /dev/sdz2, got %+v", p)
+	}
+}
@@ -0,0 +1,423 @@
+package mountmanager
+
+import (
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// binfmtMiscDir is where the kernel lists binfmt_misc handlers
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// hostArch is the qemu name of the architecture pmount runs on
+var hostArch = goArchs[runtime.GOARCH]
+
+// lookPath finds programs on the host. Tests replace it.
+var lookPath = exec.LookPath
+
+// goArchs maps Go architecture names to the names qemu uses
+var goArchs = map[string]string{
+	"386":      "i386",
+	"amd64":    "x86_64",
+	"arm":      "arm",
+	"arm64":    "aarch64",
+	"loong64":  "loongarch64",
+	"mips":     "mips",
+	"mipsle":   "mipsel",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+	"ppc64":    "ppc64",
+	"ppc64le":  "ppc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// compatibleArchs lists the architectures a host runs natively besides its own
+var compatibleArchs = map[string][]string{
+	"x86_64": {"i386"},
+}
+
+// rootShells are the binaries whose architecture is taken to be that of a
+// root filesystem, in order of preference
+var rootShells = []string{"/bin/sh", "/usr/bin/sh", "/bin/busybox"}
+
+// binfmtHandler is a binfmt_misc handler that recognizes binaries by magic
+type binfmtHandler struct {
+	Name        string
+	Interpreter string
+	Flags       string
+	Offset      int
+	Magic       []byte
+	Mask        []byte
+}
+
+// matches reports whether the handler recognizes a binary that starts with
+// header
+func (h *binfmtHandler) matches(header []byte) bool {
+	if h.Offset+len(h.Magic) > len(header) {
+		return false
+	}
+	for i, b := range h.Magic {
+		mask := byte(0xff)
+		if i < len(h.Mask) {
+			mask = h.Mask[i]
+		}
+		if header[h.Offset+i]&mask != b&mask {
+			return false
+		}
+	}
+	return true
+}
+
+// parseBinfmtHandler parses the description of a handler in binfmtMiscDir.
+// Disabled handlers, and handlers matching file name extensions rather than
+// magic, yield nil.
+func parseBinfmtHandler(name string, data []byte) (*binfmtHandler, error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if lines[0] != "enabled" {
+		return nil, nil
+	}
+
+	h := &binfmtHandler{Name: name}
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "interpreter":
+			h.Interpreter = value
+		case "flags:":
+			h.Flags = value
+		case "offset":
+			h.Offset, err = strconv.Atoi(value)
+		case "magic":
+			h.Magic, err = hex.DecodeString(value)
+		case "mask":
+			h.Mask, err = hex.DecodeString(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid binfmt_misc handler %s: %q: %w", name, line, err)
+		}
+	}
+	if len(h.Magic) == 0 {
+		return nil, nil
+	}
+	return h, nil
+}
+
+// binfmtHandlers returns the enabled binfmt_misc handlers that recognize
+// binaries by magic
+func binfmtHandlers() ([]*binfmtHandler, error) {
+	status, err := os.ReadFile(filepath.Join(binfmtMiscDir, "status"))
+	if err != nil {
+		return nil, fmt.Errorf("binfmt_misc is not mounted on %s", binfmtMiscDir)
+	}
+	if strings.TrimSpace(string(status)) != "enabled" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(binfmtMiscDir)
+	if err != nil {
+		return nil, err
+	}
+	var handlers []*binfmtHandler
+	for _, entry := range entries {
+		if entry.Name() == "status" || entry.Name() == "register" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(binfmtMiscDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		h, err := parseBinfmtHandler(entry.Name(), data)
+		if err != nil {
+			return nil, err
+		}
+		if h != nil {
+			handlers = append(handlers, h)
+		}
+	}
+	return handlers, nil
+}
+
+// elfArch returns the qemu name of the architecture of an ELF binary, or ""
+// if qemu has no name for it
+func elfArch(f *elf.File) string {
+	little := f.Data == elf.ELFDATA2LSB
+	pick := func(le, be string) string {
+		if little {
+			return le
+		}
+		return be
+	}
+
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "x86_64"
+	case elf.EM_386:
+		return "i386"
+	case elf.EM_AARCH64:
+		return pick("aarch64", "aarch64_be")
+	case elf.EM_ARM:
+		return pick("arm", "armeb")
+	case elf.EM_RISCV:
+		if f.Class == elf.ELFCLASS64 {
+			return "riscv64"
+		}
+		return "riscv32"
+	case elf.EM_PPC64:
+		return pick("ppc64le", "ppc64")
+	case elf.EM_PPC:
+		return "ppc"
+	case elf.EM_S390:
+		return "s390x"
+	case elf.EM_MIPS:
+		if f.Class == elf.ELFCLASS64 {
+			return pick("mips64el", "mips64")
+		}
+		return pick("mipsel", "mips")
+	case elf.EM_LOONGARCH:
+		return "loongarch64"
+	}
+	return ""
+}
+
+// isStatic reports whether the ELF binary at path is statically linked,
+// and so runs in a chroot that lacks its shared libraries
+func isStatic(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close() //nolint:errcheck
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveInRoot resolves the symbolic links in name, an absolute path
+// within root, the way a process chrooted in root would, and returns the
+// resulting path on the host. The last component need not exist.
+func resolveInRoot(root, name string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(name, "/")
+	for links := 0; len(rest) > 0; {
+		part := rest[0]
+		rest = rest[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && len(rest) == 0 {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > 40 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// rootBinary returns the path on the host of the first of the root
+// filesystem's shells that exists
+func rootBinary(root string) (string, error) {
+	var lastErr error
+	for _, name := range rootShells {
+		path, err := resolveInRoot(root, name)
+		if err == nil {
+			if _, err = os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// readHeader returns the first bytes of a file, as many as binfmt_misc
+// looks at
+func readHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+	header := make([]byte, 256)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// bindInterpreter makes binaries of a foreign architecture run in the
+// chroot. This takes a binfmt_misc handler registered for the architecture
+// (as by the qemu-user-static package). A handler registered with the F
+// flag has its interpreter loaded already; otherwise the kernel looks for it
+// within the chroot, so a static qemu-<arch>-static from the host is bound
+// there unless the root filesystem has one of its own.
+func (mm *MountManager) bindInterpreter(root string) error {
+	if mm.dryRun {
+		mm.logger.Printf("dry run: not checking the architecture of %s, which is not mounted", root)
+		return nil
+	}
+
+	path, err := rootBinary(root)
+	if err != nil {
+		mm.logger.Printf("warning: cannot tell the architecture of %s (%v); assuming it is %s", root, err, hostArch)
+		return nil
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		mm.logger.Printf("warning: cannot tell the architecture of %s (%v); assuming it is %s", root, err, hostArch)
+		return nil
+	}
+	arch := elfArch(f)
+	if arch == "" {
+		arch = strings.ToLower(strings.TrimPrefix(f.Machine.String(), "EM_"))
+	}
+	f.Close() //nolint:errcheck
+	if arch == hostArch || slices.Contains(compatibleArchs[hostArch], arch) {
+		return nil
+	}
+	header, err := readHeader(path)
+	if err != nil {
+		return err
+	}
+
+	handlers, err := binfmtHandlers()
+	if err != nil {
+		return fmt.Errorf("cannot run %s binaries: %w", arch, err)
+	}
+	var handler *binfmtHandler
+	for _, h := range handlers {
+		if h.matches(header) {
+			handler = h
+			break
+		}
+	}
+	if handler == nil {
+		return fmt.Errorf("cannot run %s binaries: no binfmt_misc handler is registered for them (install qemu-user-static)", arch)
+	}
+	if strings.Contains(handler.Flags, "F") {
+		mm.logger.Printf("running %s binaries with %s", arch, handler.Interpreter)
+		return nil
+	}
+
+	dir, err := resolveInRoot(root, handler.Interpreter)
+	if err != nil {
+		return fmt.Errorf("cannot run %s binaries: %w", arch, err)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		mm.logger.Printf("running %s binaries with %s from %s", arch, handler.Interpreter, root)
+		return nil
+	}
+
+	interpreter, err := lookPath("qemu-" + arch + "-static")
+	if err != nil {
+		if !isStatic(handler.Interpreter) {
+			return fmt.Errorf("cannot run %s binaries: binfmt_misc handler %s needs %s within the chroot, and there is no static qemu-%s-static to bind there", arch, handler.Name, handler.Interpreter, arch)
+		}
+		interpreter = handler.Interpreter
+	}
+
+	if err := mm.interpreterMountpoint(root, dir); err != nil {
+		return fmt.Errorf("cannot run %s binaries: %w", arch, err)
+	}
+	if err := mm.bindMount(interpreter, dir, true); err != nil {
+		return err
+	}
+	mm.logger.Printf("running %s binaries with %s", arch, interpreter)
+	return nil
+}
+
+// interpreterMountpoint creates an empty file at path, within the root
+// filesystem at root, for the interpreter to be bound onto, without writing
+// to the root filesystem (which may well be read-only). An overlay whose
+// changes go to a tmpfs is mounted over the closest existing directory
+// holding path, and the file, with any directories missing before it, is
+// created in the overlay. Everything goes away at teardown.
+func (mm *MountManager) interpreterMountpoint(root, path string) error {
+	lower := filepath.Dir(path)
+	for {
+		if info, err := os.Stat(lower); err == nil && info.IsDir() {
+			break
+		}
+		lower = filepath.Dir(lower)
+	}
+	if !isWithin(lower, root) || lower == root {
+		return fmt.Errorf("%s has no directory for %s", root, path)
+	}
+	if strings.ContainsAny(lower, ",:") {
+		return fmt.Errorf("cannot mount an overlay on %s: overlay directories must not contain commas or colons", lower)
+	}
+
+	scratch := filepath.Join(mm.overlayRoot(), "binfmt")
+	if err := mm.mkdirAll(scratch); err != nil {
+		return fmt.Errorf("failed to create %s: %w", scratch, err)
+	}
+	if mm.state.OverlayDir == "" {
+		mm.state.OverlayDir = mm.overlayRoot()
+	}
+	if output, err := mm.runAction("mount", "-t", "tmpfs", "-o", "mode=0700", "tmpfs", scratch); err != nil {
+		return fmt.Errorf("failed to mount tmpfs on %s: %w", scratch, commandError(err, output))
+	}
+	mm.recordFilesystem("tmpfs", scratch, "")
+	upper := filepath.Join(scratch, "upper")
+	work := filepath.Join(scratch, "work")
+	for _, dir := range []string{upper, work} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if output, err := mm.runAction("mount", "-t", "overlay", "-o", opts, "overlay", lower); err != nil {
+		return fmt.Errorf("failed to mount an overlay on %s: %w", lower, commandError(err, output))
+	}
+	mm.recordFilesystem("overlay", lower, "")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	mountpoint, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	return mountpoint.Close()
+}
@@ -0,0 +1,248 @@
+package mountmanager
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// qemuAarch64Handler is binfmt_misc's description of the handler the
+// qemu-user-static package registers for aarch64 binaries
+const qemuAarch64Handler = `enabled
+interpreter /usr/bin/qemu-aarch64-static
+flags: %s
+offset 0
+magic 7f454c460201010000000000000000000200b700
+mask ffffffffffffff00fffffffffffffffffeffffff
+`
+
+// writeELF writes the header of a 64-bit little-endian ELF executable for
+// the given machine to path
+func writeELF(t *testing.T, path string, machine elf.Machine) {
+	t.Helper()
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Ehsize:    64,
+		Phentsize: 56,
+		Shentsize: 64,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+		t.Fatalf("Failed to encode ELF header: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0755); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// fakeBinfmt runs the test on an x86_64 host whose binfmt_misc handlers are
+// given by name, and whose qemu-*-static binaries are in qemuDir
+func fakeBinfmt(t *testing.T, handlers map[string]string, qemuDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	if handlers != nil {
+		handlers["status"] = "enabled\n"
+		handlers["register"] = ""
+	}
+	for name, data := range handlers {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write binfmt_misc handler: %v", err)
+		}
+	}
+
+	oldDir, oldArch, oldLookPath := binfmtMiscDir, hostArch, lookPath
+	binfmtMiscDir = dir
+	hostArch = "x86_64"
+	lookPath = func(name string) (string, error) {
+		path := filepath.Join(qemuDir, name)
+		if _, err := os.Stat(path); err != nil {
+			return "", errors.New("not found")
+		}
+		return path, nil
+	}
+	t.Cleanup(func() {
+		binfmtMiscDir, hostArch, lookPath = oldDir, oldArch, oldLookPath
+	})
+}
+
+func TestParseBinfmtHandler(t *testing.T) {
+	h, err := parseBinfmtHandler("qemu-aarch64", []byte(strings.Replace(qemuAarch64Handler, "%s", "OCF", 1)))
+	if err != nil {
+		t.Fatalf("parseBinfmtHandler() error = %v", err)
+	}
+	if h.Interpreter != "/usr/bin/qemu-aarch64-static" || h.Flags != "OCF" || len(h.Magic) != 20 || len(h.Mask) != 20 {
+		t.Errorf("parseBinfmtHandler() = %+v", h)
+	}
+
+	if h, err := parseBinfmtHandler("qemu-arm", []byte("disabled\ninterpreter /usr/bin/qemu-arm\n")); h != nil || err != nil {
+		t.Errorf("Expected a disabled handler to be ignored, got %+v, %v", h, err)
+	}
+	if h, err := parseBinfmtHandler("DOSWin", []byte("enabled\ninterpreter /usr/bin/wine\nflags: \nextension .exe\n")); h != nil || err != nil {
+		t.Errorf("Expected an extension handler to be ignored, got %+v, %v", h, err)
+	}
+	if _, err := parseBinfmtHandler("broken", []byte("enabled\nmagic 7f45zz\n")); err == nil {
+		t.Error("Expected parseBinfmtHandler() to reject invalid magic")
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	writeELF(t, filepath.Join(root, "usr", "bin", "dash"), elf.EM_AARCH64)
+	// A merged /usr, with an absolute link that must not escape the root
+	if err := os.Symlink("usr/bin", filepath.Join(root, "bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/bin/dash", filepath.Join(root, "usr", "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.Join(root, "usr", "bin", "dash")
+	if got, err := resolveInRoot(root, "/bin/sh"); err != nil || got != want {
+		t.Errorf("resolveInRoot(/bin/sh) = %q, %v; want %q", got, err, want)
+	}
+	if got, err := resolveInRoot(root, "/bin/../../../bin/qemu"); err != nil || got != filepath.Join(root, "usr", "bin", "qemu") {
+		t.Errorf("resolveInRoot(/bin/../../../bin/qemu) = %q, %v", got, err)
+	}
+	if _, err := resolveInRoot(root, "/missing/sh"); err == nil {
+		t.Error("Expected resolveInRoot() to fail for a missing directory")
+	}
+}
+
+// foreignRootFS creates an aarch64 root filesystem in dir
+func foreignRootFS(t *testing.T, dir string) {
+	t.Helper()
+	fakeRootFS(t, dir)
+	writeELF(t, filepath.Join(dir, "bin", "sh"), elf.EM_AARCH64)
+	if err := os.MkdirAll(filepath.Join(dir, "usr", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBindInterpreterWithFixedHandler(t *testing.T) {
+	root := t.TempDir()
+	foreignRootFS(t, root)
+	fakeBinfmt(t, map[string]string{"qemu-aarch64": strings.Replace(qemuAarch64Handler, "%s", "OCF", 1)}, t.TempDir())
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", root, "single", runner)
+
+	if err := mm.bindInterpreter(root); err != nil {
+		t.Fatalf("bindInterpreter() error = %v", err)
+	}
+	if commands := runner.Commands(); len(commands) > 0 {
+		t.Errorf("Expected nothing to be bound, got %q", commands)
+	}
+}
+
+func TestBindInterpreterNative(t *testing.T) {
+	root := t.TempDir()
+	fakeRootFS(t, root)
+	writeELF(t, filepath.Join(root, "bin", "sh"), elf.EM_X86_64)
+	// binfmt_misc is not even looked at
+	fakeBinfmt(t, nil, t.TempDir())
+	mm := newTestManager(t, "/dev/sdz", root, "single", NewFakeRunner())
+
+	if err := mm.bindInterpreter(root); err != nil {
+		t.Fatalf("bindInterpreter() error = %v", err)
+	}
+}
+
+func TestBindInterpreterWithoutHandler(t *testing.T) {
+	root := t.TempDir()
+	foreignRootFS(t, root)
+	fakeBinfmt(t, map[string]string{}, t.TempDir())
+	mm := newTestManager(t, "/dev/sdz", root, "single", NewFakeRunner())
+
+	err := mm.bindInterpreter(root)
+	if err == nil || !strings.Contains(err.Error(), "no binfmt_misc handler") {
+		t.Errorf("Expected bindInterpreter() to fail without a handler, got %v", err)
+	}
+}
+
+func TestExecBindsInterpreter(t *testing.T) {
+	fakeSignals(t)
+	targetDir := t.TempDir()
+	foreignRootFS(t, targetDir)
+	qemuDir := t.TempDir()
+	qemu := filepath.Join(qemuDir, "qemu-aarch64-static")
+	writeELF(t, qemu, elf.EM_X86_64)
+	fakeBinfmt(t, map[string]string{"qemu-aarch64": strings.Replace(qemuAarch64Handler, "%s", "", 1)}, qemuDir)
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := trackingRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner)
+
+	dir := filepath.Join(targetDir, "usr", "bin", "qemu-aarch64-static")
+	runner.Handle("chroot", func(args []string) ([]byte, error) {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("Expected %s to exist while the command runs: %v", dir, err)
+		}
+		return nil, nil
+	})
+	if err := mm.Exec([]string{"true"}); err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+
+	// The file bound onto is created in an overlay, not in the image
+	commands := runner.Commands()
+	bin := filepath.Join(targetDir, "usr", "bin")
+	scratch := filepath.Join(mm.overlayRoot(), "binfmt")
+	for _, want := range []string{
+		"mount -t tmpfs -o mode=0700 tmpfs " + scratch,
+		"mount -t overlay -o lowerdir=" + bin + ",upperdir=" + scratch + "/upper,workdir=" + scratch + "/work overlay " + bin,
+		"mount --rbind " + qemu + " " + dir,
+		"umount -R " + dir,
+		"umount " + bin,
+		"umount " + scratch,
+	} {
+		if !containsCommand(commands, want) {
+			t.Errorf("Expected %q among %q", want, commands)
+		}
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed after teardown", dir)
+	}
+	if _, err := os.Stat(mm.overlayRoot()); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed after teardown", mm.overlayRoot())
+	}
+}
+
+func TestInterpreterMountpointMissingDirectory(t *testing.T) {
+	root := t.TempDir()
+	fakeRootFS(t, root)
+	if err := os.MkdirAll(filepath.Join(root, "usr"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", root, "single", runner)
+	mm.beginState()
+
+	// The overlay goes over the closest directory that exists
+	path := filepath.Join(root, "usr", "bin", "qemu-aarch64-static")
+	if err := mm.interpreterMountpoint(root, path); err != nil {
+		t.Fatalf("interpreterMountpoint() error = %v", err)
+	}
+	usr := filepath.Join(root, "usr")
+	want := "overlay " + usr
+	if commands := runner.Commands(); len(commands) != 2 || !strings.HasSuffix(commands[1], want) {
+		t.Errorf("Expected an overlay on %s, got %q", usr, commands)
+	}
+
+	// The root filesystem itself is never overlaid
+	if err := mm.interpreterMountpoint(root, filepath.Join(root, "opt", "qemu", "qemu-aarch64-static")); err == nil {
+		t.Error("Expected interpreterMountpoint() to fail without a directory to overlay")
+	}
+}
@@ -0,0 +1,224 @@
+package mountmanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// apiFilesystems are bind-mounted from the host into a chroot, in order,
+// together with the filesystems mounted beneath them (such as /dev/pts and
+// the cgroup filesystems under /sys)
+var apiFilesystems = []string{"/dev", "/proc", "/sys", "/run"}
+
+// resolvConfPath is the host's resolver configuration, which is copied into
+// a chroot
+var resolvConfPath = "/etc/resolv.conf"
+
+// notifySignals arranges for the signals that would otherwise terminate
+// pmount to be delivered on c instead. Tests replace it to deliver signals
+// themselves.
+var notifySignals = func(c chan<- os.Signal) {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+}
+
+// stopSignals undoes notifySignals
+var stopSignals = func(c chan<- os.Signal) {
+	signal.Stop(c)
+}
+
+// Exec mounts the source, runs a command chrooted in its root filesystem
+// with the host's API filesystems and resolver configuration bound into it,
+// and then tears everything down in reverse order. An empty command starts
+// an interactive shell. Root filesystems of another architecture are run
+// with qemu, as set up by bindInterpreter.
+//
+// A termination signal received before the command starts cancels it. While
+// the command runs, SIGTERM and SIGHUP are passed on to it; SIGINT is left
+// to the command, which receives it from the terminal as well. Either way
+// pmount itself keeps running until everything has been torn down.
+func (mm *MountManager) Exec(command []string) (err error) {
+	signals := make(chan os.Signal, 1)
+	notifySignals(signals)
+	defer stopSignals(signals)
+
+	if err := mm.Mount(); err != nil {
+		return err
+	}
+	var resolvConf string
+	defer func() {
+		if mm.dryRun {
+			return
+		}
+		mm.state.Device = mm.device
+		if teardownErr := mm.unmountState(mm.state); teardownErr != nil && err == nil {
+			err = teardownErr
+		}
+		if resolvConf != "" {
+			os.Remove(resolvConf) //nolint:errcheck
+		}
+	}()
+
+	root, err := mm.rootDir()
+	if err != nil {
+		return err
+	}
+	if err := mm.bindAPIFilesystems(root); err != nil {
+		return err
+	}
+	if resolvConf, err = mm.bindResolvConf(root); err != nil {
+		return err
+	}
+	if err := mm.bindInterpreter(root); err != nil {
+		return err
+	}
+	if err := mm.saveState(); err != nil {
+		mm.logger.Printf("warning: %v", err)
+	}
+
+	select {
+	case sig := <-signals:
+		return fmt.Errorf("interrupted by %v before running the command", sig)
+	default:
+	}
+
+	if len(command) == 0 {
+		command = []string{mm.shell(root), "-l"}
+	}
+	args := append([]string{root}, command...)
+	if mm.dryRun {
+		mm.plan("chroot", args...)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig != os.Interrupt {
+					mm.logger.Printf("received %v; stopping %s", sig, command[0])
+					cancel()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	mm.logger.Printf("running %s in %s", command[0], root)
+	return mm.runner.Interactive(ctx, "chroot", args...)
+}
+
+// looksLikeRoot reports whether a directory holds a root filesystem
+func looksLikeRoot(dir string) bool {
+	if info, err := os.Stat(filepath.Join(dir, "etc")); err != nil || !info.IsDir() {
+		return false
+	}
+	for _, bin := range []string{"bin", "usr/bin"} {
+		if info, err := os.Stat(filepath.Join(dir, bin)); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// rootDir returns the directory holding the root filesystem: the target
+// directory itself (as mounted by the single and raspberrypi profiles), or
+// else the only mounted partition that holds one
+func (mm *MountManager) rootDir() (string, error) {
+	if mm.dryRun || looksLikeRoot(mm.targetDir) {
+		return mm.targetDir, nil
+	}
+
+	var roots []string
+	for _, partition := range mm.state.Partitions {
+		if looksLikeRoot(partition.Mountpoint) {
+			roots = append(roots, partition.Mountpoint)
+		}
+	}
+	switch len(roots) {
+	case 0:
+		return "", fmt.Errorf("no root filesystem found beneath %s", mm.targetDir)
+	case 1:
+		return roots[0], nil
+	default:
+		return "", fmt.Errorf("more than one root filesystem found beneath %s (%s and %s); use a profile that mounts one on the target directory", mm.targetDir, roots[0], roots[1])
+	}
+}
+
+// bindMount bind-mounts a host path, and whatever is mounted beneath it,
+// onto a path within the chroot. The bind is made a slave so that mounts
+// and unmounts within the chroot never propagate back to the host (whose
+// mounts are usually shared). When created is set, dir was created by pmount
+// to mount on and is removed again at teardown.
+func (mm *MountManager) bindMount(source, dir string, created bool) error {
+	if output, err := mm.runAction("mount", "--rbind", source, dir); err != nil {
+		return fmt.Errorf("failed to bind %s to %s: %w", source, dir, commandError(err, output))
+	}
+	mm.recordBind(source, dir, created)
+	if output, err := mm.runAction("mount", "--make-rslave", dir); err != nil {
+		return fmt.Errorf("failed to make %s a slave mount: %w", dir, commandError(err, output))
+	}
+	return nil
+}
+
+// bindAPIFilesystems binds /dev, /proc, /sys and /run into the chroot. Filesystems the root filesystem has no directory for are skipped.
+func (mm *MountManager) bindAPIFilesystems(root string) error {
+	for _, fs := range apiFilesystems {
+		dir := filepath.Join(root, fs)
+		if info, err := os.Stat(dir); !mm.dryRun && (err != nil || !info.IsDir()) {
+			mm.logger.Printf("not binding %s: %s is not a directory", fs, dir)
+			continue
+		}
+		if err := mm.bindMount(fs, dir, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindResolvConf binds a copy of the host's resolver configuration over the
+// chroot's, so that name resolution works inside it, and returns the path of
+// the copy. A resolv.conf that is missing or is a symlink (typically into
+// /run, which is bound from the host anyway) is left alone.
+func (mm *MountManager) bindResolvConf(root string) (string, error) {
+	dir := filepath.Join(root, "etc", "resolv.conf")
+	if mm.dryRun {
+		mm.plan("mount", "--rbind", filepath.Join(os.TempDir(), "pmount-resolv.conf-*"), dir)
+		mm.plan("mount", "--make-rslave", dir)
+		return "", nil
+	}
+	if info, err := os.Lstat(dir); err != nil || !info.Mode().IsRegular() {
+		mm.logger.Printf("not binding resolv.conf: %s is not a regular file", dir)
+		return "", nil
+	}
+	data, err := os.ReadFile(resolvConfPath)
+	if err != nil {
+		mm.logger.Printf("not binding resolv.conf: %v", err)
+		return "", nil
+	}
+
+	f, err := os.CreateTemp("", "pmount-resolv.conf-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close() //nolint:errcheck
+	if _, err := f.Write(data); err != nil {
+		return f.Name(), err
+	}
+	return f.Name(), mm.bindMount(f.Name(), dir, false)
+}
+
+// shell returns the shell to start in the chroot: bash if it has one, and
+// sh otherwise
+func (mm *MountManager) shell(root string) string {
+	if _, err := os.Stat(filepath.Join(root, "bin", "bash")); err == nil {
+		return "/bin/bash"
+	}
+	return "/bin/sh"
+}
@@ -0,0 +1,166 @@
+package mountmanager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeRootFS creates the skeleton of a root filesystem in dir
+func fakeRootFS(t *testing.T, dir string) {
+	t.Helper()
+	for _, sub := range []string{"etc", "bin", "dev/pts", "proc", "sys", "run"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatalf("Failed to create root filesystem: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc", "resolv.conf"), []byte("nameserver 192.0.2.1\n"), 0644); err != nil {
+		t.Fatalf("Failed to create root filesystem: %v", err)
+	}
+}
+
+// fakeSignals replaces signal delivery for Exec, and returns the channel
+// Exec receives signals on once it has registered it
+func fakeSignals(t *testing.T) *chan<- os.Signal {
+	t.Helper()
+	var registered chan<- os.Signal
+	oldNotify, oldStop := notifySignals, stopSignals
+	notifySignals = func(c chan<- os.Signal) { registered = c }
+	stopSignals = func(c chan<- os.Signal) {}
+
+	oldResolvConf := resolvConfPath
+	resolvConfPath = filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(resolvConfPath, []byte("nameserver 198.51.100.1\n"), 0644); err != nil {
+		t.Fatalf("Failed to create resolv.conf: %v", err)
+	}
+
+	t.Cleanup(func() {
+		notifySignals, stopSignals = oldNotify, oldStop
+		resolvConfPath = oldResolvConf
+	})
+	return &registered
+}
+
+// trackingRunner scripts a single-partition /dev/sdz whose mounts findmnt
+// reports as they are made
+func trackingRunner() *FakeRunner {
+	mounted := make(map[string]string)
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz1", "TYPE=ext4\n", nil)
+	runner.Handle("mount", func(args []string) ([]byte, error) {
+		if args[0] != "--make-rslave" {
+			mounted[args[len(args)-1]] = args[len(args)-2]
+		}
+		return nil, nil
+	})
+	runner.Handle("findmnt", func(args []string) ([]byte, error) {
+		if source, ok := mounted[args[len(args)-1]]; ok {
+			return []byte(findmntJSON(args[len(args)-1], source)), nil
+		}
+		return nil, os.ErrNotExist
+	})
+	return runner
+}
+
+func TestExec(t *testing.T) {
+	fakeSignals(t)
+	targetDir := t.TempDir()
+	fakeRootFS(t, targetDir)
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := trackingRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner)
+
+	if err := mm.Exec([]string{"cat", "/etc/os-release"}); err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+
+	var resolvConf string
+	for _, call := range runner.Calls {
+		if call.Name == "mount" && call.Args[0] == "--rbind" && call.Args[2] == filepath.Join(targetDir, "etc", "resolv.conf") {
+			resolvConf = call.Args[1]
+		}
+	}
+	if !strings.HasPrefix(filepath.Base(resolvConf), "pmount-resolv.conf-") {
+		t.Fatalf("Expected a copy of resolv.conf to be bound, got %q", resolvConf)
+	}
+	if _, err := os.Stat(resolvConf); !os.IsNotExist(err) {
+		t.Error("The copy of resolv.conf should be removed")
+	}
+
+	dir := func(path string) string { return filepath.Join(targetDir, path) }
+	binds := []string{"/dev", "/proc", "/sys", "/run"}
+	want := []string{
+		"blkid -p -o export /dev/sdz1",
+		"mount /dev/sdz1 " + targetDir,
+	}
+	for _, fs := range binds {
+		want = append(want, "mount --rbind "+fs+" "+dir(fs), "mount --make-rslave "+dir(fs))
+	}
+	want = append(want,
+		"mount --rbind "+resolvConf+" "+dir("etc/resolv.conf"),
+		"mount --make-rslave "+dir("etc/resolv.conf"),
+		"chroot "+targetDir+" cat /etc/os-release",
+		"findmnt -J -M "+dir("etc/resolv.conf"),
+		"umount -R "+dir("etc/resolv.conf"),
+	)
+	for i := len(binds) - 1; i >= 0; i-- {
+		want = append(want, "findmnt -J -M "+dir(binds[i]), "umount -R "+dir(binds[i]))
+	}
+	want = append(want, "findmnt -J -M "+targetDir, "umount "+targetDir)
+	assertCommands(t, runner, want)
+}
+
+func TestExecInterrupted(t *testing.T) {
+	signals := fakeSignals(t)
+	targetDir := t.TempDir()
+	fakeRootFS(t, targetDir)
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := trackingRunner()
+	mount := runner.handlers["mount"]
+	runner.Handle("mount", func(args []string) ([]byte, error) {
+		if args[0] == "/dev/sdz1" {
+			*signals <- syscall.SIGTERM
+		}
+		return mount(args)
+	})
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner)
+
+	if err := mm.Exec(nil); err == nil {
+		t.Fatal("Expected Exec() to fail when interrupted")
+	}
+	commands := runner.Commands()
+	for _, command := range commands {
+		if strings.HasPrefix(command, "chroot") {
+			t.Errorf("The command should not run once interrupted, got %q", command)
+		}
+	}
+	if !containsCommand(commands, "umount "+targetDir) {
+		t.Errorf("Expected everything to be torn down, got %q", commands)
+	}
+}
+
+func TestRootDir(t *testing.T) {
+	targetDir := t.TempDir()
+	bootDir := filepath.Join(targetDir, "partition1")
+	rootDir := filepath.Join(targetDir, "partition2")
+	fakeRootFS(t, rootDir)
+	if err := os.MkdirAll(bootDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	mm := newTestManager(t, "/dev/sdz", targetDir, "default", NewFakeRunner())
+	mm.state = &MountState{Partitions: []MountedPartition{
+		{Device: "/dev/sdz1", Mountpoint: bootDir},
+		{Device: "/dev/sdz2", Mountpoint: rootDir},
+	}}
+	if got, err := mm.rootDir(); err != nil || got != rootDir {
+		t.Errorf("rootDir() = %q, %v; want %q", got, err, rootDir)
+	}
+
+	mm.state.Partitions = mm.state.Partitions[:1]
+	if _, err := mm.rootDir(); err == nil {
+		t.Error("Expected rootDir() to fail without a root filesystem")
+	}
+}
@@ -0,0 +1,115 @@
+package mountmanager
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ProfileMatch reports whether a profile validates against a source's
+// partitions, and why not if it does not
+type ProfileMatch struct {
+	Name   string `json:"name"`
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SourceInfo describes the partition table of a device or image
+type SourceInfo struct {
+	Source string `json:"source"`
+
+	// Label is the partition table type (dos or gpt), or "none" when a
+	// filesystem takes up the whole source
+	Label      string      `json:"label"`
+	ID         string      `json:"id"`
+	SectorSize int         `json:"sector_size"`
+	Partitions []Partition `json:"partitions"`
+	Warnings   []string    `json:"warnings,omitempty"`
+
+	// Profiles lists every known profile and whether it would accept the
+	// partitions; AutoProfile is the one the auto profile would choose
+	Profiles    []ProfileMatch `json:"profiles"`
+	AutoProfile string         `json:"auto_profile"`
+}
+
+// Inspect reads the partition table of the source and probes each partition
+// without mounting anything. Raw images are parsed in place; other images
+// are attached read-only for as long as it takes and then detached.
+func (mm *MountManager) Inspect() (info *SourceInfo, err error) {
+	mm.readOnly = true
+
+	if mm.isImageFile() && mm.isRawImage() {
+		mm.partitions, err = mm.listPartitions(mm.sourceDevice)
+		if err != nil {
+			return nil, err
+		}
+		// Partitions of an image that is not attached have no device node
+		for i := range mm.partitions {
+			mm.partitions[i].Device = ""
+		}
+	} else {
+		if err := mm.attach(); err != nil {
+			return nil, err
+		}
+		mm.undoStack = nil
+		defer func() {
+			if detachErr := mm.detach(); detachErr != nil && err == nil {
+				err = fmt.Errorf("failed to detach %s: %w", mm.sourceDevice, detachErr)
+			}
+		}()
+
+		if err := mm.discoverPartitions(); err != nil {
+			return nil, err
+		}
+	}
+	mm.probeDiscovered()
+
+	info = &SourceInfo{
+		Source:     mm.sourceDevice,
+		Label:      mm.table.Label,
+		ID:         mm.table.ID,
+		SectorSize: mm.table.SectorSize,
+		Partitions: mm.partitions,
+		Warnings:   mm.table.Warnings,
+	}
+	if info.Profiles, err = matchProfiles(mm.partitions); err != nil {
+		return nil, err
+	}
+
+	// Filesystem contents are not inspected, since that would mean mounting
+	profile, err := (&AutoProfile{}).SelectProfile(nil, mm.partitions)
+	if err != nil {
+		return nil, err
+	}
+	info.AutoProfile = profile.Name()
+
+	return info, nil
+}
+
+// matchProfiles validates the partitions against every built-in and
+// user-defined profile
+func matchProfiles(partitions []Partition) ([]ProfileMatch, error) {
+	userProfiles, err := LoadUserProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []ProfileMatch
+	for _, name := range ProfileNames(userProfiles) {
+		var profile MountProfile
+		if slices.Contains(builtinProfiles, name) {
+			if profile, err = NewProfile(name); err != nil {
+				return nil, err
+			}
+		} else {
+			profile = userProfiles[name]
+		}
+
+		match := ProfileMatch{Name: name, Valid: true}
+		if err := profile.Validate(partitions); err != nil {
+			match.Valid = false
+			match.Reason = err.Error()
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
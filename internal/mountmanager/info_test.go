@@ -0,0 +1,128 @@
+package mountmanager
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestInspectRawImage(t *testing.T) {
+	fakeProfileDirs(t)
+
+	// A DOS partition table with two partitions
+	header := make([]byte, 1<<20)
+	for i, part := range []struct{ start, sectors int }{{2048, 4096}, {6144, 8192}} {
+		entry := header[446+i*16:]
+		entry[4] = 0x83
+		binary.LittleEndian.PutUint32(entry[8:], uint32(part.start))
+		binary.LittleEndian.PutUint32(entry[12:], uint32(part.sectors))
+	}
+	binary.LittleEndian.PutUint32(header[440:], 0x7351b90c)
+	header[510], header[511] = 0x55, 0xaa
+	image := writeImage(t, header)
+
+	runner := NewFakeRunner().
+		On("blkid -p -o export --offset 1048576 --size 2097152 "+image, "LABEL=bootfs\nTYPE=vfat\n", nil).
+		On("blkid -p -o export --offset 3145728 --size 4194304 "+image, "LABEL=rootfs\nTYPE=ext4\nUUID=0b1c\n", nil)
+	mm := newTestManager(t, image, "", "default", runner)
+
+	info, err := mm.Inspect()
+	if err != nil {
+		t.Fatalf("Inspect() error = %v", err)
+	}
+
+	// Raw images are parsed in place rather than attached
+	assertCommands(t, runner, []string{
+		"blkid -p -o export --offset 1048576 --size 2097152 " + image,
+		"blkid -p -o export --offset 3145728 --size 4194304 " + image,
+	})
+
+	if info.Label != "dos" || info.ID != "0x7351b90c" || info.SectorSize != 512 {
+		t.Errorf("Unexpected table: %s %s %d", info.Label, info.ID, info.SectorSize)
+	}
+	want := []Partition{
+		{Number: 1, Start: 1 << 20, Size: 2 << 20, Type: "83", PartUUID: "7351b90c-01", FSType: "vfat", Label: "bootfs"},
+		{Number: 2, Start: 3 << 20, Size: 4 << 20, Type: "83", PartUUID: "7351b90c-02", FSType: "ext4", Label: "rootfs", UUID: "0b1c"},
+	}
+	if !reflect.DeepEqual(info.Partitions, want) {
+		t.Errorf("Partitions = %+v, want %+v", info.Partitions, want)
+	}
+
+	wantProfiles := []ProfileMatch{
+		{Name: "default", Valid: true},
+		{Name: "single", Reason: "single profile requires exactly 1 partition, found 2"},
+		{Name: "raspberrypi", Valid: true},
+	}
+	if !reflect.DeepEqual(info.Profiles, wantProfiles) {
+		t.Errorf("Profiles = %+v, want %+v", info.Profiles, wantProfiles)
+	}
+	if info.AutoProfile != "raspberrypi" {
+		t.Errorf("Expected auto profile raspberrypi, got %s", info.AutoProfile)
+	}
+}
+
+func TestInspectAttachesImage(t *testing.T) {
+	fakeProfileDirs(t)
+	image := writeImage(t, []byte("QFI\xfb"))
+	fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, image, "", "default", runner)
+	mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd5"
+
+	info, err := mm.Inspect()
+	if err != nil {
+		t.Fatalf("Inspect() error = %v", err)
+	}
+
+	// Other images are attached read-only and detached again
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 --read-only " + image,
+		"blkid -p -o export /dev/nbd5p1",
+		"qemu-nbd --disconnect /dev/nbd5",
+	})
+	if len(info.Partitions) != 1 || info.Partitions[0].Device != "/dev/nbd5p1" {
+		t.Errorf("Unexpected partitions: %+v", info.Partitions)
+	}
+	if info.AutoProfile != "single" {
+		t.Errorf("Expected auto profile single, got %s", info.AutoProfile)
+	}
+}
+
+func TestInspectDetachesOnFailure(t *testing.T) {
+	image := writeImage(t, []byte("QFI\xfb"))
+	fakeReadPartitionTable(t, "/dev/nbd5", nil, errors.New("boom"))
+	runner := NewFakeRunner()
+	mm := newTestManager(t, image, "", "default", runner)
+	mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd5"
+
+	if _, err := mm.Inspect(); err == nil {
+		t.Fatal("Expected Inspect() to fail")
+	}
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 --read-only " + image,
+		"qemu-nbd --disconnect /dev/nbd5",
+	})
+}
+
+func TestInspectWholeDeviceImage(t *testing.T) {
+	fakeProfileDirs(t)
+	image := writeImage(t, []byte("hsqs"))
+
+	runner := NewFakeRunner().
+		On("blkid -p -o export "+image, "TYPE=squashfs\n", nil).
+		On("blkid -p -o export --offset 0 --size 4 "+image, "TYPE=squashfs\n", nil)
+	mm := newTestManager(t, image, "", "default", runner)
+
+	info, err := mm.Inspect()
+	if err != nil {
+		t.Fatalf("Inspect() error = %v", err)
+	}
+	if info.Label != "none" {
+		t.Errorf("Label = %q, want none", info.Label)
+	}
+	want := []Partition{{Number: 1, Size: 4, FSType: "squashfs"}}
+	if !reflect.DeepEqual(info.Partitions, want) {
+		t.Errorf("Partitions = %+v, want %+v", info.Partitions, want)
+	}
+}
@@ -0,0 +1,228 @@
+package mountmanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	loopControlDevice = "/dev/loop-control"
+
+	// dryRunLoopDevice stands in for the loop device a dry run would use
+	dryRunLoopDevice = "/dev/loopN"
+)
+
+// loopController attaches files to loop devices
+type loopController interface {
+	// Available reports whether loop devices can be used on this host
+	Available() bool
+
+	// Free returns the path of an unused loop device
+	Free() (string, error)
+
+	// Attach binds a file to a loop device and scans it for partitions
+	Attach(device, path string, readOnly bool) error
+
+	// Detach releases a loop device
+	Detach(device string) error
+}
+
+// kernelLoopController manages loop devices using the loop ioctls, as
+// losetup does
+type kernelLoopController struct{}
+
+func (kernelLoopController) Available() bool {
+	_, err := os.Stat(loopControlDevice)
+	return err == nil
+}
+
+func (kernelLoopController) Free() (string, error) {
+	ctl, err := os.OpenFile(loopControlDevice, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer ctl.Close() //nolint:errcheck
+
+	index, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+	if err != nil {
+		return "", fmt.Errorf("LOOP_CTL_GET_FREE: %w", err)
+	}
+	return fmt.Sprintf("/dev/loop%d", index), nil
+}
+
+func (kernelLoopController) Attach(device, path string, readOnly bool) error {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+
+	backing, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return err
+	}
+	defer backing.Close() //nolint:errcheck
+
+	loop, err := os.OpenFile(device, flags, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close() //nolint:errcheck
+
+	info := unix.LoopInfo64{Flags: unix.LO_FLAGS_PARTSCAN}
+	if readOnly {
+		info.Flags |= unix.LO_FLAGS_READ_ONLY
+	}
+	copy(info.File_name[:len(info.File_name)-1], path)
+
+	config := unix.LoopConfig{Fd: uint32(backing.Fd()), Info: info}
+	err = unix.IoctlLoopConfigure(int(loop.Fd()), &config)
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+		// LOOP_CONFIGURE is not available before Linux 5.8
+		if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd())); err != nil {
+			return fmt.Errorf("LOOP_SET_FD: %w", err)
+		}
+		if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), &info); err != nil {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0) //nolint:errcheck
+			return fmt.Errorf("LOOP_SET_STATUS64: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("LOOP_CONFIGURE: %w", err)
+	}
+	return nil
+}
+
+func (kernelLoopController) Detach(device string) error {
+	loop, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close() //nolint:errcheck
+
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0); err != nil {
+		return fmt.Errorf("LOOP_CLR_FD: %w", err)
+	}
+	return nil
+}
+
+// imageMagic identifies image formats that qemu-nbd can serve but the loop
+// driver cannot
+var imageMagic = []struct {
+	format string
+	offset int64
+	magic  []byte
+}{
+	{"qcow2", 0, []byte("QFI\xfb")},
+	{"vmdk", 0, []byte("KDMV")},
+	{"vmdk", 0, []byte("# Disk DescriptorFile")},
+	{"vdi", 64, []byte{0x7f, 0x10, 0xda, 0xbe}},
+	{"vhdx", 0, []byte("vhdxfile")},
+	{"vpc", 0, []byte("conectix")},
+	{"qed", 0, []byte("QED\x00")},
+}
+
+// detectImageFormat returns the format of an image file based on its
+// header, or "raw" if no known header is found
+func detectImageFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close() //nolint:errcheck
+
+	header := make([]byte, 512)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	header = header[:n]
+
+	for _, m := range imageMagic {
+		end := m.offset + int64(len(m.magic))
+		if int64(len(header)) >= end && bytes.Equal(header[m.offset:end], m.magic) {
+			return m.format, nil
+		}
+	}
+	return "raw", nil
+}
+
+// isRawImage reports whether the source image is a raw disk image
+func (mm *MountManager) isRawImage() bool {
+	if mm.format != "" {
+		return mm.format == "raw"
+	}
+	format, err := detectImageFormat(mm.sourceDevice)
+	if err != nil {
+		return false
+	}
+	return format == "raw"
+}
+
+// LoopBackend attaches raw images to loop devices
+type LoopBackend struct {
+	controller loopController
+}
+
+func (b *LoopBackend) Name() string {
+	return "loop"
+}
+
+func (b *LoopBackend) Attach(mm *MountManager) (string, error) {
+	readOnlyArgs := []string{}
+	if mm.readOnly {
+		readOnlyArgs = append(readOnlyArgs, "--read-only")
+	}
+
+	// Finding a free loop device may allocate one (and needs root), so a
+	// dry run names a placeholder instead
+	if mm.dryRun {
+		mm.plan("losetup", append(append([]string{"--partscan"}, readOnlyArgs...), dryRunLoopDevice, mm.sourceDevice)...)
+		return dryRunLoopDevice, nil
+	}
+
+	// Another process may claim the free device before we attach to it
+	var lastErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		device, err := b.controller.Free()
+		if err != nil {
+			return "", fmt.Errorf("failed to find free loop device: %w", err)
+		}
+
+		if err := b.controller.Attach(device, mm.sourceDevice, mm.readOnly); err != nil {
+			if errors.Is(err, unix.EBUSY) {
+				lastErr = err
+				continue
+			}
+			return "", fmt.Errorf("failed to attach %s to %s: %w", mm.sourceDevice, device, err)
+		}
+
+		mm.logger.Printf("attached %s to %s", mm.sourceDevice, device)
+		return device, nil
+	}
+	return "", fmt.Errorf("failed to attach %s to a loop device: %w", mm.sourceDevice, lastErr)
+}
+
+func (b *LoopBackend) Partitions(mm *MountManager, device string) ([]Partition, error) {
+	return mm.listPartitions(device)
+}
+
+func (b *LoopBackend) Detach(mm *MountManager, device string) error {
+	if mm.dryRun {
+		mm.plan("losetup", "--detach", device)
+	} else if err := b.controller.Detach(device); err != nil {
+		mm.logger.Printf("warning: failed to detach loop device %s: %v", device, err)
+		return err
+	}
+	mm.logger.Printf("detached loop device %s", device)
+	return nil
+}
+
+func (b *LoopBackend) Owns(device string) (string, bool) {
+	return ownedDevice(device, "/dev/loop")
+}
@@ -0,0 +1,289 @@
+package mountmanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeLoopController hands out loop devices in order and records attach and
+// detach requests
+type fakeLoopController struct {
+	unavailable bool
+	next        int
+	freeErr     error
+	attachErr   error
+	attached    map[string]string
+	readOnly    map[string]bool
+	detached    []string
+}
+
+func newFakeLoopController(first int) *fakeLoopController {
+	return &fakeLoopController{
+		next:     first,
+		attached: make(map[string]string),
+		readOnly: make(map[string]bool),
+	}
+}
+
+func (f *fakeLoopController) Available() bool {
+	return !f.unavailable
+}
+
+func (f *fakeLoopController) Free() (string, error) {
+	if f.freeErr != nil {
+		return "", f.freeErr
+	}
+	return fmt.Sprintf("/dev/loop%d", f.next), nil
+}
+
+func (f *fakeLoopController) Attach(device, path string, readOnly bool) error {
+	if f.attachErr != nil {
+		err := f.attachErr
+		f.attachErr = nil
+		f.next++
+		return err
+	}
+	f.attached[device] = path
+	f.readOnly[device] = readOnly
+	f.next++
+	return nil
+}
+
+func (f *fakeLoopController) Detach(device string) error {
+	if _, ok := f.attached[device]; !ok {
+		return errors.New("not attached")
+	}
+	delete(f.attached, device)
+	f.detached = append(f.detached, device)
+	return nil
+}
+
+// setLoopController replaces the controller used by the loop backend
+func setLoopController(mm *MountManager, controller loopController) {
+	mm.findBackend("loop").(*LoopBackend).controller = controller
+}
+
+func writeImage(t *testing.T, header []byte) string {
+	t.Helper()
+	image := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(image, header, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	return image
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	vdi := make([]byte, 72)
+	copy(vdi[64:], []byte{0x7f, 0x10, 0xda, 0xbe})
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"empty", nil, "raw"},
+		{"mbr", append(make([]byte, 510), 0x55, 0xaa), "raw"},
+		{"qcow2", []byte("QFI\xfb\x00\x00\x00\x03"), "qcow2"},
+		{"vmdk", []byte("# Disk DescriptorFile\n"), "vmdk"},
+		{"vdi", vdi, "vdi"},
+		{"vhdx", []byte("vhdxfile"), "vhdx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectImageFormat(writeImage(t, tt.header))
+			if err != nil {
+				t.Fatalf("detectImageFormat() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("detectImageFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	raw := writeImage(t, nil)
+	qcow2 := writeImage(t, []byte("QFI\xfb"))
+
+	tests := []struct {
+		name        string
+		image       string
+		format      string
+		nbdDevice   string
+		backend     string
+		unavailable bool
+		want        string
+		wantErr     bool
+	}{
+		{name: "raw image", image: raw, want: "loop"},
+		{name: "raw format", image: qcow2, format: "raw", want: "loop"},
+		{name: "qcow2 image", image: qcow2, want: "nbd"},
+		{name: "qcow2 format", image: raw, format: "qcow2", want: "nbd"},
+		{name: "explicit nbd device", image: raw, nbdDevice: "/dev/nbd2", want: "nbd"},
+		{name: "loop unavailable", image: raw, unavailable: true, want: "nbd"},
+		{name: "nbd backend", image: raw, backend: "nbd", want: "nbd"},
+		{name: "loop backend", image: raw, backend: "loop", want: "loop"},
+		{name: "loop backend qcow2", image: qcow2, backend: "loop", wantErr: true},
+		{name: "block device", image: "/dev/sdz", backend: "loop", want: "direct"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm, err := NewMountManager(tt.image, t.TempDir(), tt.format, tt.nbdDevice, "default",
+				WithRunner(NewFakeRunner()), WithLogger(discardLogger()), WithBackend(tt.backend))
+			if err != nil {
+				t.Fatalf("NewMountManager() error = %v", err)
+			}
+			loop := newFakeLoopController(0)
+			loop.unavailable = tt.unavailable
+			setLoopController(mm, loop)
+
+			backend, err := mm.selectBackend()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if backend.Name() != tt.want {
+				t.Errorf("selectBackend() = %s, want %s", backend.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMountManager_UnknownBackend(t *testing.T) {
+	_, err := NewMountManager("disk.img", "/mnt", "", "", "default", WithBackend("iscsi"))
+	if err == nil || !strings.Contains(err.Error(), "unknown backend") {
+		t.Errorf("NewMountManager() error = %v, want unknown backend error", err)
+	}
+}
+
+func TestMountUnmountLoop(t *testing.T) {
+	image := writeImage(t, nil)
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	part1 := filepath.Join(targetDir, "partition1")
+
+	fakePartitionTable(t, "/dev/loop3", "/dev/loop3p1")
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+part1, findmntJSON(part1, "/dev/loop3p1"), nil)
+	mm := newTestManager(t, image, targetDir, "default", runner, WithReadOnly())
+	loop := newFakeLoopController(3)
+	setLoopController(mm, loop)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if loop.attached["/dev/loop3"] != image {
+		t.Fatalf("loop devices = %v, want /dev/loop3 attached to %s", loop.attached, image)
+	}
+	if !loop.readOnly["/dev/loop3"] {
+		t.Error("Loop device should be attached read-only")
+	}
+	if mm.state.Backend != "loop" || mm.state.Device != "/dev/loop3" {
+		t.Errorf("state records %s device %q, want loop device /dev/loop3", mm.state.Backend, mm.state.Device)
+	}
+
+	// The loop device is attached read-only, so no blockdev calls are needed
+	for _, cmd := range runner.Commands() {
+		if strings.HasPrefix(cmd, "blockdev") || strings.HasPrefix(cmd, "qemu-nbd") {
+			t.Errorf("unexpected command %q", cmd)
+		}
+	}
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	if !slices.Equal(loop.detached, []string{"/dev/loop3"}) {
+		t.Errorf("detached = %v, want [/dev/loop3]", loop.detached)
+	}
+}
+
+func TestMountLoopRetriesBusyDevice(t *testing.T) {
+	image := writeImage(t, nil)
+	fakePartitionTable(t, "/dev/loop1", "/dev/loop1p1")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, image, t.TempDir(), "single", runner)
+	loop := newFakeLoopController(0)
+	loop.attachErr = fmt.Errorf("LOOP_CONFIGURE: %w", unix.EBUSY)
+	setLoopController(mm, loop)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if mm.device != "/dev/loop1" {
+		t.Errorf("device = %q, want /dev/loop1", mm.device)
+	}
+}
+
+func TestMountLoopRollback(t *testing.T) {
+	image := writeImage(t, nil)
+	fakePartitionTable(t, "/dev/loop0", "/dev/loop0p1", "/dev/loop0p2")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, image, t.TempDir(), "single", runner)
+	loop := newFakeLoopController(0)
+	setLoopController(mm, loop)
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Mount() should fail validation for the single profile")
+	}
+	if !slices.Equal(loop.detached, []string{"/dev/loop0"}) {
+		t.Errorf("detached = %v, want [/dev/loop0]", loop.detached)
+	}
+}
+
+func TestMountLoopDryRun(t *testing.T) {
+	image := writeImage(t, nil)
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+
+	fakePartitionTable(t, image, image+"1")
+	runner := NewFakeRunner()
+	var plan bytes.Buffer
+	mm := newTestManager(t, image, targetDir, "single", runner, WithDryRun(&plan), WithReadOnly())
+	// Looking for a free device may allocate one, and needs root
+	loop := newFakeLoopController(2)
+	loop.freeErr = os.ErrPermission
+	setLoopController(mm, loop)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if len(loop.attached) != 0 {
+		t.Errorf("Dry run should not attach loop devices, got %v", loop.attached)
+	}
+
+	want := strings.Join([]string{
+		"losetup --partscan --read-only /dev/loopN " + image,
+		"mkdir -p " + targetDir,
+		"mount -o ro /dev/loopNp1 " + targetDir,
+	}, "\n") + "\n"
+	if plan.String() != want {
+		t.Errorf("unexpected plan\ngot:\n%s\nwant:\n%s", plan.String(), want)
+	}
+}
+
+func TestUnmountLoopWithoutState(t *testing.T) {
+	targetDir := t.TempDir()
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+targetDir, findmntJSON(targetDir, "/dev/loop12p1"), nil)
+	mm := newTestManager(t, "", targetDir, "single", runner)
+	loop := newFakeLoopController(0)
+	loop.attached["/dev/loop12"] = "disk.img"
+	setLoopController(mm, loop)
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	if !slices.Equal(loop.detached, []string{"/dev/loop12"}) {
+		t.Errorf("detached = %v, want [/dev/loop12]", loop.detached)
+	}
+}
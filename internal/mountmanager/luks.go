@@ -0,0 +1,164 @@
+package mountmanager
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// LUKSKeys says how LUKS encrypted volumes are unlocked
+type LUKSKeys struct {
+	// KeyFile unlocks every volume that has no key file of its own
+	KeyFile string
+
+	// KeyFiles maps the UUID of a LUKS volume to its key file
+	KeyFiles map[string]string
+
+	// Passphrase is asked for the passphrase of a volume without a key
+	// file. When it is nil, such volumes cannot be unlocked.
+	Passphrase func(volume Partition) ([]byte, error)
+}
+
+// OpenedLUKS records a LUKS volume unlocked during a mount session
+type OpenedLUKS struct {
+	// Name is the device-mapper name of the unlocked volume
+	Name string `json:"name"`
+
+	// Device is the encrypted device
+	Device string `json:"device"`
+
+	// OnLogicalVolume is set when Device is an LVM logical volume, so the
+	// volume must be closed before its volume group is deactivated
+	OnLogicalVolume bool `json:"on_logical_volume,omitempty"`
+}
+
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ParseKeyFiles parses key file arguments, each either the path of a key
+// file for every LUKS volume or UUID=PATH for the volume with that UUID
+func ParseKeyFiles(specs []string) (LUKSKeys, error) {
+	keys := LUKSKeys{KeyFiles: make(map[string]string)}
+	for _, spec := range specs {
+		if uuid, path, ok := strings.Cut(spec, "="); ok && uuidRe.MatchString(uuid) {
+			if path == "" {
+				return LUKSKeys{}, fmt.Errorf("invalid key file %q: expected UUID=PATH", spec)
+			}
+			keys.KeyFiles[strings.ToLower(uuid)] = path
+			continue
+		}
+		if spec == "" {
+			return LUKSKeys{}, fmt.Errorf("key file name is empty")
+		}
+		if keys.KeyFile != "" {
+			return LUKSKeys{}, fmt.Errorf("more than one key file for every LUKS volume (%s, %s); use UUID=PATH to give a volume its own key file", keys.KeyFile, spec)
+		}
+		keys.KeyFile = spec
+	}
+	return keys, nil
+}
+
+// keyFileFor returns the key file that unlocks a volume, or "" if there is none
+func (keys *LUKSKeys) keyFileFor(volume Partition) string {
+	if keyFile, ok := keys.KeyFiles[strings.ToLower(volume.UUID)]; ok {
+		return keyFile
+	}
+	return keys.KeyFile
+}
+
+// unlockLUKS unlocks the LUKS volumes among the partitions, and returns the
+// partitions with each volume replaced by its unlocked device, probed for
+// the filesystem inside. Nothing is unlocked unless keys were configured.
+func (mm *MountManager) unlockLUKS(partitions []Partition) ([]Partition, error) {
+	if mm.luksKeys == nil {
+		return partitions, nil
+	}
+
+	result := make([]Partition, 0, len(partitions))
+	for _, partition := range partitions {
+		if partition.FSType != "crypto_LUKS" {
+			result = append(result, partition)
+			continue
+		}
+		if mm.dryRun && mm.isImageFile() {
+			mm.logger.Printf("dry run: not unlocking LUKS volume %s, which is not attached", partition.Device)
+			result = append(result, partition)
+			continue
+		}
+
+		unlocked, err := mm.openLUKS(partition)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, unlocked)
+	}
+	return result, nil
+}
+
+// openLUKS unlocks a LUKS volume as /dev/mapper/pmount-crypt-<device>. The
+// unlocked device keeps the partition's number, so it is named like the
+// partition it replaces.
+func (mm *MountManager) openLUKS(volume Partition) (Partition, error) {
+	name := "pmount-crypt-" + filepath.Base(volume.Device)
+
+	args := []string{"open", "--type", "luks"}
+	if mm.readOnly || volume.ReadOnly {
+		args = append(args, "--readonly")
+	}
+
+	// cryptsetup reads a passphrase from standard input up to the first
+	// newline; nothing is asked for in dry-run mode
+	var input []byte
+	if keyFile := mm.luksKeys.keyFileFor(volume); keyFile != "" {
+		args = append(args, "--key-file", keyFile)
+	} else if !mm.dryRun {
+		if mm.luksKeys.Passphrase == nil {
+			return Partition{}, fmt.Errorf("no key file for LUKS volume %s (UUID %s)", volume.Device, volume.UUID)
+		}
+		passphrase, err := mm.luksKeys.Passphrase(volume)
+		if err != nil {
+			return Partition{}, fmt.Errorf("failed to read passphrase for %s: %w", volume.Device, err)
+		}
+		input = append(passphrase, '\n')
+	}
+	args = append(args, volume.Device, name)
+
+	if output, err := mm.runActionWithInput(input, "cryptsetup", args...); err != nil {
+		return Partition{}, fmt.Errorf("failed to unlock LUKS volume %s: %w", volume.Device, commandError(err, output))
+	}
+	mm.logger.Printf("unlocked LUKS volume %s as /dev/mapper/%s", volume.Device, name)
+	mm.recordLUKS(OpenedLUKS{Name: name, Device: volume.Device, OnLogicalVolume: volume.LV != ""})
+	mm.pushUndo("close LUKS volume "+name, func() error {
+		return mm.closeLUKS(name)
+	})
+
+	unlocked := volume
+	unlocked.Device = filepath.Join("/dev/mapper", name)
+	unlocked.EncryptedDevice = volume.Device
+	probed := []Partition{unlocked}
+	mm.probePartitions(probed)
+	return probed[0], nil
+}
+
+// closeLUKS locks a LUKS volume unlocked by openLUKS
+func (mm *MountManager) closeLUKS(name string) error {
+	if output, err := mm.runAction("cryptsetup", "close", name); err != nil {
+		return fmt.Errorf("failed to close LUKS volume %s: %w", name, commandError(err, output))
+	}
+	mm.logger.Printf("closed LUKS volume %s", name)
+	return nil
+}
+
+// closeLUKSVolumes closes, in reverse order, the recorded LUKS volumes that
+// are (or are not) inside logical volumes
+func (mm *MountManager) closeLUKSVolumes(volumes []OpenedLUKS, onLogicalVolume bool) error {
+	for i := len(volumes) - 1; i >= 0; i-- {
+		if volumes[i].OnLogicalVolume != onLogicalVolume {
+			continue
+		}
+		if err := mm.closeLUKS(volumes[i].Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
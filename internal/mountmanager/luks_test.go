@@ -0,0 +1,160 @@
+package mountmanager
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const luksUUID = "0e3a4b8c-5d1f-4c2a-9b7e-3f6d8a1c2e4b"
+
+// luksImageRunner scripts an image at /dev/nbd4 whose second partition is a
+// LUKS volume holding an ext4 filesystem
+func luksImageRunner() *FakeRunner {
+	return NewFakeRunner().
+		On("blkid -p -o export /dev/nbd4p1", "TYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/nbd4p2", "TYPE=crypto_LUKS\nUUID="+luksUUID+"\n", nil).
+		On("blkid -p -o export /dev/mapper/pmount-crypt-nbd4p2", "TYPE=ext4\nLABEL=data\n", nil)
+}
+
+func TestParseKeyFiles(t *testing.T) {
+	keys, err := ParseKeyFiles([]string{"/keys/default=1.key", "0E3A4B8C-5D1F-4C2A-9B7E-3F6D8A1C2E4B=/keys/data.key"})
+	if err != nil {
+		t.Fatalf("ParseKeyFiles() error = %v", err)
+	}
+	if keys.KeyFile != "/keys/default=1.key" {
+		t.Errorf("KeyFile = %q, want /keys/default=1.key", keys.KeyFile)
+	}
+	if want := map[string]string{luksUUID: "/keys/data.key"}; !reflect.DeepEqual(keys.KeyFiles, want) {
+		t.Errorf("KeyFiles = %v, want %v", keys.KeyFiles, want)
+	}
+	if got := keys.keyFileFor(Partition{UUID: luksUUID}); got != "/keys/data.key" {
+		t.Errorf("keyFileFor(%s) = %q, want /keys/data.key", luksUUID, got)
+	}
+	if got := keys.keyFileFor(Partition{UUID: "other"}); got != "/keys/default=1.key" {
+		t.Errorf("keyFileFor(other) = %q, want /keys/default=1.key", got)
+	}
+
+	if _, err := ParseKeyFiles([]string{"/keys/one.key", "/keys/two.key"}); err == nil {
+		t.Error("Expected ParseKeyFiles() to reject two key files for every volume")
+	}
+	if _, err := ParseKeyFiles([]string{luksUUID + "="}); err == nil {
+		t.Error("Expected ParseKeyFiles() to reject a UUID without a key file")
+	}
+}
+
+func TestMountUnlocksLUKS(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+	runner := luksImageRunner()
+	keys, _ := ParseKeyFiles([]string{luksUUID + "=/keys/data.key"})
+	mm := newLVMTestManager(t, targetDir, runner, WithStateDir(stateDir), WithLUKSKeys(keys))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	part1 := filepath.Join(targetDir, "partition1")
+	part2 := filepath.Join(targetDir, "partition2")
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd4 " + mm.sourceDevice,
+		"blkid -p -o export /dev/nbd4p1",
+		"blkid -p -o export /dev/nbd4p2",
+		"cryptsetup open --type luks --key-file /keys/data.key /dev/nbd4p2 pmount-crypt-nbd4p2",
+		"blkid -p -o export /dev/mapper/pmount-crypt-nbd4p2",
+		"mount /dev/nbd4p1 " + part1,
+		"mount /dev/mapper/pmount-crypt-nbd4p2 " + part2,
+	})
+
+	// The LUKS volume is closed before the device is detached
+	runner = NewFakeRunner().
+		On("findmnt -J -M "+part1, findmntJSON(part1, "/dev/nbd4p1"), nil).
+		On("findmnt -J -M "+part2, findmntJSON(part2, "/dev/mapper/pmount-crypt-nbd4p2"), nil)
+	mm = newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + part2,
+		"umount " + part2,
+		"findmnt -J -M " + part1,
+		"umount " + part1,
+		"cryptsetup close pmount-crypt-nbd4p2",
+		"qemu-nbd --disconnect /dev/nbd4",
+	})
+}
+
+func TestMountUnlocksLUKSWithPassphrase(t *testing.T) {
+	runner := luksImageRunner()
+	var asked []string
+	mm := newLVMTestManager(t, t.TempDir(), runner, WithReadOnly(), WithLUKSKeys(LUKSKeys{
+		Passphrase: func(volume Partition) ([]byte, error) {
+			asked = append(asked, volume.Device)
+			return []byte("correct horse"), nil
+		},
+	}))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if !reflect.DeepEqual(asked, []string{"/dev/nbd4p2"}) {
+		t.Errorf("Asked for passphrases of %v, want [/dev/nbd4p2]", asked)
+	}
+
+	want := "cryptsetup open --type luks --readonly /dev/nbd4p2 pmount-crypt-nbd4p2"
+	for _, call := range runner.Calls {
+		if call.String() == want {
+			if string(call.Input) != "correct horse\n" {
+				t.Errorf("cryptsetup was given %q on standard input", call.Input)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected %q among %q", want, runner.Commands())
+}
+
+func TestMountLeavesLUKSLocked(t *testing.T) {
+	targetDir := t.TempDir()
+	runner := luksImageRunner()
+	mm := newLVMTestManager(t, targetDir, runner)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd4 " + mm.sourceDevice,
+		"blkid -p -o export /dev/nbd4p1",
+		"blkid -p -o export /dev/nbd4p2",
+		"mount /dev/nbd4p1 " + filepath.Join(targetDir, "partition1"),
+	})
+}
+
+func TestMountWithoutLUKSKey(t *testing.T) {
+	runner := luksImageRunner()
+	mm := newLVMTestManager(t, t.TempDir(), runner, WithLUKSKeys(LUKSKeys{}))
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail without a key for the LUKS volume")
+	}
+	if commands := runner.Commands(); !containsCommand(commands, "qemu-nbd --disconnect /dev/nbd4") {
+		t.Errorf("Expected the device to be detached, got %q", commands)
+	}
+}
+
+func TestMountRollsBackLUKS(t *testing.T) {
+	targetDir := t.TempDir()
+	part2 := filepath.Join(targetDir, "partition2")
+	runner := luksImageRunner().
+		On("mount /dev/mapper/pmount-crypt-nbd4p2 "+part2, "", errors.New("exit status 32"))
+	mm := newLVMTestManager(t, targetDir, runner, WithLUKSKeys(LUKSKeys{KeyFile: "/keys/data.key"}))
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail")
+	}
+	commands := runner.Commands()
+	want := []string{"cryptsetup close pmount-crypt-nbd4p2", "qemu-nbd --disconnect /dev/nbd4"}
+	if got := commands[len(commands)-2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Rollback ran %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,328 @@
+package mountmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ActiveVolumeGroup records an LVM volume group activated during a mount
+// session
+type ActiveVolumeGroup struct {
+	Name string `json:"name"`
+
+	// Devices are the physical volumes the volume group was found on
+	Devices []string `json:"devices"`
+
+	// Mapped is set when the volume group's name is in use on the host, so
+	// that instead of activating it pmount created a device-mapper device
+	// (listed in Mappings) for each logical volume
+	Mapped   bool     `json:"mapped,omitempty"`
+	Mappings []string `json:"mappings,omitempty"`
+
+	// readOnly is set when the volume group is activated read-only
+	readOnly bool
+}
+
+// lvmReport is the JSON report produced by pvs, vgs and lvs. Each report
+// maps the kind of object ("pv", "lv", "seg") to one row per object.
+type lvmReport struct {
+	Report []map[string][]map[string]string `json:"report"`
+}
+
+// lvmQuery runs an LVM reporting command and returns its rows. When
+// devices are given, LVM only looks at those devices, so that volume groups
+// on the host cannot be confused with volume groups in the source.
+func (mm *MountManager) lvmQuery(command string, devices []string, fields []string, args ...string) ([]map[string]string, error) {
+	var cmdArgs []string
+	if len(devices) > 0 {
+		cmdArgs = append(cmdArgs, "--devices", strings.Join(devices, ","))
+	}
+	cmdArgs = append(cmdArgs, "--reportformat", "json", "--units", "b", "--nosuffix", "-o", strings.Join(fields, ","))
+	cmdArgs = append(cmdArgs, args...)
+
+	output, err := mm.runner.Output(command, cmdArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", command, err)
+	}
+
+	var report lvmReport
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse %s output: %w", command, err)
+	}
+	var rows []map[string]string
+	for _, section := range report.Report {
+		for _, sectionRows := range section {
+			rows = append(rows, sectionRows...)
+		}
+	}
+	return rows, nil
+}
+
+// lvmDMName returns the device-mapper name LVM uses for a logical volume,
+// in which dashes within the names are doubled
+func lvmDMName(vg, lv string) string {
+	return strings.ReplaceAll(vg, "-", "--") + "-" + strings.ReplaceAll(lv, "-", "--")
+}
+
+// activateLVM activates the volume groups found on LVM physical volumes
+// among the partitions, and returns their logical volumes and the physical
+// volumes the groups were activated from
+func (mm *MountManager) activateLVM(partitions []Partition) ([]Partition, []string, error) {
+	var pvs []string
+	readOnly := make(map[string]bool)
+	for _, partition := range partitions {
+		if partition.FSType == "LVM2_member" {
+			pvs = append(pvs, partition.Device)
+			readOnly[partition.Device] = mm.readOnly || partition.ReadOnly
+		}
+	}
+	if len(pvs) == 0 {
+		return nil, nil, nil
+	}
+	if mm.dryRun && mm.isImageFile() {
+		mm.logger.Printf("dry run: not looking for LVM volume groups on %s, which is not attached", strings.Join(pvs, ", "))
+		return nil, nil, nil
+	}
+
+	rows, err := mm.lvmQuery("pvs", pvs, []string{"pv_name", "vg_name"})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read LVM physical volumes: %w", err)
+	}
+	devices := make(map[string][]string)
+	for _, row := range rows {
+		if vg := row["vg_name"]; vg != "" {
+			devices[vg] = append(devices[vg], row["pv_name"])
+		}
+	}
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var volumes []Partition
+	var used []string
+	for _, name := range names {
+		vg := &ActiveVolumeGroup{Name: name, Devices: devices[name]}
+		vg.readOnly = slices.ContainsFunc(vg.Devices, func(device string) bool { return readOnly[device] })
+		inUse, err := mm.volumeGroupNameInUse(vg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var lvs []Partition
+		if inUse {
+			mm.logger.Printf("volume group %s has the same name as one on the host; mapping its logical volumes under new names", name)
+			lvs, err = mm.mapVolumeGroup(vg)
+		} else {
+			lvs, err = mm.activateVolumeGroup(vg)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		volumes = append(volumes, lvs...)
+		used = append(used, vg.Devices...)
+	}
+	return volumes, used, nil
+}
+
+// volumeGroupNameInUse reports whether a volume group in the source has
+// the same name as a volume group or logical volume on the host, in which
+// case activating it would clash with (or even replace) the host's
+func (mm *MountManager) volumeGroupNameInUse(vg *ActiveVolumeGroup) (bool, error) {
+	rows, err := mm.lvmQuery("pvs", nil, []string{"pv_name", "vg_name"})
+	if err != nil {
+		return false, fmt.Errorf("failed to read host LVM physical volumes: %w", err)
+	}
+	for _, row := range rows {
+		if row["vg_name"] == vg.Name && !slices.Contains(vg.Devices, row["pv_name"]) {
+			return true, nil
+		}
+	}
+
+	// The host may not see every volume group (e.g. when it uses an LVM
+	// devices file), but active logical volumes always have a mapping
+	output, err := mm.runner.Output("dmsetup", "info", "-c", "--noheadings", "-o", "name")
+	if err != nil {
+		return false, fmt.Errorf("failed to list device-mapper devices: %w", err)
+	}
+	prefix := strings.ReplaceAll(vg.Name, "-", "--") + "-"
+	for _, line := range strings.Split(string(output), "\n") {
+		if name := strings.TrimSpace(line); strings.HasPrefix(name, prefix) && !strings.HasPrefix(name, prefix+"-") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// activateVolumeGroup activates a volume group with LVM and returns its
+// logical volumes
+func (mm *MountManager) activateVolumeGroup(vg *ActiveVolumeGroup) ([]Partition, error) {
+	args := []string{"--devices", strings.Join(vg.Devices, ","), "-ay"}
+	if vg.readOnly {
+		args = append(args, "--config", fmt.Sprintf("activation { read_only_volume_list = [ %q ] }", vg.Name))
+	}
+	args = append(args, vg.Name)
+	if output, err := mm.runAction("vgchange", args...); err != nil {
+		return nil, fmt.Errorf("failed to activate volume group %s: %w", vg.Name, commandError(err, output))
+	}
+	mm.logger.Printf("activated volume group %s", vg.Name)
+	mm.recordVolumeGroup(vg)
+	mm.pushUndo("deactivate volume group "+vg.Name, func() error {
+		return mm.deactivateVolumeGroup(vg)
+	})
+
+	rows, err := mm.lvmQuery("lvs", vg.Devices, []string{"lv_name", "lv_size"}, vg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list logical volumes of %s: %w", vg.Name, err)
+	}
+	var lvs []Partition
+	for _, row := range rows {
+		size, _ := strconv.ParseInt(row["lv_size"], 10, 64)
+		lvs = append(lvs, Partition{
+			Device:   filepath.Join("/dev/mapper", lvmDMName(vg.Name, row["lv_name"])),
+			Size:     size,
+			VG:       vg.Name,
+			LV:       row["lv_name"],
+			ReadOnly: vg.readOnly,
+		})
+	}
+	return lvs, nil
+}
+
+// lvSegment is one contiguous piece of a logical volume
+type lvSegment struct {
+	start, size int64
+	segType     string
+	peRanges    string
+}
+
+// mapVolumeGroup creates a device-mapper device for each linear logical
+// volume of a volume group without activating it, so that its name cannot
+// clash with the host's. The devices are named after the attached device
+// (e.g. pmount-nbd0-rhel-root).
+func (mm *MountManager) mapVolumeGroup(vg *ActiveVolumeGroup) ([]Partition, error) {
+	vg.Mapped = true
+
+	// Mappings are added to the recorded volume group as they are made, so
+	// that a later failure tears down exactly what exists
+	mm.recordVolumeGroup(vg)
+	mm.pushUndo("remove mappings for volume group "+vg.Name, func() error {
+		return mm.deactivateVolumeGroup(vg)
+	})
+
+	rows, err := mm.lvmQuery("pvs", vg.Devices, []string{"pv_name", "pe_start"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read physical volumes of %s: %w", vg.Name, err)
+	}
+	peStart := make(map[string]int64)
+	for _, row := range rows {
+		peStart[row["pv_name"]], _ = strconv.ParseInt(row["pe_start"], 10, 64)
+	}
+
+	rows, err = mm.lvmQuery("lvs", vg.Devices,
+		[]string{"lv_name", "vg_extent_size", "segtype", "seg_start", "seg_size", "seg_pe_ranges"},
+		"--segments", vg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read logical volumes of %s: %w", vg.Name, err)
+	}
+
+	var names []string
+	segments := make(map[string][]lvSegment)
+	var extentSize int64
+	for _, row := range rows {
+		lv := row["lv_name"]
+		if _, ok := segments[lv]; !ok {
+			names = append(names, lv)
+		}
+		extentSize, _ = strconv.ParseInt(row["vg_extent_size"], 10, 64)
+		segment := lvSegment{segType: row["segtype"], peRanges: row["seg_pe_ranges"]}
+		segment.start, _ = strconv.ParseInt(row["seg_start"], 10, 64)
+		segment.size, _ = strconv.ParseInt(row["seg_size"], 10, 64)
+		segments[lv] = append(segments[lv], segment)
+	}
+
+	flags := "rw"
+	if vg.readOnly {
+		flags = "ro"
+	}
+
+	var lvs []Partition
+	for _, lv := range names {
+		table, err := linearTable(segments[lv], extentSize, peStart)
+		if err != nil {
+			mm.logger.Printf("skipping logical volume %s/%s: %v", vg.Name, lv, err)
+			continue
+		}
+
+		name := fmt.Sprintf("pmount-%s-%s", filepath.Base(mm.getActiveDevice()), lvmDMName(vg.Name, lv))
+		spec := strings.Join(append([]string{name, "", "", flags}, table...), ",")
+		if output, err := mm.runAction("dmsetup", "create", "--concise", spec); err != nil {
+			return nil, fmt.Errorf("failed to map logical volume %s/%s: %w", vg.Name, lv, commandError(err, output))
+		}
+		mm.logger.Printf("mapped logical volume %s/%s as %s", vg.Name, lv, name)
+
+		vg.Mappings = append(vg.Mappings, name)
+
+		var size int64
+		for _, segment := range segments[lv] {
+			size += segment.size
+		}
+		lvs = append(lvs, Partition{
+			Device:   filepath.Join("/dev/mapper", name),
+			Size:     size,
+			VG:       vg.Name,
+			LV:       lv,
+			ReadOnly: vg.readOnly,
+		})
+	}
+	return lvs, nil
+}
+
+// linearTable builds the device-mapper table for a logical volume made of
+// linear segments. Sizes are in bytes; tables are in 512-byte sectors.
+func linearTable(segments []lvSegment, extentSize int64, peStart map[string]int64) ([]string, error) {
+	var table []string
+	for _, segment := range segments {
+		if segment.segType != "linear" {
+			return nil, fmt.Errorf("%s segments can only be used when the volume group can be activated", segment.segType)
+		}
+
+		// A linear segment occupies one range of extents, e.g. /dev/nbd0p2:0-255
+		pv, extents, ok := strings.Cut(segment.peRanges, ":")
+		first, _, _ := strings.Cut(extents, "-")
+		firstExtent, err := strconv.ParseInt(first, 10, 64)
+		if !ok || err != nil || strings.Contains(segment.peRanges, " ") {
+			return nil, fmt.Errorf("unexpected extent range %q", segment.peRanges)
+		}
+
+		offset := peStart[pv] + firstExtent*extentSize
+		table = append(table, fmt.Sprintf("%d %d linear %s %d", segment.start/512, segment.size/512, pv, offset/512))
+	}
+	return table, nil
+}
+
+// deactivateVolumeGroup deactivates a volume group activated by
+// activateVolumeGroup, or removes the mappings made by mapVolumeGroup
+func (mm *MountManager) deactivateVolumeGroup(vg *ActiveVolumeGroup) error {
+	if vg.Mapped {
+		for i := len(vg.Mappings) - 1; i >= 0; i-- {
+			if output, err := mm.runAction("dmsetup", "remove", vg.Mappings[i]); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", vg.Mappings[i], commandError(err, output))
+			}
+		}
+		mm.logger.Printf("removed mappings for volume group %s", vg.Name)
+		return nil
+	}
+
+	if output, err := mm.runAction("vgchange", "--devices", strings.Join(vg.Devices, ","), "-an", vg.Name); err != nil {
+		return fmt.Errorf("failed to deactivate volume group %s: %w", vg.Name, commandError(err, output))
+	}
+	mm.logger.Printf("deactivated volume group %s", vg.Name)
+	return nil
+}
@@ -0,0 +1,287 @@
+package mountmanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	lvmFields     = " --reportformat json --units b --nosuffix -o "
+	hostPVsQuery  = "pvs" + lvmFields + "pv_name,vg_name"
+	dmsetupNames  = "dmsetup info -c --noheadings -o name"
+	imagePVsQuery = "pvs --devices /dev/nbd4p2" + lvmFields + "pv_name,vg_name"
+)
+
+// lvmJSON returns an LVM JSON report with one section of the given kind
+func lvmJSON(kind string, rows ...string) string {
+	return fmt.Sprintf(`{"report": [{%q: [%s]}]}`, kind, strings.Join(rows, ", "))
+}
+
+// lvmImageRunner scripts an image at /dev/nbd4 whose second partition is an
+// LVM physical volume in volume group "rhel", with root and swap volumes
+func lvmImageRunner(hostVGs string) *FakeRunner {
+	return NewFakeRunner().
+		On("blkid -p -o export /dev/nbd4p1", "TYPE=xfs\n", nil).
+		On("blkid -p -o export /dev/nbd4p2", "TYPE=LVM2_member\n", nil).
+		On(imagePVsQuery, lvmJSON("pv", `{"pv_name": "/dev/nbd4p2", "vg_name": "rhel"}`), nil).
+		On(hostPVsQuery, lvmJSON("pv", hostVGs), nil)
+}
+
+func newLVMTestManager(t *testing.T, targetDir string, runner *FakeRunner, opts ...Option) *MountManager {
+	t.Helper()
+	image := writeImage(t, []byte("QFI\xfb"))
+	fakePartitionTable(t, "/dev/nbd4", "/dev/nbd4p1", "/dev/nbd4p2")
+	mm := newTestManager(t, image, targetDir, "default", runner, opts...)
+	mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd4"
+	return mm
+}
+
+func TestMountActivatesVolumeGroup(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+	runner := lvmImageRunner(`{"pv_name": "/dev/sda2", "vg_name": "fedora"}`).
+		On(dmsetupNames, "fedora-root\nfedora-swap\n", nil).
+		On("lvs --devices /dev/nbd4p2"+lvmFields+"lv_name,lv_size rhel", lvmJSON("lv",
+			`{"lv_name": "root", "lv_size": "8589934592"}`,
+			`{"lv_name": "swap", "lv_size": "1073741824"}`), nil).
+		On("blkid -p -o export /dev/mapper/rhel-root", "TYPE=xfs\nLABEL=root\n", nil).
+		On("blkid -p -o export /dev/mapper/rhel-swap", "TYPE=swap\n", nil)
+	mm := newLVMTestManager(t, targetDir, runner, WithStateDir(stateDir))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	rootDir := filepath.Join(targetDir, "lv-rhel-root")
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd4 " + mm.sourceDevice,
+		"blkid -p -o export /dev/nbd4p1",
+		"blkid -p -o export /dev/nbd4p2",
+		imagePVsQuery,
+		hostPVsQuery,
+		dmsetupNames,
+		"vgchange --devices /dev/nbd4p2 -ay rhel",
+		"lvs --devices /dev/nbd4p2" + lvmFields + "lv_name,lv_size rhel",
+		"blkid -p -o export /dev/mapper/rhel-root",
+		"blkid -p -o export /dev/mapper/rhel-swap",
+		"mount /dev/nbd4p1 " + filepath.Join(targetDir, "partition1"),
+		"mount /dev/mapper/rhel-root " + rootDir,
+	})
+
+	states, err := LoadStates(stateDir)
+	if err != nil || len(states) != 1 {
+		t.Fatalf("Expected one recorded state, got %v (%v)", states, err)
+	}
+	want := []*ActiveVolumeGroup{{Name: "rhel", Devices: []string{"/dev/nbd4p2"}}}
+	if !reflect.DeepEqual(states[0].VolumeGroups, want) {
+		t.Errorf("Recorded volume groups = %+v, want %+v", states[0].VolumeGroups, want)
+	}
+
+	// Volume groups are deactivated before the device is detached
+	part1 := filepath.Join(targetDir, "partition1")
+	runner = NewFakeRunner().
+		On("findmnt -J -M "+part1, findmntJSON(part1, "/dev/nbd4p1"), nil).
+		On("findmnt -J -M "+rootDir, findmntJSON(rootDir, "/dev/mapper/rhel-root"), nil)
+	mm = newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + rootDir,
+		"umount " + rootDir,
+		"findmnt -J -M " + part1,
+		"umount " + part1,
+		"vgchange --devices /dev/nbd4p2 -an rhel",
+		"qemu-nbd --disconnect /dev/nbd4",
+	})
+}
+
+func TestMountActivatesVolumeGroupReadOnly(t *testing.T) {
+	runner := lvmImageRunner("").
+		On("lvs --devices /dev/nbd4p2"+lvmFields+"lv_name,lv_size rhel", lvmJSON("lv"), nil)
+	mm := newLVMTestManager(t, t.TempDir(), runner, WithReadOnly())
+
+	if _, _, err := mm.activateLVM([]Partition{{Device: "/dev/nbd4p2", FSType: "LVM2_member"}}); err != nil {
+		t.Fatalf("activateLVM() error = %v", err)
+	}
+	want := `vgchange --devices /dev/nbd4p2 -ay --config activation { read_only_volume_list = [ "rhel" ] } rhel`
+	if commands := runner.Commands(); !containsCommand(commands, want) {
+		t.Errorf("Expected %q among %q", want, commands)
+	}
+}
+
+func TestMountSingleLogicalVolume(t *testing.T) {
+	targetDir := t.TempDir()
+	pvsQuery := "pvs --devices /dev/nbd4p1" + lvmFields + "pv_name,vg_name"
+	lvsQuery := "lvs --devices /dev/nbd4p1" + lvmFields + "lv_name,lv_size data"
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/nbd4p1", "TYPE=LVM2_member\n", nil).
+		On(pvsQuery, lvmJSON("pv", `{"pv_name": "/dev/nbd4p1", "vg_name": "data"}`), nil).
+		On(hostPVsQuery, lvmJSON("pv"), nil).
+		On(lvsQuery, lvmJSON("lv", `{"lv_name": "home", "lv_size": "1073741824"}`), nil).
+		On("blkid -p -o export /dev/mapper/data-home", "TYPE=ext4\n", nil)
+	image := writeImage(t, []byte("QFI\xfb"))
+	fakePartitionTable(t, "/dev/nbd4", "/dev/nbd4p1")
+	mm := newTestManager(t, image, targetDir, "single", runner)
+	mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd4"
+
+	// The physical volume gives way to its logical volume
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	want := "mount /dev/mapper/data-home " + targetDir
+	if commands := runner.Commands(); !containsCommand(commands, want) {
+		t.Errorf("Expected %q among %q", want, commands)
+	}
+}
+
+func TestMountMapsCollidingVolumeGroup(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+
+	// The host's root filesystem is also in a volume group called rhel
+	runner := lvmImageRunner(`{"pv_name": "/dev/sda2", "vg_name": "rhel"}`).
+		On("pvs --devices /dev/nbd4p2"+lvmFields+"pv_name,pe_start",
+			lvmJSON("pv", `{"pv_name": "/dev/nbd4p2", "pe_start": "1048576"}`), nil).
+		On("lvs --devices /dev/nbd4p2"+lvmFields+"lv_name,vg_extent_size,segtype,seg_start,seg_size,seg_pe_ranges --segments rhel", lvmJSON("seg",
+			`{"lv_name": "root", "vg_extent_size": "4194304", "segtype": "linear", "seg_start": "0", "seg_size": "8388608", "seg_pe_ranges": "/dev/nbd4p2:0-1"}`,
+			`{"lv_name": "root", "vg_extent_size": "4194304", "segtype": "linear", "seg_start": "8388608", "seg_size": "4194304", "seg_pe_ranges": "/dev/nbd4p2:4-4"}`,
+			`{"lv_name": "pool", "vg_extent_size": "4194304", "segtype": "thin-pool", "seg_start": "0", "seg_size": "4194304", "seg_pe_ranges": ""}`,
+		), nil).
+		On("blkid -p -o export /dev/mapper/pmount-nbd4-rhel-root", "TYPE=xfs\n", nil)
+	mm := newLVMTestManager(t, targetDir, runner, WithStateDir(stateDir), WithReadOnly())
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	// The host's volume group is never activated or deactivated
+	for _, command := range runner.Commands() {
+		if strings.HasPrefix(command, "vgchange") {
+			t.Errorf("Unexpected command %q", command)
+		}
+	}
+	wantCreate := "dmsetup create --concise pmount-nbd4-rhel-root,,,ro," +
+		"0 16384 linear /dev/nbd4p2 2048," +
+		"16384 8192 linear /dev/nbd4p2 34816"
+	if !containsCommand(runner.Commands(), wantCreate) {
+		t.Errorf("Expected %q among %q", wantCreate, runner.Commands())
+	}
+	rootDir := filepath.Join(targetDir, "lv-rhel-root")
+	if !containsCommand(runner.Commands(), "mount -o ro /dev/mapper/pmount-nbd4-rhel-root "+rootDir) {
+		t.Errorf("Expected the mapped volume to be mounted, got %q", runner.Commands())
+	}
+
+	states, err := LoadStates(stateDir)
+	if err != nil || len(states) != 1 {
+		t.Fatalf("Expected one recorded state, got %v (%v)", states, err)
+	}
+	want := []*ActiveVolumeGroup{{
+		Name:     "rhel",
+		Devices:  []string{"/dev/nbd4p2"},
+		Mapped:   true,
+		Mappings: []string{"pmount-nbd4-rhel-root"},
+	}}
+	if !reflect.DeepEqual(states[0].VolumeGroups, want) {
+		t.Errorf("Recorded volume groups = %+v, want %+v", states[0].VolumeGroups, want)
+	}
+
+	runner = NewFakeRunner().
+		On("findmnt -J -M "+rootDir, findmntJSON(rootDir, "/dev/mapper/pmount-nbd4-rhel-root"), nil)
+	mm = newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	part1 := filepath.Join(targetDir, "partition1")
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + rootDir,
+		"umount " + rootDir,
+		"findmnt -J -M " + part1,
+		"findmnt -J -S /dev/nbd4p1",
+		"dmsetup remove pmount-nbd4-rhel-root",
+		"qemu-nbd --disconnect /dev/nbd4",
+	})
+}
+
+func TestVolumeGroupNameInUseByMapping(t *testing.T) {
+	// Volume groups the host's LVM cannot see still show up as mappings
+	runner := NewFakeRunner().
+		On(hostPVsQuery, lvmJSON("pv"), nil).
+		On(dmsetupNames, "my--vg-root\nrhel--data-home\n", nil)
+	mm := newTestManager(t, "/dev/sdz", t.TempDir(), "default", runner)
+
+	tests := map[string]bool{"rhel": false, "rhel-data": true, "my-vg": true, "my": false}
+	for name, want := range tests {
+		got, err := mm.volumeGroupNameInUse(&ActiveVolumeGroup{Name: name, Devices: []string{"/dev/sdz2"}})
+		if err != nil {
+			t.Fatalf("volumeGroupNameInUse(%s) error = %v", name, err)
+		}
+		if got != want {
+			t.Errorf("volumeGroupNameInUse(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMountRollsBackVolumeGroup(t *testing.T) {
+	targetDir := t.TempDir()
+	runner := lvmImageRunner("").
+		On("lvs --devices /dev/nbd4p2"+lvmFields+"lv_name,lv_size rhel", lvmJSON("lv",
+			`{"lv_name": "root", "lv_size": "8589934592"}`), nil).
+		On("blkid -p -o export /dev/mapper/rhel-root", "TYPE=xfs\n", nil).
+		On("mount /dev/mapper/rhel-root "+filepath.Join(targetDir, "lv-rhel-root"), "bad superblock", errors.New("exit status 32"))
+	mm := newLVMTestManager(t, targetDir, runner)
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail")
+	}
+	commands := runner.Commands()
+	deactivate := "vgchange --devices /dev/nbd4p2 -an rhel"
+	if len(commands) < 2 || commands[len(commands)-2] != deactivate {
+		t.Errorf("Expected %q before the device is detached, got %q", deactivate, commands)
+	}
+}
+
+func TestUnmountWithoutStateRemovesHolders(t *testing.T) {
+	fakeSysfs(t)
+	for _, dir := range []string{"nbd4/nbd4p2/holders/dm-0", "dm-0/dm", "dm-0/slaves/nbd4p2"} {
+		if err := os.MkdirAll(filepath.Join(sysBlockDir, dir), 0755); err != nil {
+			t.Fatalf("Failed to create fake sysfs: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(sysBlockDir, "dm-0", "dm", "name"), []byte("rhel-root\n"), 0644); err != nil {
+		t.Fatalf("Failed to create fake sysfs: %v", err)
+	}
+
+	targetDir := t.TempDir()
+	rootDir := filepath.Join(targetDir, "lv-rhel-root")
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+rootDir, findmntJSON(rootDir, "/dev/dm-0"), nil)
+	mm := newTestManager(t, "", targetDir, "default", runner)
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + rootDir,
+		"umount " + rootDir,
+		"dmsetup remove rhel-root",
+		"qemu-nbd --disconnect /dev/nbd4",
+	})
+}
+
+func containsCommand(commands []string, want string) bool {
+	for _, command := range commands {
+		if command == want {
+			return true
+		}
+	}
+	return false
+}
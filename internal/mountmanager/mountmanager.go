@@ -1,30 +1,56 @@
 package mountmanager
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
+	"slices"
 )
 
-func NewMountManager(sourceDevice, targetDir, format, nbdDevice, profileName string) (*MountManager, error) {
+func NewMountManager(sourceDevice, targetDir, format, nbdDevice, profileName string, opts ...Option) (*MountManager, error) {
 	profile, err := NewProfile(profileName)
 	if err != nil {
 		return nil, err
 	}
 
-	return &MountManager{
-		sourceDevice:      sourceDevice,
-		targetDir:         targetDir,
-		format:            format,
-		nbdDeviceExplicit: nbdDevice,
-		profileName:       profileName,
-		profile:           profile,
-		logger:            log.New(os.Stdout, "[pmount] ", log.LstdFlags),
-	}, nil
+	mm := &MountManager{
+		sourceDevice: sourceDevice,
+		targetDir:    targetDir,
+		format:       format,
+		profileName:  profileName,
+		profile:      profile,
+		logger:       log.New(os.Stdout, "[pmount] ", log.LstdFlags),
+		runner:       ExecRunner{},
+		stateDir:     DefaultStateDir,
+	}
+	mm.backends = []Backend{
+		&NBDBackend{Device: nbdDevice},
+		&LoopBackend{controller: kernelLoopController{}},
+		DirectBackend{},
+	}
+	for _, opt := range opts {
+		opt(mm)
+	}
+
+	switch mm.backendName {
+	case "", "auto", "nbd", "loop":
+	default:
+		return nil, fmt.Errorf("unknown backend %q (available: auto, nbd, loop)", mm.backendName)
+	}
+	nbd := mm.findBackend("nbd").(*NBDBackend)
+	if nbd.Delta != "" && (nbd.Snapshot || nbd.LoadSnapshot != "") {
+		return nil, fmt.Errorf("a delta cannot be combined with a snapshot")
+	}
+	if mm.nameTemplate != "" {
+		if err := validateNameTemplate(mm.nameTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	return mm, nil
 }
 
 func (mm *MountManager) isImageFile() bool {
@@ -37,21 +63,14 @@ func (mm *MountManager) isImageFile() bool {
 
 // findMountedDevice returns the device mounted at the given path, or empty string if not mounted
 func (mm *MountManager) findMountedDevice(mountPath string) (string, error) {
-	cmd := exec.Command("findmnt", "-J", "-M", mountPath)
-	output, err := cmd.Output()
+	output, err := mm.runner.Output("findmnt", "-J", "-M", mountPath)
 	if err != nil {
 		// Path not mounted
 		return "", nil
 	}
 
 	// Parse findmnt JSON output to get mounted device
-	var findmntData struct {
-		Filesystems []struct {
-			Target string `json:"target"`
-			Source string `json:"source"`
-		} `json:"filesystems"`
-	}
-
+	var findmntData FindmntOutput
 	if err := json.Unmarshal(output, &findmntData); err != nil {
 		return "", fmt.Errorf("failed to parse findmnt output for %s: %w", mountPath, err)
 	}
@@ -63,18 +82,38 @@ func (mm *MountManager) findMountedDevice(mountPath string) (string, error) {
 	return "", nil
 }
 
+// findMountpoints returns every path on which the given device is mounted
+func (mm *MountManager) findMountpoints(device string) ([]string, error) {
+	output, err := mm.runner.Output("findmnt", "-J", "-S", device)
+	if err != nil || len(bytes.TrimSpace(output)) == 0 {
+		// Device not mounted
+		return nil, nil
+	}
+
+	var findmntData FindmntOutput
+	if err := json.Unmarshal(output, &findmntData); err != nil {
+		return nil, fmt.Errorf("failed to parse findmnt output for %s: %w", device, err)
+	}
+
+	var mountpoints []string
+	for _, fs := range findmntData.Filesystems {
+		mountpoints = append(mountpoints, fs.Target)
+	}
+	return mountpoints, nil
+}
+
 // addPartition adds a partition to the manager's partition list (used by profiles during unmount)
 func (mm *MountManager) addPartition(device string, number int) {
 	partition := Partition{
 		Device: device,
 		Number: number,
-		Size:   "unknown",
 	}
 	mm.partitions = append(mm.partitions, partition)
 }
 
+// discoverMountedPartitions finds the partitions mounted on directories
+// directly beneath the target directory, whatever their names
 func (mm *MountManager) discoverMountedPartitions() error {
-	// First, find partition directories in the target directory
 	entries, err := os.ReadDir(mm.targetDir)
 	if err != nil {
 		return fmt.Errorf("failed to read target directory: %w", err)
@@ -82,7 +121,7 @@ func (mm *MountManager) discoverMountedPartitions() error {
 
 	mm.partitions = []Partition{}
 	for _, entry := range entries {
-		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "partition") {
+		if !entry.IsDir() {
 			continue
 		}
 
@@ -92,214 +131,206 @@ func (mm *MountManager) discoverMountedPartitions() error {
 			mm.logger.Printf("warning: %v", err)
 			continue
 		}
-
-		if device != "" {
-			// Extract partition number from directory name (partition1 -> 1)
-			partName := entry.Name()
-			if len(partName) > 9 { // "partition" is 9 chars
-				if partNum := partName[9:]; partNum != "" {
-					// Convert to int for consistency
-					var num int
-					if _, err := fmt.Sscanf(partNum, "%d", &num); err != nil {
-						return fmt.Errorf("failed to read partition number from %s", partNum)
-					}
-
-					partition := Partition{
-						Device: device,
-						Number: num,
-						Size:   "unknown", // We don't need size for unmounting
-					}
-					mm.partitions = append(mm.partitions, partition)
-				}
-			}
+		if device == "" {
+			continue
 		}
+
+		mm.partitions = append(mm.partitions, Partition{
+			Device:     device,
+			Number:     partitionNumber(device),
+			Mountpoint: partitionPath,
+		})
 	}
 
 	mm.logger.Printf("discovered %d mounted partitions", len(mm.partitions))
 	return nil
 }
 
-func (mm *MountManager) extractNBDDevice() {
-	// Look through partitions to find NBD device
-	for _, partition := range mm.partitions {
-		if strings.Contains(partition.Device, "/dev/nbd") {
-			// Extract NBD device from partition device (e.g., /dev/nbd1p1 -> /dev/nbd1)
-			if idx := strings.LastIndex(partition.Device, "p"); idx > 0 {
-				mm.nbdDevice = partition.Device[:idx]
-				mm.logger.Printf("detected NBD device: %s", mm.nbdDevice)
-				return
-			}
-		}
+func (mm *MountManager) getActiveDevice() string {
+	if mm.device != "" {
+		return mm.device
 	}
+	return mm.sourceDevice
 }
 
-func (mm *MountManager) findFreeNBDDevice() (string, error) {
-	i := 0
-	for {
-		nbdDevice := fmt.Sprintf("nbd%d", i)
-		nbdDevicePath := fmt.Sprintf("/dev/%s", nbdDevice)
-		nbdSysFSPath := fmt.Sprintf("/sys/class/block/%s", nbdDevice)
-		i++
-
-		// If nbdDevicePath does not exist, assume we have reached the end of
-		// available nbd devices.
-		if _, err := os.Stat(nbdDevicePath); os.IsNotExist(err) {
-			break
-		}
-
-		// Check if device is in use by looking for the pid file
-		pidFile := fmt.Sprintf("%s/pid", nbdSysFSPath)
-		if _, err := os.Stat(pidFile); err == nil {
-			// If pid file exists, NBD device is in use
-			continue
-		}
-
-		// Device appears free
-		return nbdDevicePath, nil
+// discoverPartitions asks the backend for the partitions of the attached device
+func (mm *MountManager) discoverPartitions() error {
+	partitions, err := mm.backend.Partitions(mm, mm.device)
+	if err != nil {
+		return err
 	}
+	mm.partitions = partitions
 
-	return "", fmt.Errorf("no free NBD devices found (checked /dev/nbd0 through /dev/nbd%d)", i)
+	mm.logger.Printf("discovered %d partitions", len(mm.partitions))
+	return nil
 }
 
-func (mm *MountManager) attachImageWithNBD() error {
-	var nbdDevice string
-	var err error
-
-	if mm.nbdDeviceExplicit != "" {
-		nbdDevice = mm.nbdDeviceExplicit
-		mm.logger.Printf("using explicitly specified NBD device: %s", nbdDevice)
-	} else {
-		nbdDevice, err = mm.findFreeNBDDevice()
-		if err != nil {
-			return fmt.Errorf("failed to find free NBD device: %w", err)
-		}
-		mm.logger.Printf("using discovered NBD device: %s", nbdDevice)
+func (mm *MountManager) createTargetDirectories() error {
+	if err := mm.mkdirAll(mm.targetDir); err != nil {
+		return fmt.Errorf("failed to create target directory %s: %w", mm.targetDir, err)
 	}
 
-	args := []string{"--connect=" + nbdDevice}
-	if mm.format != "" {
-		args = append(args, "--format="+mm.format)
+	for _, name := range mm.partitionDirs(mm.partitions) {
+		partDir := filepath.Join(mm.targetDir, name)
+		if err := mm.mkdirAll(partDir); err != nil {
+			return fmt.Errorf("failed to create partition directory %s: %w", partDir, err)
+		}
 	}
-	args = append(args, mm.sourceDevice)
+	return nil
+}
 
-	cmd := exec.Command("qemu-nbd", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to attach image with qemu-nbd: %w\nOutput: %s", err, string(output))
+func (mm *MountManager) removePartitionDirectories() error { //nolint:unparam
+	for _, name := range mm.partitionDirs(mm.partitions) {
+		partDir := filepath.Join(mm.targetDir, name)
+		if err := mm.removeDir(partDir); err != nil {
+			mm.logger.Printf("failed to remove directory %s: %v", partDir, err)
+		}
 	}
-	mm.nbdDevice = nbdDevice
-	mm.logger.Printf("attached %s to %s", mm.sourceDevice, mm.nbdDevice)
 	return nil
 }
 
-func (mm *MountManager) detachNBD() error {
-	if mm.nbdDevice == "" {
-		return nil
-	}
-	cmd := exec.Command("qemu-nbd", "--disconnect", mm.nbdDevice)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		mm.logger.Printf("warning: failed to disconnect NBD device %s: %v\nOutput: %s", mm.nbdDevice, err, string(output))
+// setDevicesReadOnly marks the source device and each of the partitions read-only
+func (mm *MountManager) setDevicesReadOnly(partitions []Partition) error {
+	if err := mm.setReadOnly(mm.getActiveDevice()); err != nil {
 		return err
 	}
-	mm.logger.Printf("disconnected NBD device %s", mm.nbdDevice)
-	mm.nbdDevice = ""
+	for _, partition := range partitions {
+		if err := mm.setReadOnly(partition.Device); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (mm *MountManager) getActiveDevice() string {
-	if mm.nbdDevice != "" {
-		return mm.nbdDevice
+// splitPartitions separates the partitions on the given devices from the rest
+func splitPartitions(partitions []Partition, devices []string) (rest, matched []Partition) {
+	for _, partition := range partitions {
+		if slices.Contains(devices, partition.Device) {
+			matched = append(matched, partition)
+		} else {
+			rest = append(rest, partition)
+		}
 	}
-	return mm.sourceDevice
+	return rest, matched
 }
 
-func (mm *MountManager) discoverPartitions() error {
-	device := mm.getActiveDevice()
-	cmd := exec.Command("sfdisk", "-J", device)
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to list partitions: %w", err)
+func (mm *MountManager) Mount() (err error) {
+	if err := mm.checkTargetFree(); err != nil {
+		return err
 	}
+	mm.beginState()
+	mm.undoStack = nil
+	defer func() {
+		if err != nil {
+			mm.abortMount()
+		}
+	}()
 
-	var sfdiskData SfdiskOutput
-	if err := json.Unmarshal(output, &sfdiskData); err != nil {
-		return fmt.Errorf("failed to parse sfdisk output: %w", err)
+	if err := mm.attach(); err != nil {
+		return err
 	}
 
-	mm.partitions = []Partition{}
-	for i, part := range sfdiskData.PartitionTable.Partitions {
-		// Calculate size in human readable format (sectors to bytes to MB/GB)
-		sizeBytes := part.Size * sfdiskData.PartitionTable.SectorSize
-		var sizeStr string
-		if sizeBytes >= 1024*1024*1024 {
-			sizeStr = fmt.Sprintf("%.1fG", float64(sizeBytes)/(1024*1024*1024))
-		} else if sizeBytes >= 1024*1024 {
-			sizeStr = fmt.Sprintf("%.1fM", float64(sizeBytes)/(1024*1024))
-		} else {
-			sizeStr = fmt.Sprintf("%dK", sizeBytes/1024)
-		}
+	if err := mm.discoverPartitions(); err != nil {
+		return err
+	}
 
-		partition := Partition{
-			Device: part.Node,
-			Number: i + 1,
-			Size:   sizeStr,
-		}
-		mm.partitions = append(mm.partitions, partition)
+	// Fail, rather than leave the device attached with nothing mounted
+	if len(mm.partitions) == 0 {
+		return fmt.Errorf("no partitions or filesystem found on %s", mm.getActiveDevice())
 	}
 
-	mm.logger.Printf("discovered %d partitions", len(mm.partitions))
-	return nil
-}
+	mm.probeDiscovered()
+	discovered := len(mm.partitions)
+	mm.partitions = mm.selectPartitions(mm.partitions)
 
-func (mm *MountManager) createTargetDirectories() error {
-	if err := os.MkdirAll(mm.targetDir, 0755); err != nil {
-		return fmt.Errorf("failed to create target directory %s: %w", mm.targetDir, err)
+	// RAID arrays are mounted in place of their members, which may be on
+	// the additional sources. Members among the partitions are still
+	// marked read-only.
+	members, err := mm.attachAdditionalSources()
+	if err != nil {
+		return err
+	}
+	arrays, used, err := mm.assembleRAID(slices.Concat(mm.partitions, members))
+	if err != nil {
+		return err
 	}
+	var consumed []Partition
+	mm.partitions, consumed = splitPartitions(mm.partitions, used)
+	mm.partitions = append(mm.partitions, arrays...)
 
-	for _, partition := range mm.partitions {
-		partDir := filepath.Join(mm.targetDir, fmt.Sprintf("partition%d", partition.Number))
-		if err := os.MkdirAll(partDir, 0755); err != nil {
-			return fmt.Errorf("failed to create partition directory %s: %w", partDir, err)
-		}
+	// Encrypted partitions are replaced by their unlocked devices
+	mm.partitions, err = mm.unlockLUKS(mm.partitions)
+	if err != nil {
+		return err
 	}
-	return nil
-}
 
-func (mm *MountManager) removePartitionDirectories() error { //nolint:unparam
-	for _, partition := range mm.partitions {
-		partDir := filepath.Join(mm.targetDir, fmt.Sprintf("partition%d", partition.Number))
-		if err := os.Remove(partDir); err != nil {
-			mm.logger.Printf("failed to remove directory %s: %v", partDir, err)
-		}
+	// Logical volumes are mounted in place of the physical volumes holding
+	// them, which are still marked read-only
+	volumes, pvs, err := mm.activateLVM(mm.partitions)
+	if err != nil {
+		return err
+	}
+	var volumeGroupPVs []Partition
+	mm.partitions, volumeGroupPVs = splitPartitions(mm.partitions, pvs)
+	consumed = append(consumed, volumeGroupPVs...)
+	mm.probePartitions(volumes)
+	volumes, err = mm.unlockLUKS(volumes)
+	if err != nil {
+		return err
+	}
+	mm.partitions = mm.filterPartitions(append(mm.partitions, volumes...))
+	if len(mm.partitions) == 0 {
+		return fmt.Errorf("none of the %d partitions were selected", discovered)
 	}
-	return nil
-}
 
-func (mm *MountManager) Mount() error {
-	if mm.isImageFile() {
-		if err := mm.attachImageWithNBD(); err != nil {
+	// Let the profile hand off to a more specific one; the chosen profile
+	// is recorded in the mount state
+	if selector, ok := mm.profile.(ProfileSelector); ok {
+		profile, err := selector.SelectProfile(mm, mm.partitions)
+		if err != nil {
 			return err
 		}
+		mm.profile = profile
+		mm.state.Profile = profile.Name()
 	}
 
-	if err := mm.discoverPartitions(); err != nil {
+	// Validate partitions against profile requirements
+	if err := mm.profile.Validate(mm.partitions); err != nil {
 		return err
 	}
 
-	if len(mm.partitions) == 0 {
-		mm.logger.Printf("no partitions found on %s", mm.getActiveDevice())
-		return nil
+	mm.applyMountOptions(mm.partitions)
+
+	// Images attached read-only are already protected; block devices are
+	// marked read-only before anything is mounted from them
+	if mm.readOnly && mm.device == mm.sourceDevice {
+		if err := mm.setDevicesReadOnly(slices.Concat(mm.partitions, consumed)); err != nil {
+			return err
+		}
 	}
 
-	// Validate partitions against profile requirements
-	if err := mm.profile.Validate(mm.partitions); err != nil {
+	// Use profile to mount partitions
+	if err := mm.profile.Mount(mm, mm.partitions); err != nil {
 		return err
 	}
 
-	// Use profile to mount partitions
-	return mm.profile.Mount(mm, mm.partitions)
+	if err := mm.saveState(); err != nil {
+		mm.logger.Printf("warning: %v", err)
+	}
+	mm.undoStack = nil
+	return nil
 }
 
 func (mm *MountManager) Unmount() error {
+	// Prefer the state recorded at mount time over the profile's heuristics
+	state, err := mm.findState()
+	if err != nil {
+		mm.logger.Printf("warning: failed to read mount state: %v", err)
+	}
+	if state != nil {
+		return mm.unmountState(state)
+	}
+
 	// Initialize partitions slice (profiles will populate during unmount)
 	mm.partitions = []Partition{}
 
@@ -308,11 +339,13 @@ func (mm *MountManager) Unmount() error {
 		return err
 	}
 
-	// Extract NBD device if any partitions are on NBD
-	mm.extractNBDDevice()
-
-	if mm.nbdDevice != "" {
-		return mm.detachNBD()
+	// Detach the device the partitions were on, if a backend attached it,
+	// once nothing is stacked on it any more
+	if mm.findOwner() {
+		if err := mm.removeHolders(mm.device); err != nil {
+			return err
+		}
+		return mm.detach()
 	}
 
 	return nil
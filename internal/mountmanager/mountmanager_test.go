@@ -1,10 +1,19 @@
 package mountmanager
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/larsks/pmount/internal/parttable"
 )
 
 func TestNewMountManager(t *testing.T) {
@@ -63,8 +72,8 @@ func TestNBDDeviceSelection(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewMountManager() error = %v", err)
 	}
-	if mm.nbdDeviceExplicit != "" {
-		t.Errorf("Expected nbdDeviceExplicit to be empty for auto discovery, got %s", mm.nbdDeviceExplicit)
+	if nbd := mm.findBackend("nbd").(*NBDBackend); nbd.Device != "" {
+		t.Errorf("Expected NBD device to be empty for auto discovery, got %s", nbd.Device)
 	}
 
 	// Test explicit NBD device
@@ -72,8 +81,8 @@ func TestNBDDeviceSelection(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewMountManager() error = %v", err)
 	}
-	if mm2.nbdDeviceExplicit != "/dev/nbd5" {
-		t.Errorf("Expected nbdDeviceExplicit to be /dev/nbd5, got %s", mm2.nbdDeviceExplicit)
+	if nbd := mm2.findBackend("nbd").(*NBDBackend); nbd.Device != "/dev/nbd5" {
+		t.Errorf("Expected NBD device to be /dev/nbd5, got %s", nbd.Device)
 	}
 }
 
@@ -115,8 +124,8 @@ func TestCreateTargetDirectories(t *testing.T) {
 		t.Fatalf("NewMountManager() error = %v", err)
 	}
 	mm.partitions = []Partition{
-		{Device: "/dev/test1", Number: 1, Size: "1G"},
-		{Device: "/dev/test2", Number: 2, Size: "2G"},
+		{Device: "/dev/test1", Number: 1, Size: 1 << 30},
+		{Device: "/dev/test2", Number: 2, Size: 2 << 30},
 	}
 
 	err = mm.createTargetDirectories()
@@ -166,8 +175,8 @@ func TestRemovePartitionDirectories(t *testing.T) {
 		t.Fatalf("NewMountManager() error = %v", err)
 	}
 	mm.partitions = []Partition{
-		{Device: "/dev/test1", Number: 1, Size: "1G"},
-		{Device: "/dev/test2", Number: 2, Size: "2G"},
+		{Device: "/dev/test1", Number: 1, Size: 1 << 30},
+		{Device: "/dev/test2", Number: 2, Size: 2 << 30},
 	}
 
 	err = mm.removePartitionDirectories()
@@ -196,19 +205,19 @@ func TestGetActiveDevice(t *testing.T) {
 		t.Fatalf("NewMountManager() error = %v", err)
 	}
 
-	// Test without NBD device
+	// Test without an attached device
 	if mm.getActiveDevice() != "/dev/sda" {
 		t.Errorf("Expected active device to be /dev/sda, got %s", mm.getActiveDevice())
 	}
 
 	// Test with NBD device
-	mm.nbdDevice = "/dev/nbd0"
+	mm.device = "/dev/nbd0"
 	if mm.getActiveDevice() != "/dev/nbd0" {
 		t.Errorf("Expected active device to be /dev/nbd0, got %s", mm.getActiveDevice())
 	}
 }
 
-func TestExtractNBDDevice(t *testing.T) {
+func TestFindOwner(t *testing.T) {
 	mm, err := NewMountManager("/dev/test", "/mnt/test", "", "", "default")
 	if err != nil {
 		t.Fatalf("NewMountManager() error = %v", err)
@@ -216,13 +225,12 @@ func TestExtractNBDDevice(t *testing.T) {
 
 	// Test with NBD partitions
 	mm.partitions = []Partition{
-		{Device: "/dev/nbd1p1", Number: 1, Size: "1G"},
-		{Device: "/dev/nbd1p2", Number: 2, Size: "2G"},
+		{Device: "/dev/nbd1p1", Number: 1, Size: 1 << 30},
+		{Device: "/dev/nbd1p2", Number: 2, Size: 2 << 30},
 	}
 
-	mm.extractNBDDevice()
-	if mm.nbdDevice != "/dev/nbd1" {
-		t.Errorf("Expected NBD device to be /dev/nbd1, got %s", mm.nbdDevice)
+	if !mm.findOwner() || mm.backend.Name() != "nbd" || mm.device != "/dev/nbd1" {
+		t.Errorf("Expected NBD device /dev/nbd1, got %s", mm.device)
 	}
 
 	// Test with non-NBD partitions
@@ -231,13 +239,12 @@ func TestExtractNBDDevice(t *testing.T) {
 		t.Fatalf("NewMountManager() error = %v", err)
 	}
 	mm2.partitions = []Partition{
-		{Device: "/dev/sda1", Number: 1, Size: "1G"},
-		{Device: "/dev/sda2", Number: 2, Size: "2G"},
+		{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
+		{Device: "/dev/sda2", Number: 2, Size: 2 << 30},
 	}
 
-	mm2.extractNBDDevice()
-	if mm2.nbdDevice != "" {
-		t.Errorf("Expected no NBD device for non-NBD partitions, got %s", mm2.nbdDevice)
+	if mm2.findOwner() {
+		t.Errorf("Expected no owner for partitions of a block device, got %s device %s", mm2.backend.Name(), mm2.device)
 	}
 }
 
@@ -284,7 +291,7 @@ func TestPartitionStruct(t *testing.T) {
 	p := Partition{
 		Device: "/dev/sda1",
 		Number: 1,
-		Size:   "500M",
+		Size:   500 << 20,
 	}
 
 	if p.Device != "/dev/sda1" {
@@ -295,40 +302,501 @@ func TestPartitionStruct(t *testing.T) {
 		t.Errorf("Expected partition number to be 1, got %d", p.Number)
 	}
 
-	if p.Size != "500M" {
-		t.Errorf("Expected size to be 500M, got %s", p.Size)
+	if p.HumanSize() != "500.0M" {
+		t.Errorf("Expected size to be 500.0M, got %s", p.HumanSize())
+	}
+	if size := (Partition{}).HumanSize(); size != "unknown" {
+		t.Errorf("Expected unknown size, got %s", size)
+	}
+}
+
+// fakePartitionTable makes device appear to hold a DOS partition table
+// with the given partition nodes
+func fakePartitionTable(t *testing.T, device string, nodes ...string) {
+	t.Helper()
+	table := &parttable.Table{Label: "dos", SectorSize: 512}
+	for i, node := range nodes {
+		number, err := strconv.Atoi(node[len(strings.TrimRight(node, "0123456789")):])
+		if err != nil {
+			t.Fatalf("invalid partition node %s", node)
+		}
+		table.Partitions = append(table.Partitions, parttable.Partition{
+			Number: number,
+			Start:  int64(2048+i*2048) * 512,
+			Size:   2048 * 512,
+			Type:   "83",
+		})
+	}
+	fakeReadPartitionTable(t, device, table, nil)
+}
+
+// fakeReadPartitionTable scripts the result of reading the partition table of device
+func fakeReadPartitionTable(t *testing.T, device string, table *parttable.Table, err error) {
+	t.Helper()
+	prev := readPartitionTable
+	readPartitionTable = func(path string) (*parttable.Table, error) {
+		if path == device {
+			return table, err
+		}
+		return prev(path)
+	}
+	t.Cleanup(func() { readPartitionTable = prev })
+}
+
+// findmntJSON returns findmnt -J output for a single mounted filesystem
+func findmntJSON(target, source string) string {
+	return fmt.Sprintf(`{"filesystems": [{"target": %q, "source": %q}]}`, target, source)
+}
+
+func discardLogger() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+func newTestManager(t *testing.T, source, targetDir, profile string, runner CommandRunner, opts ...Option) *MountManager {
+	t.Helper()
+	opts = append([]Option{
+		WithRunner(runner),
+		WithLogger(discardLogger()),
+		WithStateDir(t.TempDir()),
+	}, opts...)
+	mm, err := NewMountManager(source, targetDir, "", "", profile, opts...)
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+	// Never attach real loop devices from tests
+	setLoopController(mm, &fakeLoopController{unavailable: true})
+	return mm
+}
+
+func assertCommands(t *testing.T, runner *FakeRunner, want []string) {
+	t.Helper()
+	got := runner.Commands()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected commands\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestMountImageWithNBD(t *testing.T) {
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	targetDir := filepath.Join(tempDir, "mnt")
+
+	fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1", "/dev/nbd5p2")
+	runner := NewFakeRunner()
+	mm, err := NewMountManager(image, targetDir, "qcow2", "/dev/nbd5", "default",
+		WithRunner(runner), WithLogger(discardLogger()), WithStateDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 --format=qcow2 " + image,
+		"blkid -p -o export /dev/nbd5p1",
+		"blkid -p -o export /dev/nbd5p2",
+		"mount /dev/nbd5p1 " + filepath.Join(targetDir, "partition1"),
+		"mount /dev/nbd5p2 " + filepath.Join(targetDir, "partition2"),
+	})
+}
+
+func TestMountAttachFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	runner := NewFakeRunner().
+		On("qemu-nbd --connect=/dev/nbd5 "+image, "nbd module not loaded", errors.New("exit status 1"))
+	mm, err := NewMountManager(image, filepath.Join(tempDir, "mnt"), "", "/dev/nbd5", "default",
+		WithRunner(runner), WithLogger(discardLogger()), WithStateDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail when qemu-nbd fails")
+	}
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 " + image,
+	})
+}
+
+func TestMountNoPartitions(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	fakePartitionTable(t, "/dev/sdz")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "default", runner)
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail when there is nothing to mount")
+	}
+	assertCommands(t, runner, []string{"blkid -p -o export /dev/sdz"})
+}
+
+func TestMountNoPartitionsDetachesImage(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	image := writeImage(t, []byte("QFI\xfb"))
+	fakePartitionTable(t, "/dev/nbd5")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, image, targetDir, "default", runner)
+	mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd5"
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail when there is nothing to mount")
+	}
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 " + image,
+		"blkid -p -o export /dev/nbd5",
+		"qemu-nbd --disconnect /dev/nbd5",
+	})
+}
+
+func TestMountPartitionTableFailure(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	fakeReadPartitionTable(t, "/dev/sdz", nil, parttable.ErrNoPartitionTable)
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "default", runner)
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail when the partition table cannot be read")
+	}
+}
+
+func TestMountWholeDeviceFilesystem(t *testing.T) {
+	for _, tt := range []struct {
+		profile string
+		dir     string
+	}{
+		{"default", "partition1"},
+		{"single", ""},
+	} {
+		t.Run(tt.profile, func(t *testing.T) {
+			targetDir := t.TempDir()
+			fakeReadPartitionTable(t, "/dev/sdz1", nil, parttable.ErrNoPartitionTable)
+			runner := NewFakeRunner().
+				On("blkid -p -o export /dev/sdz1", "TYPE=ext4\nLABEL=data\n", nil)
+			mm := newTestManager(t, "/dev/sdz1", targetDir, tt.profile, runner)
+
+			if err := mm.Mount(); err != nil {
+				t.Fatalf("Mount() error = %v", err)
+			}
+			// The filesystem is probed once, when it is found
+			assertCommands(t, runner, []string{
+				"blkid -p -o export /dev/sdz1",
+				"mount /dev/sdz1 " + filepath.Join(targetDir, tt.dir),
+			})
+		})
+	}
+}
+
+func TestUnmountDetachesNBD(t *testing.T) {
+	targetDir := t.TempDir()
+	partDir := filepath.Join(targetDir, "partition1")
+	if err := os.MkdirAll(partDir, 0755); err != nil {
+		t.Fatalf("Failed to create partition directory: %v", err)
+	}
+
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+partDir, findmntJSON(partDir, "/dev/nbd3p1"), nil)
+	mm := newTestManager(t, "", targetDir, "default", runner)
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + partDir,
+		"umount " + partDir,
+		"qemu-nbd --disconnect /dev/nbd3",
+	})
+	if _, err := os.Stat(partDir); !os.IsNotExist(err) {
+		t.Error("Partition directory was not removed")
+	}
+}
+
+func TestMountDryRun(t *testing.T) {
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	targetDir := filepath.Join(tempDir, "mnt")
+
+	fakePartitionTable(t, image, image+"1", image+"2")
+	runner := NewFakeRunner()
+	var plan bytes.Buffer
+	mm, err := NewMountManager(image, targetDir, "", "/dev/nbd5", "raspberrypi",
+		WithRunner(runner), WithLogger(discardLogger()), WithStateDir(t.TempDir()), WithDryRun(&plan))
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	// Only the read-only filesystem probes should have been executed, against
+	// the partition extents in the image itself
+	assertCommands(t, runner, []string{
+		"blkid -p -o export --offset 1048576 --size 1048576 " + image,
+		"blkid -p -o export --offset 2097152 --size 1048576 " + image,
+	})
+
+	want := strings.Join([]string{
+		"qemu-nbd --connect=/dev/nbd5 " + image,
+		"mkdir -p " + targetDir,
+		"mount /dev/nbd5p2 " + targetDir,
+		"mount /dev/nbd5p1 " + filepath.Join(targetDir, "boot", "firmware"),
+	}, "\n") + "\n"
+	if plan.String() != want {
+		t.Errorf("unexpected plan\ngot:\n%s\nwant:\n%s", plan.String(), want)
+	}
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Error("Dry run should not create the target directory")
+	}
+}
+
+func TestUnmountDryRun(t *testing.T) {
+	targetDir := t.TempDir()
+	partDir := filepath.Join(targetDir, "partition1")
+	if err := os.MkdirAll(partDir, 0755); err != nil {
+		t.Fatalf("Failed to create partition directory: %v", err)
+	}
+
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+partDir, findmntJSON(partDir, "/dev/nbd3p1"), nil)
+	var plan bytes.Buffer
+	mm := newTestManager(t, "", targetDir, "default", runner, WithDryRun(&plan))
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{"findmnt -J -M " + partDir})
+	want := strings.Join([]string{
+		"umount " + partDir,
+		"rmdir " + partDir,
+		"qemu-nbd --disconnect /dev/nbd3",
+	}, "\n") + "\n"
+	if plan.String() != want {
+		t.Errorf("unexpected plan\ngot:\n%s\nwant:\n%s", plan.String(), want)
+	}
+	if _, err := os.Stat(partDir); err != nil {
+		t.Error("Dry run should not remove partition directories")
+	}
+}
+
+func TestFormatCommand(t *testing.T) {
+	got := formatCommand("mount", "/dev/sda1", "/mnt/my disk")
+	want := `mount /dev/sda1 "/mnt/my disk"`
+	if got != want {
+		t.Errorf("formatCommand() = %s, want %s", got, want)
+	}
+}
+
+func TestMountReadOnlyImage(t *testing.T) {
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	targetDir := filepath.Join(tempDir, "mnt")
+
+	fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1")
+	runner := NewFakeRunner()
+	mm, err := NewMountManager(image, targetDir, "", "/dev/nbd5", "single",
+		WithRunner(runner), WithLogger(discardLogger()), WithStateDir(t.TempDir()), WithReadOnly())
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
 	}
+
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 --read-only " + image,
+		"blkid -p -o export /dev/nbd5p1",
+		"mount -o ro /dev/nbd5p1 " + targetDir,
+	})
 }
 
-func TestSfdiskStructs(t *testing.T) {
-	// Test that our sfdisk structs are properly structured
-	sfdisk := SfdiskOutput{
-		PartitionTable: SfdiskPartitionTable{
-			Label:      "dos",
-			ID:         "0x12345678",
-			Device:     "/dev/sda",
-			Unit:       "sectors",
-			SectorSize: 512,
-			Partitions: []SfdiskPartition{
-				{
-					Node:  "/dev/sda1",
-					Start: 2048,
-					Size:  1048576,
-					Type:  "83",
-				},
+func TestMountImageSnapshots(t *testing.T) {
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	existingDelta := filepath.Join(tempDir, "existing.qcow2")
+	if err := os.WriteFile(existingDelta, nil, 0644); err != nil {
+		t.Fatalf("Failed to create delta: %v", err)
+	}
+	delta := filepath.Join(tempDir, "delta.qcow2")
+
+	tests := []struct {
+		name   string
+		option Option
+		want   []string
+	}{
+		{
+			name:   "snapshot",
+			option: WithNBDSnapshot(),
+			want:   []string{"qemu-nbd --connect=/dev/nbd5 --snapshot " + image},
+		},
+		{
+			name:   "load snapshot",
+			option: WithLoadSnapshot("before-upgrade"),
+			want:   []string{"qemu-nbd --connect=/dev/nbd5 --read-only --load-snapshot=before-upgrade " + image},
+		},
+		{
+			name:   "new delta",
+			option: WithDelta(delta),
+			want: []string{
+				"qemu-img create -f qcow2 -b " + image + " -F raw " + delta,
+				"qemu-nbd --connect=/dev/nbd5 --format=qcow2 " + delta,
+			},
+		},
+		{
+			name:   "existing delta",
+			option: WithDelta(existingDelta),
+			want: []string{
+				"qemu-img info --output=json " + existingDelta,
+				"qemu-nbd --connect=/dev/nbd5 --format=qcow2 " + existingDelta,
 			},
 		},
 	}
 
-	if sfdisk.PartitionTable.Device != "/dev/sda" {
-		t.Errorf("Expected device to be /dev/sda, got %s", sfdisk.PartitionTable.Device)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1")
+			// The existing delta records its backing file relative to itself
+			runner := NewFakeRunner().
+				On("qemu-img info --output=json "+existingDelta, `{"backing-filename": "disk.img"}`, nil).
+				On("blkid -p -o export /dev/nbd5p1", "TYPE=ext4\n", nil)
+			mm := newTestManager(t, image, filepath.Join(tempDir, "mnt"), "single", runner, tt.option)
+			mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd5"
+
+			if err := mm.Mount(); err != nil {
+				t.Fatalf("Mount() error = %v", err)
+			}
+			if got := runner.Commands()[:len(tt.want)]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Attached with %q, want %q", got, tt.want)
+			}
+		})
 	}
+}
 
-	if len(sfdisk.PartitionTable.Partitions) != 1 {
-		t.Errorf("Expected 1 partition, got %d", len(sfdisk.PartitionTable.Partitions))
+func TestMountRejectsDeltaOfAnotherImage(t *testing.T) {
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	delta := filepath.Join(tempDir, "delta.qcow2")
+	if err := os.WriteFile(delta, nil, 0644); err != nil {
+		t.Fatalf("Failed to create delta: %v", err)
 	}
+	runner := NewFakeRunner().
+		On("qemu-img info --output=json "+delta, `{"backing-filename": "/images/other.img"}`, nil)
+	mm := newTestManager(t, image, filepath.Join(tempDir, "mnt"), "single", runner, WithDelta(delta))
+	mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd5"
 
-	if sfdisk.PartitionTable.Partitions[0].Node != "/dev/sda1" {
-		t.Errorf("Expected partition node to be /dev/sda1, got %s", sfdisk.PartitionTable.Partitions[0].Node)
+	err := mm.Mount()
+	if err == nil || !strings.Contains(err.Error(), "/images/other.img") {
+		t.Fatalf("Expected Mount() to reject a delta backed by another image, got %v", err)
 	}
+	assertCommands(t, runner, []string{"qemu-img info --output=json " + delta})
+}
+
+func TestSnapshotOptionsRejected(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	if _, err := NewMountManager(image, t.TempDir(), "", "", "default", WithDelta("delta.qcow2"), WithNBDSnapshot()); err == nil {
+		t.Error("Expected a delta to be rejected alongside a snapshot")
+	}
+
+	// Snapshots need qemu-nbd even where a loop device would do
+	mm := newTestManager(t, image, t.TempDir(), "default", NewFakeRunner(), WithNBDSnapshot())
+	setLoopController(mm, newFakeLoopController(0))
+	if backend, err := mm.selectBackend(); err != nil || backend.Name() != "nbd" {
+		t.Errorf("selectBackend() = %v, %v; want the nbd backend", backend, err)
+	}
+
+	mm = newTestManager(t, image, t.TempDir(), "default", NewFakeRunner(), WithBackend("loop"), WithNBDSnapshot())
+	if err := mm.Mount(); err == nil {
+		t.Error("Expected a snapshot to be rejected with the loop backend")
+	}
+
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	mm = newTestManager(t, "/dev/sdz", t.TempDir(), "default", NewFakeRunner(), WithNBDSnapshot())
+	if err := mm.Mount(); err == nil {
+		t.Error("Expected a snapshot of a block device to be rejected")
+	}
+}
+
+func TestMountReadOnlyBlockDevice(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := NewFakeRunner().
+		On("blockdev --getro /dev/sdz", "0\n", nil).
+		On("blockdev --getro /dev/sdz1", "1\n", nil).
+		On("findmnt -J -M "+targetDir, findmntJSON(targetDir, "/dev/sdz1"), nil)
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner, WithReadOnly(), WithStateDir(stateDir))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	// /dev/sdz1 was already read-only, so it is left alone
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blockdev --getro /dev/sdz",
+		"blockdev --setro /dev/sdz",
+		"blockdev --getro /dev/sdz1",
+		"mount -o ro /dev/sdz1 " + targetDir,
+		"findmnt -J -M " + targetDir,
+		"umount " + targetDir,
+		"blockdev --setrw /dev/sdz",
+	})
+}
+
+func TestMountReadOnlyRollback(t *testing.T) {
+	targetDir := t.TempDir()
+
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := NewFakeRunner().
+		On("blockdev --getro /dev/sdz", "0\n", nil).
+		On("blockdev --getro /dev/sdz1", "0\n", nil).
+		On("mount -o ro /dev/sdz1 "+targetDir, "", errors.New("exit status 32"))
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner, WithReadOnly())
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail")
+	}
+
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blockdev --getro /dev/sdz",
+		"blockdev --setro /dev/sdz",
+		"blockdev --getro /dev/sdz1",
+		"blockdev --setro /dev/sdz1",
+		"mount -o ro /dev/sdz1 " + targetDir,
+		"blockdev --setrw /dev/sdz1",
+		"blockdev --setrw /dev/sdz",
+	})
 }
@@ -0,0 +1,83 @@
+package mountmanager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MountOptions holds user-specified options passed to mount(8). Options are
+// applied from least to most specific: global options first, then options
+// for the partition's filesystem type, then options for the partition
+// number.
+type MountOptions struct {
+	Global     []string
+	Filesystem map[string][]string
+	Partition  map[int][]string
+}
+
+// splitOptions splits a comma-separated mount option string
+func splitOptions(s string) []string {
+	var opts []string
+	for _, opt := range strings.Split(s, ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// ParseGlobalOptions parses one or more comma-separated option strings
+// (e.g. "noatime,nodev")
+func ParseGlobalOptions(specs []string) []string {
+	var opts []string
+	for _, spec := range specs {
+		opts = append(opts, splitOptions(spec)...)
+	}
+	return opts
+}
+
+// ParsePartitionOptions parses specifications of the form
+// "<number>=<options>" (e.g. "1=uid=1000,gid=1000")
+func ParsePartitionOptions(specs []string) (map[int][]string, error) {
+	opts := make(map[int][]string)
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid partition options %q (expected <number>=<options>)", spec)
+		}
+		number, err := strconv.Atoi(key)
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("invalid partition number in %q", spec)
+		}
+		opts[number] = append(opts[number], splitOptions(value)...)
+	}
+	return opts, nil
+}
+
+// ParseFilesystemOptions parses specifications of the form
+// "<fstype>=<options>" (e.g. "vfat=umask=022")
+func ParseFilesystemOptions(specs []string) (map[string][]string, error) {
+	opts := make(map[string][]string)
+	for _, spec := range specs {
+		fstype, value, ok := strings.Cut(spec, "=")
+		if !ok || fstype == "" {
+			return nil, fmt.Errorf("invalid filesystem options %q (expected <fstype>=<options>)", spec)
+		}
+		opts[fstype] = append(opts[fstype], splitOptions(value)...)
+	}
+	return opts, nil
+}
+
+// applyMountOptions determines the mount options for each partition
+func (mm *MountManager) applyMountOptions(partitions []Partition) {
+	for i := range partitions {
+		partition := &partitions[i]
+
+		var opts []string
+		opts = append(opts, mm.mountOptions.Global...)
+		opts = append(opts, mm.mountOptions.Filesystem[partition.FSType]...)
+		opts = append(opts, mm.mountOptions.Partition[partition.Number]...)
+		partition.MountOptions = opts
+	}
+}
@@ -0,0 +1,103 @@
+package mountmanager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePartitionOptions(t *testing.T) {
+	opts, err := ParsePartitionOptions([]string{"1=uid=1000,gid=1000", "2=noatime", "1=umask=022"})
+	if err != nil {
+		t.Fatalf("ParsePartitionOptions() error = %v", err)
+	}
+	want := map[int][]string{
+		1: {"uid=1000", "gid=1000", "umask=022"},
+		2: {"noatime"},
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("ParsePartitionOptions() = %v, want %v", opts, want)
+	}
+
+	for _, spec := range []string{"uid=1000", "0=ro", "one=ro"} {
+		if _, err := ParsePartitionOptions([]string{spec}); err == nil {
+			t.Errorf("Expected ParsePartitionOptions(%q) to fail", spec)
+		}
+	}
+}
+
+func TestParseFilesystemOptions(t *testing.T) {
+	opts, err := ParseFilesystemOptions([]string{"vfat=umask=022,shortname=mixed", "ext4=noatime"})
+	if err != nil {
+		t.Fatalf("ParseFilesystemOptions() error = %v", err)
+	}
+	want := map[string][]string{
+		"vfat": {"umask=022", "shortname=mixed"},
+		"ext4": {"noatime"},
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("ParseFilesystemOptions() = %v, want %v", opts, want)
+	}
+
+	for _, spec := range []string{"vfat", "=ro"} {
+		if _, err := ParseFilesystemOptions([]string{spec}); err == nil {
+			t.Errorf("Expected ParseFilesystemOptions(%q) to fail", spec)
+		}
+	}
+}
+
+func TestParseGlobalOptions(t *testing.T) {
+	got := ParseGlobalOptions([]string{"noatime,nodev", "", "nosuid"})
+	want := []string{"noatime", "nodev", "nosuid"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseGlobalOptions() = %v, want %v", got, want)
+	}
+}
+
+func TestMountWithOptions(t *testing.T) {
+	targetDir := t.TempDir()
+	bootDir := filepath.Join(targetDir, "boot", "firmware")
+	if err := os.MkdirAll(bootDir, 0755); err != nil {
+		t.Fatalf("Failed to create boot directory: %v", err)
+	}
+
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz1", "DEVNAME=/dev/sdz1\nLABEL=bootfs\nTYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/sdz2", "DEVNAME=/dev/sdz2\nLABEL=rootfs\nTYPE=ext4\n", nil)
+	opts := MountOptions{
+		Global:     []string{"nodev"},
+		Filesystem: map[string][]string{"vfat": {"umask=022"}},
+		Partition:  map[int][]string{1: {"uid=1000", "gid=1000"}, 2: {"noatime"}},
+	}
+	mm := newTestManager(t, "/dev/sdz", targetDir, "raspberrypi", runner, WithMountOptions(opts))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount -o nodev,noatime /dev/sdz2 " + targetDir,
+		"mount -o nodev,umask=022,uid=1000,gid=1000 /dev/sdz1 " + bootDir,
+	})
+}
+
+func TestMountOptionsCannotOverrideReadOnly(t *testing.T) {
+	targetDir := t.TempDir()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz1", "TYPE=ext4\n", nil)
+	opts := MountOptions{Global: []string{"rw", "noatime"}}
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner, WithMountOptions(opts), WithReadOnly())
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	want := "mount -o rw,noatime,ro /dev/sdz1 " + targetDir
+	if commands := runner.Commands(); !containsCommand(commands, want) {
+		t.Errorf("Expected %q among %q", want, commands)
+	}
+}
@@ -0,0 +1,123 @@
+package mountmanager
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultNameTemplate names partition directories partition1, partition2, ...
+const DefaultNameTemplate = "partition{number}"
+
+// templateFields lists the fields a name template can refer to
+var templateFields = []string{"number", "label", "partlabel", "uuid", "partuuid", "fstype"}
+
+var templateFieldRe = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// validateNameTemplate checks that a name template names a single directory
+// and only refers to known fields
+func validateNameTemplate(template string) error {
+	if template == "" {
+		return fmt.Errorf("name template is empty")
+	}
+	if strings.Contains(template, "/") {
+		return fmt.Errorf("name template %q must name a single directory beneath the target directory", template)
+	}
+	for _, match := range templateFieldRe.FindAllStringSubmatch(template, -1) {
+		if !slices.Contains(templateFields, match[1]) {
+			return fmt.Errorf("unknown field {%s} in name template (available: %s)", match[1], strings.Join(templateFields, ", "))
+		}
+	}
+	return nil
+}
+
+// sanitizeName makes a field value safe to use in a directory name by
+// replacing path separators, whitespace and control characters
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// expandNameTemplate fills in the template fields for a partition
+func expandNameTemplate(template string, partition Partition) string {
+	return templateFieldRe.ReplaceAllStringFunc(template, func(field string) string {
+		var value string
+		switch strings.Trim(field, "{}") {
+		case "number":
+			value = strconv.Itoa(partition.Number)
+		case "label":
+			value = partition.Label
+		case "partlabel":
+			value = partition.PartLabel
+		case "uuid":
+			value = partition.UUID
+		case "partuuid":
+			value = partition.PartUUID
+		case "fstype":
+			value = partition.FSType
+		}
+		return sanitizeName(value)
+	})
+}
+
+// partitionDirs returns the directory name of each partition, expanded from
+// the name template. With the default template, LVM logical volumes are
+// named lv-<vg>-<lv>, and RAID arrays md-<array> (or md-<array>-<number>
+// for their partitions). A partition whose name comes out empty (e.g. {label}
+// for a partition without a label) falls back to the default name, and
+// names already taken by an earlier partition get the partition number
+// appended.
+func (mm *MountManager) partitionDirs(partitions []Partition) []string {
+	template := mm.nameTemplate
+	if template == "" {
+		template = DefaultNameTemplate
+	}
+
+	names := make([]string, len(partitions))
+	used := make(map[string]bool)
+	for i, partition := range partitions {
+		name := expandNameTemplate(template, partition)
+		if name == "." || name == ".." {
+			name = ""
+		}
+		switch {
+		case partition.LV != "" && (name == "" || template == DefaultNameTemplate):
+			name = "lv-" + sanitizeName(partition.VG) + "-" + sanitizeName(partition.LV)
+		case partition.Array != "" && (name == "" || template == DefaultNameTemplate):
+			name = "md-" + sanitizeName(partition.Array)
+			if partition.Number > 0 {
+				name += "-" + strconv.Itoa(partition.Number)
+			}
+		case name == "":
+			name = expandNameTemplate(DefaultNameTemplate, partition)
+		}
+		if used[name] {
+			base := fmt.Sprintf("%s_%d", name, partition.Number)
+			name = base
+			for n := 2; used[name]; n++ {
+				name = fmt.Sprintf("%s_%d", base, n)
+			}
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// partitionNumber returns the partition number at the end of a partition
+// device node (e.g. /dev/nbd0p2 -> 2), or 0 if there is none
+func partitionNumber(device string) int {
+	digits := len(device)
+	for digits > 0 && device[digits-1] >= '0' && device[digits-1] <= '9' {
+		digits--
+	}
+	number, _ := strconv.Atoi(device[digits:])
+	return number
+}
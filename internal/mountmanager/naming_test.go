@@ -0,0 +1,120 @@
+package mountmanager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateNameTemplate(t *testing.T) {
+	for _, template := range []string{"partition{number}", "{label}", "{fstype}-{uuid}", "disk", "{partlabel}_{partuuid}"} {
+		if err := validateNameTemplate(template); err != nil {
+			t.Errorf("validateNameTemplate(%q) error = %v", template, err)
+		}
+	}
+	for _, template := range []string{"", "{size}", "{label}/{number}", "/mnt/img/{label}"} {
+		if err := validateNameTemplate(template); err == nil {
+			t.Errorf("Expected validateNameTemplate(%q) to fail", template)
+		}
+	}
+
+	if _, err := NewMountManager("/dev/sda", "/mnt/test", "", "", "default", WithNameTemplate("{bogus}")); err == nil {
+		t.Error("Expected NewMountManager() to reject an invalid name template")
+	}
+}
+
+func TestPartitionDirs(t *testing.T) {
+	partitions := []Partition{
+		{Number: 1, FSType: "vfat", Label: "EFI System", UUID: "4B2C-19F0"},
+		{Number: 2, FSType: "ext4", Label: "root", UUID: "0b1c"},
+		{Number: 3, FSType: "ext4", Label: "root"},
+		{Number: 5, FSType: "ext4"},
+		{Number: 6, FSType: "xfs", Label: "../etc"},
+	}
+
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{"", []string{"partition1", "partition2", "partition3", "partition5", "partition6"}},
+		{"{label}", []string{"EFI_System", "root", "root_3", "partition5", ".._etc"}},
+		{"{fstype}", []string{"vfat", "ext4", "ext4_3", "ext4_5", "xfs"}},
+		{"p{number}-{uuid}", []string{"p1-4B2C-19F0", "p2-0b1c", "p3-", "p5-", "p6-"}},
+	}
+	for _, tt := range tests {
+		mm := &MountManager{nameTemplate: tt.template}
+		if got := mm.partitionDirs(partitions); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("partitionDirs(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestPartitionNumber(t *testing.T) {
+	tests := map[string]int{
+		"/dev/sda1":      1,
+		"/dev/nbd0p12":   12,
+		"/dev/loop3p2":   2,
+		"/dev/sda":       0,
+		"/dev/mapper/vg": 0,
+	}
+	for device, want := range tests {
+		if got := partitionNumber(device); got != want {
+			t.Errorf("partitionNumber(%s) = %d, want %d", device, got, want)
+		}
+	}
+}
+
+func TestMountWithNameTemplate(t *testing.T) {
+	targetDir := t.TempDir()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz1", "LABEL=bootfs\nTYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/sdz2", "LABEL=rootfs\nTYPE=ext4\n", nil)
+	mm := newTestManager(t, "/dev/sdz", targetDir, "default", runner, WithNameTemplate("{label}"))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount /dev/sdz1 " + filepath.Join(targetDir, "bootfs"),
+		"mount /dev/sdz2 " + filepath.Join(targetDir, "rootfs"),
+	})
+}
+
+func TestUnmountAnyDirectoryNames(t *testing.T) {
+	targetDir := t.TempDir()
+	bootDir := filepath.Join(targetDir, "bootfs")
+	rootDir := filepath.Join(targetDir, "rootfs")
+	emptyDir := filepath.Join(targetDir, "empty")
+	for _, dir := range []string{bootDir, rootDir, emptyDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+
+	// Without recorded state, every mounted directory beneath the target
+	// directory is unmounted, whatever it is called
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+bootDir, findmntJSON(bootDir, "/dev/nbd3p1"), nil).
+		On("findmnt -J -M "+rootDir, findmntJSON(rootDir, "/dev/nbd3p2"), nil)
+	mm := newTestManager(t, "", targetDir, "default", runner)
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + bootDir,
+		"findmnt -J -M " + emptyDir,
+		"findmnt -J -M " + rootDir,
+		"umount " + bootDir,
+		"umount " + rootDir,
+		"qemu-nbd --disconnect /dev/nbd3",
+	})
+	if _, err := os.Stat(emptyDir); err != nil {
+		t.Error("Directories with nothing mounted should be left alone")
+	}
+}
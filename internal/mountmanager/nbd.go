@@ -0,0 +1,291 @@
+package mountmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// nbdTimeout is how long to wait for an attached NBD device to report
+	// its size and for udev to create the nodes of its partitions
+	nbdTimeout = 10 * time.Second
+
+	// nbdPollInterval is how often the device is checked while waiting
+	nbdPollInterval = 100 * time.Millisecond
+
+	// deviceSize returns the size in bytes the kernel reports for a block
+	// device, or 0 if it has none yet. Tests replace it.
+	deviceSize = func(device string) int64 {
+		data, err := os.ReadFile(filepath.Join(sysBlockDir, filepath.Base(device), "size"))
+		if err != nil {
+			return 0
+		}
+		sectors, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		return sectors * 512
+	}
+
+	// deviceNodeExists reports whether a device node has been created.
+	// Tests replace it.
+	deviceNodeExists = func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+)
+
+// NBDBackend attaches images of any format supported by qemu-nbd to a
+// network block device
+type NBDBackend struct {
+	// Device is the NBD device to use; a free one is found if empty
+	Device string
+
+	// Snapshot makes writes to the device temporary: they are discarded
+	// when it is detached
+	Snapshot bool
+
+	// LoadSnapshot names a qcow2 internal snapshot to attach, read-only,
+	// instead of the image's current state
+	LoadSnapshot string
+
+	// Delta names a qcow2 file that is attached instead of the image, so
+	// that writes go to it and the image is left alone. It is created, with
+	// the image as its backing file, if it does not exist.
+	Delta string
+}
+
+// snapshotting reports whether the backend is to attach something other
+// than the image as it is
+func (b *NBDBackend) snapshotting() bool {
+	return b.Snapshot || b.LoadSnapshot != "" || b.Delta != ""
+}
+
+func (b *NBDBackend) Name() string {
+	return "nbd"
+}
+
+func (b *NBDBackend) Attach(mm *MountManager) (string, error) {
+	var nbdDevice string
+	var err error
+
+	if b.Device != "" {
+		nbdDevice = b.Device
+		mm.logger.Printf("using explicitly specified NBD device: %s", nbdDevice)
+	} else {
+		nbdDevice, err = findFreeNBDDevice()
+		if err != nil {
+			return "", fmt.Errorf("failed to find free NBD device: %w", err)
+		}
+		mm.logger.Printf("using discovered NBD device: %s", nbdDevice)
+	}
+
+	image, format := mm.sourceDevice, mm.format
+	if b.Delta != "" {
+		if err := b.createDelta(mm); err != nil {
+			return "", err
+		}
+		image, format = b.Delta, "qcow2"
+	}
+
+	args := []string{"--connect=" + nbdDevice}
+	if mm.readOnly {
+		args = append(args, "--read-only")
+	}
+	if format != "" {
+		args = append(args, "--format="+format)
+	}
+	if b.Snapshot {
+		args = append(args, "--snapshot")
+	}
+	if b.LoadSnapshot != "" {
+		args = append(args, "--load-snapshot="+b.LoadSnapshot)
+	}
+	args = append(args, image)
+
+	if output, err := mm.runAction("qemu-nbd", args...); err != nil {
+		return "", fmt.Errorf("failed to attach image with qemu-nbd: %w\nOutput: %s", err, string(output))
+	}
+	switch {
+	case b.Snapshot:
+		mm.logger.Printf("attached %s to %s; writes are discarded when it is detached", image, nbdDevice)
+	case b.LoadSnapshot != "":
+		mm.logger.Printf("attached snapshot %s of %s to %s", b.LoadSnapshot, image, nbdDevice)
+	default:
+		mm.logger.Printf("attached %s to %s", image, nbdDevice)
+	}
+	return nbdDevice, nil
+}
+
+// createDelta creates the delta file, backed by the image, unless it
+// already exists. A delta created for a mount that then fails is removed.
+func (b *NBDBackend) createDelta(mm *MountManager) error {
+	// The backing file is recorded relative to the delta unless absolute
+	backing, err := filepath.Abs(mm.sourceDevice)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(b.Delta); err == nil {
+		if err := b.checkDelta(mm, backing); err != nil {
+			return err
+		}
+		mm.logger.Printf("using existing delta %s", b.Delta)
+		return nil
+	}
+	format := mm.format
+	if format == "" {
+		if format, err = detectImageFormat(mm.sourceDevice); err != nil {
+			return fmt.Errorf("failed to detect format of %s: %w", mm.sourceDevice, err)
+		}
+	}
+
+	if output, err := mm.runAction("qemu-img", "create", "-f", "qcow2", "-b", backing, "-F", format, b.Delta); err != nil {
+		return fmt.Errorf("failed to create delta %s: %w", b.Delta, commandError(err, output))
+	}
+	mm.logger.Printf("created delta %s backed by %s", b.Delta, backing)
+	mm.pushUndo("remove delta "+b.Delta, func() error {
+		return mm.removeFile(b.Delta)
+	})
+	return nil
+}
+
+// checkDelta makes sure an existing delta is backed by the image, since
+// one made for another image would show that image's data instead
+func (b *NBDBackend) checkDelta(mm *MountManager, backing string) error {
+	output, err := mm.runner.Output("qemu-img", "info", "--output=json", b.Delta)
+	if err != nil {
+		return fmt.Errorf("failed to read delta %s: %w", b.Delta, commandError(err, output))
+	}
+	var info struct {
+		BackingFilename string `json:"backing-filename"`
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return fmt.Errorf("failed to parse qemu-img output for %s: %w", b.Delta, err)
+	}
+	if info.BackingFilename == "" {
+		return fmt.Errorf("delta %s has no backing file; expected %s", b.Delta, backing)
+	}
+
+	deltaBacking := info.BackingFilename
+	if !filepath.IsAbs(deltaBacking) {
+		deltaBacking = filepath.Join(filepath.Dir(b.Delta), deltaBacking)
+	}
+	if deltaBacking, err = filepath.Abs(deltaBacking); err != nil {
+		return err
+	}
+	if deltaBacking != backing {
+		return fmt.Errorf("delta %s is backed by %s, not %s", b.Delta, deltaBacking, backing)
+	}
+	return nil
+}
+
+// Partitions waits for qemu-nbd to have connected the device before reading
+// its partition table, and for udev to have created the nodes of the
+// partitions before returning them
+func (b *NBDBackend) Partitions(mm *MountManager, device string) ([]Partition, error) {
+	if mm.dryRun {
+		return mm.listPartitions(device)
+	}
+
+	deadline := time.Now().Add(nbdTimeout)
+	if !waitUntil(deadline, func() bool { return deviceSize(device) > 0 }) {
+		return nil, fmt.Errorf("timed out after %v waiting for %s to be connected", nbdTimeout, device)
+	}
+	partitions, err := mm.listPartitions(device)
+	if err != nil {
+		return nil, err
+	}
+	if err := mm.waitForPartitionNodes(device, partitions, deadline); err != nil {
+		return nil, err
+	}
+	return partitions, nil
+}
+
+// waitForPartitionNodes waits until the node of every partition exists. If
+// they are slow to appear, the kernel is asked to re-read the partition
+// table once, in case it read the table before the device was ready.
+func (mm *MountManager) waitForPartitionNodes(device string, partitions []Partition, deadline time.Time) error {
+	var missing []string
+	allPresent := func() bool {
+		missing = nil
+		for _, partition := range partitions {
+			if !deviceNodeExists(partition.Device) {
+				missing = append(missing, partition.Device)
+			}
+		}
+		return len(missing) == 0
+	}
+
+	reread := time.Now().Add(nbdTimeout / 4)
+	if reread.After(deadline) {
+		reread = deadline
+	}
+	if waitUntil(reread, allPresent) {
+		return nil
+	}
+	mm.logger.Printf("waiting for %s; re-reading the partition table of %s", strings.Join(missing, ", "), device)
+	if output, err := mm.runAction("blockdev", "--rereadpt", device); err != nil {
+		mm.logger.Printf("warning: failed to re-read the partition table of %s: %v", device, commandError(err, output))
+	}
+	if waitUntil(deadline, allPresent) {
+		return nil
+	}
+	return fmt.Errorf("timed out after %v waiting for the partitions of %s to appear (missing %s)", nbdTimeout, device, strings.Join(missing, ", "))
+}
+
+// waitUntil checks ready every nbdPollInterval until it returns true or the
+// deadline passes, and reports whether it returned true
+func waitUntil(deadline time.Time, ready func() bool) bool {
+	for {
+		if ready() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(nbdPollInterval)
+	}
+}
+
+func (b *NBDBackend) Detach(mm *MountManager, device string) error {
+	if output, err := mm.runAction("qemu-nbd", "--disconnect", device); err != nil {
+		mm.logger.Printf("warning: failed to disconnect NBD device %s: %v\nOutput: %s", device, err, string(output))
+		return err
+	}
+	mm.logger.Printf("disconnected NBD device %s", device)
+	return nil
+}
+
+func (b *NBDBackend) Owns(device string) (string, bool) {
+	return ownedDevice(device, "/dev/nbd")
+}
+
+func findFreeNBDDevice() (string, error) {
+	i := 0
+	for {
+		nbdDevice := fmt.Sprintf("nbd%d", i)
+		nbdDevicePath := fmt.Sprintf("/dev/%s", nbdDevice)
+		nbdSysFSPath := filepath.Join(sysBlockDir, nbdDevice)
+		i++
+
+		// If nbdDevicePath does not exist, assume we have reached the end of
+		// available nbd devices.
+		if _, err := os.Stat(nbdDevicePath); os.IsNotExist(err) {
+			break
+		}
+
+		// Check if device is in use by looking for the pid file
+		pidFile := fmt.Sprintf("%s/pid", nbdSysFSPath)
+		if _, err := os.Stat(pidFile); err == nil {
+			// If pid file exists, NBD device is in use
+			continue
+		}
+
+		// Device appears free
+		return nbdDevicePath, nil
+	}
+
+	return "", fmt.Errorf("no free NBD devices found (checked /dev/nbd0 through /dev/nbd%d)", i)
+}
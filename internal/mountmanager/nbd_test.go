@@ -0,0 +1,111 @@
+package mountmanager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Devices attached by tests are ready at once, unless a test says
+	// otherwise
+	deviceSize = func(string) int64 { return 1 << 30 }
+	deviceNodeExists = func(string) bool { return true }
+	os.Exit(m.Run())
+}
+
+// fakeNBDReadiness makes /dev/nbd5 report no size the first unsized times
+// it is checked (or always, if unsized is negative), and its partition nodes
+// missing until nodes is set
+func fakeNBDReadiness(t *testing.T, unsized int, nodes *bool) {
+	t.Helper()
+	oldSize, oldExists := deviceSize, deviceNodeExists
+	oldTimeout, oldInterval := nbdTimeout, nbdPollInterval
+	nbdTimeout, nbdPollInterval = 200*time.Millisecond, time.Millisecond
+	checks := 0
+	deviceSize = func(device string) int64 {
+		if checks++; unsized < 0 || checks <= unsized {
+			return 0
+		}
+		return 1 << 30
+	}
+	deviceNodeExists = func(path string) bool {
+		return path == "/dev/nbd5" || *nodes
+	}
+	t.Cleanup(func() {
+		deviceSize, deviceNodeExists = oldSize, oldExists
+		nbdTimeout, nbdPollInterval = oldTimeout, oldInterval
+	})
+}
+
+// newNBDTestManager attaches an image to /dev/nbd5 with the single profile
+func newNBDTestManager(t *testing.T, runner *FakeRunner) (*MountManager, string) {
+	t.Helper()
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1")
+	mm, err := NewMountManager(image, filepath.Join(tempDir, "mnt"), "", "/dev/nbd5", "single",
+		WithRunner(runner), WithLogger(discardLogger()), WithStateDir(t.TempDir()), WithBackend("nbd"))
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+	return mm, image
+}
+
+func TestNBDWaitsForPartitionNodes(t *testing.T) {
+	// qemu-nbd returns before the device is connected, and udev only
+	// creates the partition nodes once the partition table is re-read
+	nodes := false
+	fakeNBDReadiness(t, 3, &nodes)
+	runner := NewFakeRunner()
+	runner.Handle("blockdev", func(args []string) ([]byte, error) {
+		nodes = true
+		return nil, nil
+	})
+	mm, image := newNBDTestManager(t, runner)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 " + image,
+		"blockdev --rereadpt /dev/nbd5",
+		"blkid -p -o export /dev/nbd5p1",
+		"mount /dev/nbd5p1 " + mm.targetDir,
+	})
+}
+
+func TestNBDPartitionNodesTimeout(t *testing.T) {
+	nodes := false
+	fakeNBDReadiness(t, 0, &nodes)
+	runner := NewFakeRunner()
+	mm, _ := newNBDTestManager(t, runner)
+
+	err := mm.Mount()
+	if err == nil || !strings.Contains(err.Error(), "missing /dev/nbd5p1") {
+		t.Fatalf("Expected Mount() to time out waiting for /dev/nbd5p1, got %v", err)
+	}
+	if commands := runner.Commands(); !containsCommand(commands, "qemu-nbd --disconnect /dev/nbd5") {
+		t.Errorf("Expected the device to be detached, got %q", commands)
+	}
+}
+
+func TestNBDConnectTimeout(t *testing.T) {
+	nodes := true
+	fakeNBDReadiness(t, -1, &nodes)
+	runner := NewFakeRunner()
+	mm, _ := newNBDTestManager(t, runner)
+
+	err := mm.Mount()
+	if err == nil || !strings.Contains(err.Error(), "waiting for /dev/nbd5 to be connected") {
+		t.Fatalf("Expected Mount() to time out waiting for /dev/nbd5, got %v", err)
+	}
+	if commands := runner.Commands(); containsCommand(commands, "blockdev --rereadpt /dev/nbd5") {
+		t.Errorf("Expected the partition table not to be read, got %q", commands)
+	}
+}
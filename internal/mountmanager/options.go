@@ -0,0 +1,152 @@
+package mountmanager
+
+import (
+	"io"
+	"log"
+)
+
+// Option configures optional MountManager behavior
+type Option func(*MountManager)
+
+// WithRunner sets the CommandRunner used to execute external commands
+func WithRunner(runner CommandRunner) Option {
+	return func(mm *MountManager) {
+		mm.runner = runner
+	}
+}
+
+// WithLogger sets the logger used for progress messages
+func WithLogger(logger *log.Logger) Option {
+	return func(mm *MountManager) {
+		mm.logger = logger
+	}
+}
+
+// WithDryRun causes actions that modify the system (attaching images,
+// creating directories, mounting and unmounting) to be written to w
+// instead of executed. Partition discovery still runs normally.
+func WithDryRun(w io.Writer) Option {
+	return func(mm *MountManager) {
+		mm.dryRun = true
+		mm.planOutput = w
+	}
+}
+
+// WithStateDir sets the directory in which mount session state is recorded
+func WithStateDir(dir string) Option {
+	return func(mm *MountManager) {
+		mm.stateDir = dir
+	}
+}
+
+// WithKeepGoing makes mounting best-effort: partitions that fail to mount
+// are skipped, and a failed mount leaves whatever was already done in place
+// instead of rolling it back.
+func WithKeepGoing() Option {
+	return func(mm *MountManager) {
+		mm.keepGoing = true
+	}
+}
+
+// WithReadOnly attaches images read-only, marks block devices read-only
+// before mounting from them, and mounts every filesystem with -o ro
+func WithReadOnly() Option {
+	return func(mm *MountManager) {
+		mm.readOnly = true
+	}
+}
+
+// WithMountOptions sets options passed to every mount issued by the profile
+func WithMountOptions(opts MountOptions) Option {
+	return func(mm *MountManager) {
+		mm.mountOptions = opts
+	}
+}
+
+// WithBackend selects how image files are attached: "nbd" uses qemu-nbd,
+// "loop" uses a loop device (raw images only), and "auto" or "" uses a loop
+// device for raw images and qemu-nbd for everything else
+func WithBackend(backend string) Option {
+	return func(mm *MountManager) {
+		mm.backendName = backend
+	}
+}
+
+// WithPartitionSelection restricts which of the discovered partitions are
+// handed to the profile
+func WithPartitionSelection(selection PartitionSelection) Option {
+	return func(mm *MountManager) {
+		mm.selection = selection
+	}
+}
+
+// WithNameTemplate sets how the default profile names partition directories
+// (e.g. "{label}"); see DefaultNameTemplate
+func WithNameTemplate(template string) Option {
+	return func(mm *MountManager) {
+		mm.nameTemplate = template
+	}
+}
+
+// WithAdditionalSources attaches more devices or images besides the source,
+// such as the other disks of a RAID set. Only their RAID members are used.
+func WithAdditionalSources(sources ...string) Option {
+	return func(mm *MountManager) {
+		mm.extraSources = sources
+	}
+}
+
+// WithOverlay mounts each partition read-only beneath an overlay, so that
+// changes made to the mounted filesystems never reach the source. Changes go
+// to a tmpfs, and are discarded on unmount, unless upperDir names a
+// directory to keep them in.
+func WithOverlay(upperDir string) Option {
+	return func(mm *MountManager) {
+		mm.overlay = true
+		mm.overlayDir = upperDir
+		mm.readOnly = true
+	}
+}
+
+// WithExportChanges makes unmounting first write the changes made through
+// the session's overlays to a tar archive (see WithOverlay)
+func WithExportChanges(name string) Option {
+	return func(mm *MountManager) {
+		mm.exportTo = name
+	}
+}
+
+// WithNBDSnapshot attaches the image with qemu-nbd --snapshot, so that
+// writes are discarded when it is detached
+func WithNBDSnapshot() Option {
+	return func(mm *MountManager) {
+		mm.findBackend("nbd").(*NBDBackend).Snapshot = true
+	}
+}
+
+// WithLoadSnapshot attaches a qcow2 internal snapshot of the image instead
+// of its current state. Snapshots are read-only, so everything is attached
+// and mounted read-only.
+func WithLoadSnapshot(name string) Option {
+	return func(mm *MountManager) {
+		mm.findBackend("nbd").(*NBDBackend).LoadSnapshot = name
+		mm.readOnly = true
+	}
+}
+
+// WithDelta attaches a qcow2 delta file backed by the image instead of the
+// image itself, creating it if needed, so that writes go to the delta
+func WithDelta(name string) Option {
+	return func(mm *MountManager) {
+		mm.findBackend("nbd").(*NBDBackend).Delta = name
+	}
+}
+
+// WithLUKSKeys unlocks LUKS encrypted volumes with the given keys, so that
+// the filesystems inside them are mounted. Without it, LUKS volumes are left
+// locked.
+func WithLUKSKeys(keys LUKSKeys) Option {
+	return func(mm *MountManager) {
+		mm.luksKeys = &keys
+	}
+}
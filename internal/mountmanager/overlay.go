@@ -0,0 +1,214 @@
+package mountmanager
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// overlayRoot returns the directory holding the read-only mounts beneath
+// the overlays of a target directory (and, without an upper directory of
+// the user's, the tmpfs holding the changes made to them)
+func (mm *MountManager) overlayRoot() string {
+	return filepath.Join(mm.stateDir, "overlay", url.PathEscape(mm.absTargetDir()))
+}
+
+// setupOverlayRoot prepares the overlay root the first time an overlay is
+// mounted, mounting a tmpfs on it unless changes go to the user's directory
+func (mm *MountManager) setupOverlayRoot() (string, error) {
+	root := mm.overlayRoot()
+	if mm.state.OverlayDir != "" {
+		return root, nil
+	}
+	if err := mm.mkdirAll(root); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", root, err)
+	}
+	if mm.overlayDir == "" {
+		if output, err := mm.runAction("mount", "-t", "tmpfs", "-o", "mode=0700", "tmpfs", root); err != nil {
+			return "", fmt.Errorf("failed to mount tmpfs on %s: %w", root, commandError(err, output))
+		}
+		mm.recordFilesystem("tmpfs", root, "")
+		mm.pushUndo("unmount "+root, func() error {
+			return mm.unmountDir(root)
+		})
+	}
+	mm.state.OverlayDir = root
+	return root, nil
+}
+
+// overlayDirs returns the directory a partition is mounted read-only on,
+// and the upper and work directories of the overlay over it
+func (mm *MountManager) overlayDirs(partition Partition) (lower, upper, work string, err error) {
+	root, err := mm.setupOverlayRoot()
+	if err != nil {
+		return "", "", "", err
+	}
+	name := filepath.Base(partition.Device)
+	changes := root
+	if mm.overlayDir != "" {
+		changes = mm.overlayDir
+	}
+	lower = filepath.Join(root, name, "lower")
+	upper = filepath.Join(changes, name, "upper")
+	work = filepath.Join(changes, name, "work")
+
+	// overlayfs separates its options with commas and its lower directories
+	// with colons
+	for _, dir := range []string{lower, upper, work} {
+		if strings.ContainsAny(dir, ",:") {
+			return "", "", "", fmt.Errorf("cannot mount an overlay using %s: overlay directories must not contain commas or colons", dir)
+		}
+		if err := mm.mkdirAll(dir); err != nil {
+			return "", "", "", fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	return lower, upper, work, nil
+}
+
+// mountOverlay mounts an overlay on dir whose lower layer is the partition
+// mounted read-only on lower, so that changes made beneath dir go to upper
+// and never reach the partition
+func (mm *MountManager) mountOverlay(partition Partition, lower, upper, work, dir string) error {
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if output, err := mm.runAction("mount", "-t", "overlay", "-o", opts, "overlay", dir); err != nil {
+		return commandError(err, output)
+	}
+	mm.recordFilesystem("overlay", dir, upper)
+	mm.pushUndo("unmount "+dir, func() error {
+		return mm.unmountDir(dir)
+	})
+	mm.logger.Printf("mounted %s on %s with an overlay; changes are written to %s", partition.Device, dir, upper)
+	return nil
+}
+
+// removeOverlayRoot removes what remains of the overlay root once
+// everything mounted beneath it is unmounted. Only empty directories are
+// removed, so changes kept in the user's directory are never touched.
+func (mm *MountManager) removeOverlayRoot(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error { //nolint:errcheck
+		if err == nil && entry.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := mm.removeDir(dirs[i]); err != nil {
+			mm.logger.Printf("failed to remove directory %s: %v", dirs[i], err)
+		}
+	}
+}
+
+// exportChanges writes the changes made through the overlays of a session
+// to a tar archive (compressed if its name ends in .gz or .tgz). Each
+// overlay's changes are placed beneath the path of its mountpoint relative to
+// the target directory. Deleted files appear as overlayfs whiteouts:
+// character devices with device number 0/0.
+func (mm *MountManager) exportChanges(state *MountState, name string) error {
+	var overlays []MountedPartition
+	for _, partition := range state.Partitions {
+		if partition.Upper != "" {
+			overlays = append(overlays, partition)
+		}
+	}
+	if len(overlays) == 0 {
+		return fmt.Errorf("no changes to export: %s was not mounted with an overlay", state.TargetDir)
+	}
+	if mm.dryRun {
+		mm.logger.Printf("dry run: not exporting changes to %s", name)
+		return nil
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to export changes: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, overlay := range overlays {
+		prefix, err := filepath.Rel(state.TargetDir, overlay.Mountpoint)
+		if err != nil {
+			return err
+		}
+		if err := addTree(tw, overlay.Upper, filepath.ToSlash(prefix)); err != nil {
+			return fmt.Errorf("failed to export changes from %s: %w", overlay.Upper, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	mm.logger.Printf("exported changes to %s", name)
+	return nil
+}
+
+// addTree adds the contents of dir to a tar archive beneath prefix
+func addTree(tw *tar.Writer, dir, prefix string) error {
+	return filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		archiveName := path.Join(prefix, filepath.ToSlash(rel))
+		if archiveName == "." {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(name); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = archiveName
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close() //nolint:errcheck
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
@@ -0,0 +1,149 @@
+package mountmanager
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readOnlyRunner is trackingRunner for a /dev/sdz that is already read-only
+func readOnlyRunner() *FakeRunner {
+	return trackingRunner().
+		On("blockdev --getro /dev/sdz", "1\n", nil).
+		On("blockdev --getro /dev/sdz1", "1\n", nil)
+}
+
+// tarNames returns the names of the entries in a tar archive
+func tarNames(t *testing.T, name string) []string {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", name, err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+func TestMountWithOverlay(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := readOnlyRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner, WithOverlay(""), WithStateDir(stateDir))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	root := mm.overlayRoot()
+	lower := filepath.Join(root, "sdz1", "lower")
+	upper := filepath.Join(root, "sdz1", "upper")
+	work := filepath.Join(root, "sdz1", "work")
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blockdev --getro /dev/sdz",
+		"blockdev --getro /dev/sdz1",
+		"mount -t tmpfs -o mode=0700 tmpfs " + root,
+		"mount -o ro /dev/sdz1 " + lower,
+		"mount -t overlay -o lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work + " overlay " + targetDir,
+	})
+
+	// Changes are exported before everything is unmounted
+	if err := os.MkdirAll(filepath.Join(upper, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "etc", "hostname"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "changes.tar")
+	runner.Calls = nil
+	mm = newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir), WithExportChanges(archive))
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	if got, want := tarNames(t, archive), []string{"etc/", "etc/hostname"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Exported %q, want %q", got, want)
+	}
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + targetDir,
+		"umount " + targetDir,
+		"findmnt -J -M " + lower,
+		"umount " + lower,
+		"findmnt -J -M " + root,
+		"umount " + root,
+	})
+}
+
+func TestMountWithOverlayDir(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+	changes := t.TempDir()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := readOnlyRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner, WithOverlay(changes), WithStateDir(stateDir))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	root := mm.overlayRoot()
+	lower := filepath.Join(root, "sdz1", "lower")
+	upper := filepath.Join(changes, "sdz1", "upper")
+	work := filepath.Join(changes, "sdz1", "work")
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blockdev --getro /dev/sdz",
+		"blockdev --getro /dev/sdz1",
+		"mount -o ro /dev/sdz1 " + lower,
+		"mount -t overlay -o lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work + " overlay " + targetDir,
+	})
+
+	// The changes are kept, and the read-only mount's directory is removed
+	mm = newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed", root)
+	}
+	if _, err := os.Stat(upper); err != nil {
+		t.Errorf("Expected %s to be kept: %v", upper, err)
+	}
+}
+
+func TestExportChangesWithoutOverlay(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := trackingRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner, WithStateDir(stateDir))
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "changes.tar")
+	mm = newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir), WithExportChanges(archive))
+	if err := mm.Unmount(); err == nil {
+		t.Fatal("Expected Unmount() to fail without an overlay")
+	}
+	if commands := runner.Commands(); containsCommand(commands, "umount "+targetDir) {
+		t.Errorf("Expected nothing to be unmounted, got %q", commands)
+	}
+}
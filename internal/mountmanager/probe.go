@@ -0,0 +1,65 @@
+package mountmanager
+
+import (
+	"strconv"
+	"strings"
+)
+
+// probeBlkid returns the key/value pairs reported by blkid for a device.
+// Devices that cannot be probed yield an empty map. Unlike partition tables,
+// superblocks are not read natively, so blkid is a runtime dependency:
+// without it no filesystem, LUKS, LVM or RAID member is recognized.
+func (mm *MountManager) probeBlkid(args ...string) map[string]string {
+	output, err := mm.runner.Output("blkid", append([]string{"-p", "-o", "export"}, args...)...)
+	if err != nil {
+		return make(map[string]string)
+	}
+	return parseExport(output)
+}
+
+// parseExport parses the KEY=value lines printed by blkid and mdadm with
+// their export options
+func parseExport(output []byte) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// probePartitions fills in the filesystem type, label and UUID of each
+// partition. When an image has not actually been attached (in dry-run mode,
+// or when it is inspected in place), each partition is probed at its offset
+// within the image instead.
+func (mm *MountManager) probePartitions(partitions []Partition) {
+	fromImage := mm.isImageFile() && (mm.dryRun || mm.device == "")
+	for i := range partitions {
+		partition := &partitions[i]
+
+		args := []string{partition.Device}
+		if fromImage {
+			args = []string{
+				"--offset", strconv.FormatInt(partition.Start, 10),
+				"--size", strconv.FormatInt(partition.Size, 10),
+				mm.sourceDevice,
+			}
+		}
+
+		values := mm.probeBlkid(args...)
+		partition.FSType = values["TYPE"]
+		partition.Label = values["LABEL"]
+		partition.UUID = values["UUID"]
+	}
+}
+
+// probeDiscovered probes the partitions found on the active device. A
+// filesystem taking up a device without partitions was probed when it was
+// found, and is not probed again.
+func (mm *MountManager) probeDiscovered() {
+	if mm.table != nil && mm.table.Label == "none" {
+		return
+	}
+	mm.probePartitions(mm.partitions)
+}
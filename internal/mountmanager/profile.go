@@ -1,6 +1,11 @@
 package mountmanager
 
-import "fmt"
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
 
 // MountProfile defines the interface for different mount strategies
 type MountProfile interface {
@@ -17,7 +22,11 @@ type MountProfile interface {
 	Name() string
 }
 
-// NewProfile creates a new mount profile by name
+// builtinProfiles lists the names of the built-in profiles
+var builtinProfiles = []string{"default", "single", "raspberrypi"}
+
+// NewProfile creates a new mount profile by name. Built-in profiles take
+// precedence over user-defined profiles with the same name.
 func NewProfile(name string) (MountProfile, error) {
 	switch name {
 	case "default":
@@ -26,7 +35,31 @@ func NewProfile(name string) (MountProfile, error) {
 		return &SingleProfile{}, nil
 	case "raspberrypi":
 		return &RaspberryPiProfile{}, nil
-	default:
-		return nil, fmt.Errorf("unknown mount profile: %s (valid options: default, single, raspberrypi)", name)
+	case "auto":
+		return &AutoProfile{}, nil
+	}
+
+	userProfiles, err := LoadUserProfiles()
+	if err != nil {
+		return nil, err
+	}
+	if profile, ok := userProfiles[name]; ok {
+		return profile, nil
+	}
+
+	return nil, fmt.Errorf("unknown mount profile: %s (valid options: auto, %s)", name, strings.Join(ProfileNames(userProfiles), ", "))
+}
+
+// ProfileNames returns the names of the built-in profiles followed by
+// the names of the given user-defined profiles
+func ProfileNames(userProfiles map[string]*UserProfile) []string {
+	names := slices.Clone(builtinProfiles)
+	var userNames []string
+	for name := range userProfiles {
+		if !slices.Contains(builtinProfiles, name) {
+			userNames = append(userNames, name)
+		}
 	}
+	sort.Strings(userNames)
+	return append(names, userNames...)
 }
@@ -3,13 +3,14 @@ package mountmanager
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 )
 
 // DefaultProfile implements the default mount behavior:
-// - Creates partition1, partition2, etc. subdirectories
+// - Creates a subdirectory per partition, named by the name template
 // - Mounts each partition to its corresponding subdirectory
+// - Skips partitions that hold no filesystem (swap, extended, LVM, LUKS...)
+// - Stops at the first failed mount unless keep-going is enabled
 type DefaultProfile struct{}
 
 func (p *DefaultProfile) Name() string {
@@ -23,28 +24,41 @@ func (p *DefaultProfile) Validate(partitions []Partition) error {
 
 func (p *DefaultProfile) Mount(mm *MountManager, partitions []Partition) error {
 	// Create base target directory
-	if err := os.MkdirAll(mm.targetDir, 0755); err != nil {
+	if err := mm.mkdirAll(mm.targetDir); err != nil {
 		return fmt.Errorf("failed to create target directory %s: %w", mm.targetDir, err)
 	}
 
-	// Create partition subdirectories
+	// Leave out partitions that cannot be mounted instead of failing on them
+	var mountable []Partition
 	for _, partition := range partitions {
-		partDir := filepath.Join(mm.targetDir, fmt.Sprintf("partition%d", partition.Number))
-		if err := os.MkdirAll(partDir, 0755); err != nil {
+		if reason := unmountableReason(partition); reason != "" {
+			mm.logger.Printf("skipping %s: %s", partition.Device, reason)
+			continue
+		}
+		mountable = append(mountable, partition)
+	}
+
+	// Create partition subdirectories
+	names := mm.partitionDirs(mountable)
+	for _, name := range names {
+		partDir := filepath.Join(mm.targetDir, name)
+		if err := mm.mkdirAll(partDir); err != nil {
 			return fmt.Errorf("failed to create partition directory %s: %w", partDir, err)
 		}
 	}
 
 	// Mount each partition
-	for _, partition := range partitions {
-		partDir := filepath.Join(mm.targetDir, fmt.Sprintf("partition%d", partition.Number))
+	for i, partition := range mountable {
+		partDir := filepath.Join(mm.targetDir, names[i])
 
-		cmd := exec.Command("mount", partition.Device, partDir)
-		if err := cmd.Run(); err != nil {
+		if err := mm.mountPartition(partition, partDir); err != nil {
+			if !mm.keepGoing {
+				return fmt.Errorf("failed to mount %s to %s: %w", partition.Device, partDir, err)
+			}
 			mm.logger.Printf("failed to mount %s to %s: %v", partition.Device, partDir, err)
 			continue
 		}
-		mm.logger.Printf("mounted %s (%s) to %s", partition.Device, partition.Size, partDir)
+		mm.logger.Printf("mounted %s (%s) to %s", partition.Device, partition.HumanSize(), partDir)
 	}
 	return nil
 }
@@ -57,10 +71,9 @@ func (p *DefaultProfile) Unmount(mm *MountManager) error {
 
 	// Unmount each partition
 	for _, partition := range mm.partitions {
-		partDir := filepath.Join(mm.targetDir, fmt.Sprintf("partition%d", partition.Number))
+		partDir := partition.Mountpoint
 
-		cmd := exec.Command("umount", partDir)
-		if err := cmd.Run(); err != nil {
+		if err := mm.unmountDir(partDir); err != nil {
 			mm.logger.Printf("failed to unmount %s: %v", partDir, err)
 			continue
 		}
@@ -69,8 +82,8 @@ func (p *DefaultProfile) Unmount(mm *MountManager) error {
 
 	// Remove partition subdirectories
 	for _, partition := range mm.partitions {
-		partDir := filepath.Join(mm.targetDir, fmt.Sprintf("partition%d", partition.Number))
-		if err := os.Remove(partDir); err != nil {
+		partDir := partition.Mountpoint
+		if err := mm.removeDir(partDir); err != nil {
 			mm.logger.Printf("failed to remove directory %s: %v", partDir, err)
 		}
 	}
@@ -96,17 +109,16 @@ func (p *SingleProfile) Validate(partitions []Partition) error {
 
 func (p *SingleProfile) Mount(mm *MountManager, partitions []Partition) error {
 	// Create target directory
-	if err := os.MkdirAll(mm.targetDir, 0755); err != nil {
+	if err := mm.mkdirAll(mm.targetDir); err != nil {
 		return fmt.Errorf("failed to create target directory %s: %w", mm.targetDir, err)
 	}
 
 	// Mount the single partition directly on target
 	partition := partitions[0]
-	cmd := exec.Command("mount", partition.Device, mm.targetDir)
-	if err := cmd.Run(); err != nil {
+	if err := mm.mountPartition(partition, mm.targetDir); err != nil {
 		return fmt.Errorf("failed to mount %s to %s: %w", partition.Device, mm.targetDir, err)
 	}
-	mm.logger.Printf("mounted %s (%s) to %s", partition.Device, partition.Size, mm.targetDir)
+	mm.logger.Printf("mounted %s (%s) to %s", partition.Device, partition.HumanSize(), mm.targetDir)
 	return nil
 }
 
@@ -122,8 +134,7 @@ func (p *SingleProfile) Unmount(mm *MountManager) error {
 	}
 
 	// Unmount from target directory
-	cmd := exec.Command("umount", mm.targetDir)
-	if err := cmd.Run(); err != nil {
+	if err := mm.unmountDir(mm.targetDir); err != nil {
 		return fmt.Errorf("failed to unmount %s: %w", mm.targetDir, err)
 	}
 	mm.logger.Printf("unmounted %s", mm.targetDir)
@@ -149,7 +160,7 @@ func (p *RaspberryPiProfile) Validate(partitions []Partition) error {
 
 func (p *RaspberryPiProfile) Mount(mm *MountManager, partitions []Partition) error {
 	// Create target directory
-	if err := os.MkdirAll(mm.targetDir, 0755); err != nil {
+	if err := mm.mkdirAll(mm.targetDir); err != nil {
 		return fmt.Errorf("failed to create target directory %s: %w", mm.targetDir, err)
 	}
 
@@ -168,28 +179,23 @@ func (p *RaspberryPiProfile) Mount(mm *MountManager, partitions []Partition) err
 	}
 
 	// Mount partition 2 (root) on target directory
-	cmd := exec.Command("mount", partition2.Device, mm.targetDir)
-	if err := cmd.Run(); err != nil {
+	if err := mm.mountPartition(*partition2, mm.targetDir); err != nil {
 		return fmt.Errorf("failed to mount %s to %s: %w", partition2.Device, mm.targetDir, err)
 	}
-	mm.logger.Printf("mounted %s (%s) to %s", partition2.Device, partition2.Size, mm.targetDir)
+	mm.logger.Printf("mounted %s (%s) to %s", partition2.Device, partition2.HumanSize(), mm.targetDir)
 
-	// Check if /boot/firmware exists in the mounted filesystem
+	// Check if /boot/firmware exists in the mounted filesystem. In dry-run
+	// mode nothing has been mounted, so there is nothing to check.
 	bootFirmwarePath := filepath.Join(mm.targetDir, "boot", "firmware")
-	if _, err := os.Stat(bootFirmwarePath); os.IsNotExist(err) {
-		// Unmount partition 2 before returning error
-		exec.Command("umount", mm.targetDir).Run() //nolint:errcheck
+	if _, err := os.Stat(bootFirmwarePath); os.IsNotExist(err) && !mm.dryRun {
 		return fmt.Errorf("/boot/firmware directory does not exist in partition 2 filesystem")
 	}
 
 	// Mount partition 1 (boot) on target/boot/firmware
-	cmd = exec.Command("mount", partition1.Device, bootFirmwarePath)
-	if err := cmd.Run(); err != nil {
-		// Unmount partition 2 before returning error
-		exec.Command("umount", mm.targetDir).Run() //nolint:errcheck
+	if err := mm.mountPartition(*partition1, bootFirmwarePath); err != nil {
 		return fmt.Errorf("failed to mount %s to %s: %w", partition1.Device, bootFirmwarePath, err)
 	}
-	mm.logger.Printf("mounted %s (%s) to %s", partition1.Device, partition1.Size, bootFirmwarePath)
+	mm.logger.Printf("mounted %s (%s) to %s", partition1.Device, partition1.HumanSize(), bootFirmwarePath)
 
 	return nil
 }
@@ -217,8 +223,7 @@ func (p *RaspberryPiProfile) Unmount(mm *MountManager) error {
 	}
 
 	// Unmount boot partition
-	cmd := exec.Command("umount", bootFirmwarePath)
-	if err := cmd.Run(); err != nil {
+	if err := mm.unmountDir(bootFirmwarePath); err != nil {
 		mm.logger.Printf("failed to unmount %s: %v", bootFirmwarePath, err)
 		// Continue to try unmounting root partition
 	} else {
@@ -226,8 +231,7 @@ func (p *RaspberryPiProfile) Unmount(mm *MountManager) error {
 	}
 
 	// Unmount root partition
-	cmd = exec.Command("umount", mm.targetDir)
-	if err := cmd.Run(); err != nil {
+	if err := mm.unmountDir(mm.targetDir); err != nil {
 		return fmt.Errorf("failed to unmount %s: %w", mm.targetDir, err)
 	}
 	mm.logger.Printf("unmounted %s", mm.targetDir)
@@ -1,6 +1,9 @@
 package mountmanager
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -29,6 +32,12 @@ func TestNewProfile(t *testing.T) {
 			wantErr:     false,
 			wantType:    "raspberrypi",
 		},
+		{
+			name:        "auto profile",
+			profileName: "auto",
+			wantErr:     false,
+			wantType:    "auto",
+		},
 		{
 			name:        "unknown profile",
 			profileName: "unknown",
@@ -67,16 +76,16 @@ func TestDefaultProfile_Validate(t *testing.T) {
 		{
 			name: "one partition",
 			partitions: []Partition{
-				{Device: "/dev/sda1", Number: 1, Size: "1G"},
+				{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
 			},
 			wantErr: false,
 		},
 		{
 			name: "multiple partitions",
 			partitions: []Partition{
-				{Device: "/dev/sda1", Number: 1, Size: "1G"},
-				{Device: "/dev/sda2", Number: 2, Size: "2G"},
-				{Device: "/dev/sda3", Number: 3, Size: "3G"},
+				{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
+				{Device: "/dev/sda2", Number: 2, Size: 2 << 30},
+				{Device: "/dev/sda3", Number: 3, Size: 3 << 30},
 			},
 			wantErr: false,
 		},
@@ -108,24 +117,24 @@ func TestSingleProfile_Validate(t *testing.T) {
 		{
 			name: "one partition",
 			partitions: []Partition{
-				{Device: "/dev/sda1", Number: 1, Size: "1G"},
+				{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
 			},
 			wantErr: false,
 		},
 		{
 			name: "two partitions",
 			partitions: []Partition{
-				{Device: "/dev/sda1", Number: 1, Size: "1G"},
-				{Device: "/dev/sda2", Number: 2, Size: "2G"},
+				{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
+				{Device: "/dev/sda2", Number: 2, Size: 2 << 30},
 			},
 			wantErr: true,
 		},
 		{
 			name: "three partitions",
 			partitions: []Partition{
-				{Device: "/dev/sda1", Number: 1, Size: "1G"},
-				{Device: "/dev/sda2", Number: 2, Size: "2G"},
-				{Device: "/dev/sda3", Number: 3, Size: "3G"},
+				{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
+				{Device: "/dev/sda2", Number: 2, Size: 2 << 30},
+				{Device: "/dev/sda3", Number: 3, Size: 3 << 30},
 			},
 			wantErr: true,
 		},
@@ -157,24 +166,24 @@ func TestRaspberryPiProfile_Validate(t *testing.T) {
 		{
 			name: "one partition",
 			partitions: []Partition{
-				{Device: "/dev/sda1", Number: 1, Size: "1G"},
+				{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
 			},
 			wantErr: true,
 		},
 		{
 			name: "two partitions",
 			partitions: []Partition{
-				{Device: "/dev/sda1", Number: 1, Size: "1G"},
-				{Device: "/dev/sda2", Number: 2, Size: "2G"},
+				{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
+				{Device: "/dev/sda2", Number: 2, Size: 2 << 30},
 			},
 			wantErr: false,
 		},
 		{
 			name: "three partitions",
 			partitions: []Partition{
-				{Device: "/dev/sda1", Number: 1, Size: "1G"},
-				{Device: "/dev/sda2", Number: 2, Size: "2G"},
-				{Device: "/dev/sda3", Number: 3, Size: "3G"},
+				{Device: "/dev/sda1", Number: 1, Size: 1 << 30},
+				{Device: "/dev/sda2", Number: 2, Size: 2 << 30},
+				{Device: "/dev/sda3", Number: 3, Size: 3 << 30},
 			},
 			wantErr: true,
 		},
@@ -217,3 +226,176 @@ func TestProfile_Names(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaultProfile_MountKeepGoing(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	part1 := filepath.Join(targetDir, "partition1")
+	part2 := filepath.Join(targetDir, "partition2")
+	runner := NewFakeRunner().
+		On("mount /dev/sdz1 "+part1, "wrong fs type", errors.New("exit status 32"))
+	mm := newTestManager(t, "/dev/sdz", targetDir, "default", runner, WithKeepGoing())
+
+	partitions := []Partition{
+		{Device: "/dev/sdz1", Number: 1, Size: 1 << 30},
+		{Device: "/dev/sdz2", Number: 2, Size: 2 << 30},
+	}
+	if err := mm.profile.Mount(mm, partitions); err != nil {
+		t.Fatalf("DefaultProfile.Mount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"mount /dev/sdz1 " + part1,
+		"mount /dev/sdz2 " + part2,
+	})
+	for _, dir := range []string{part1, part2} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("Expected directory %s to exist: %v", dir, err)
+		}
+	}
+}
+
+func TestSingleProfile_MountUnmount(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+targetDir, findmntJSON(targetDir, "/dev/sdz1"), nil)
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"mount /dev/sdz1 " + targetDir,
+		"findmnt -J -M " + targetDir,
+		"umount " + targetDir,
+	})
+}
+
+func TestSingleProfile_MountRejectsMultiplePartitions(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "single", runner)
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail validation")
+	}
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+	})
+}
+
+func TestSingleProfile_UnmountFailure(t *testing.T) {
+	targetDir := t.TempDir()
+	runner := NewFakeRunner().
+		On("umount "+targetDir, "target is busy", errors.New("exit status 32"))
+	mm := newTestManager(t, "", targetDir, "single", runner)
+
+	if err := mm.Unmount(); err == nil {
+		t.Fatal("Expected Unmount() to fail when umount fails")
+	}
+}
+
+func TestRaspberryPiProfile_MountUnmount(t *testing.T) {
+	targetDir := t.TempDir()
+	bootDir := filepath.Join(targetDir, "boot", "firmware")
+	// Simulate the root filesystem containing /boot/firmware
+	if err := os.MkdirAll(bootDir, 0755); err != nil {
+		t.Fatalf("Failed to create boot directory: %v", err)
+	}
+
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+bootDir, findmntJSON(bootDir, "/dev/sdz1"), nil).
+		On("findmnt -J -M "+targetDir, findmntJSON(targetDir, "/dev/sdz2"), nil)
+	mm := newTestManager(t, "/dev/sdz", targetDir, "raspberrypi", runner)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount /dev/sdz2 " + targetDir,
+		"mount /dev/sdz1 " + bootDir,
+		"findmnt -J -M " + bootDir,
+		"umount " + bootDir,
+		"findmnt -J -M " + targetDir,
+		"umount " + targetDir,
+	})
+}
+
+func TestRaspberryPiProfile_UnmountWithoutState(t *testing.T) {
+	targetDir := t.TempDir()
+	bootDir := filepath.Join(targetDir, "boot", "firmware")
+
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+bootDir, findmntJSON(bootDir, "/dev/nbd2p1"), nil).
+		On("findmnt -J -M "+targetDir, findmntJSON(targetDir, "/dev/nbd2p2"), nil)
+	mm := newTestManager(t, "", targetDir, "raspberrypi", runner)
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + bootDir,
+		"findmnt -J -M " + targetDir,
+		"umount " + bootDir,
+		"umount " + targetDir,
+		"qemu-nbd --disconnect /dev/nbd2",
+	})
+}
+
+func TestRaspberryPiProfile_MountMissingFirmwareDir(t *testing.T) {
+	targetDir := t.TempDir()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "raspberrypi", runner)
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail without /boot/firmware")
+	}
+
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount /dev/sdz2 " + targetDir,
+		"umount " + targetDir,
+	})
+}
+
+func TestRaspberryPiProfile_MountBootFailure(t *testing.T) {
+	targetDir := t.TempDir()
+	bootDir := filepath.Join(targetDir, "boot", "firmware")
+	if err := os.MkdirAll(bootDir, 0755); err != nil {
+		t.Fatalf("Failed to create boot directory: %v", err)
+	}
+
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner().
+		On("mount /dev/sdz1 "+bootDir, "", errors.New("exit status 32"))
+	mm := newTestManager(t, "/dev/sdz", targetDir, "raspberrypi", runner)
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail when boot partition cannot be mounted")
+	}
+
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount /dev/sdz2 " + targetDir,
+		"mount /dev/sdz1 " + bootDir,
+		"umount " + targetDir,
+	})
+}
@@ -0,0 +1,145 @@
+package mountmanager
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// AssembledArray records an md RAID array assembled during a mount session
+type AssembledArray struct {
+	// Name is the array's device under /dev/md, and Device is the md device
+	// it resolves to (e.g. /dev/md/pmount-nbd0-root -> /dev/md127)
+	Name   string `json:"name"`
+	Device string `json:"device"`
+
+	// Members are the partitions the array was assembled from
+	Members []string `json:"members"`
+}
+
+// examineRAIDMember returns what mdadm reports about the md superblock of a
+// RAID member (MD_UUID, MD_NAME, MD_LEVEL, MD_DEVICES, ...)
+func (mm *MountManager) examineRAIDMember(device string) (map[string]string, error) {
+	output, err := mm.runner.Output("mdadm", "--examine", "--export", device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to examine RAID member %s: %w", device, err)
+	}
+	values := parseExport(output)
+	if values["MD_UUID"] == "" {
+		return nil, fmt.Errorf("no md superblock found on %s", device)
+	}
+	return values, nil
+}
+
+// assembleRAID assembles, read-only, the md RAID arrays whose members are
+// among the partitions, and returns the partitions of each array (or the
+// array itself, when it has no partition table) and the members the arrays
+// were assembled from
+func (mm *MountManager) assembleRAID(partitions []Partition) ([]Partition, []string, error) {
+	var members []string
+	for _, partition := range partitions {
+		if partition.FSType == "linux_raid_member" {
+			members = append(members, partition.Device)
+		}
+	}
+	if len(members) == 0 {
+		return nil, nil, nil
+	}
+	if mm.dryRun && (mm.isImageFile() || len(mm.extraSources) > 0) {
+		mm.logger.Printf("dry run: not assembling RAID arrays from %s, which are not attached", strings.Join(members, ", "))
+		return nil, nil, nil
+	}
+
+	// Members are grouped by array UUID, in the order they were found
+	var uuids []string
+	arrayMembers := make(map[string][]string)
+	superblocks := make(map[string]map[string]string)
+	for _, member := range members {
+		values, err := mm.examineRAIDMember(member)
+		if err != nil {
+			return nil, nil, err
+		}
+		uuid := values["MD_UUID"]
+		if _, ok := arrayMembers[uuid]; !ok {
+			uuids = append(uuids, uuid)
+			superblocks[uuid] = values
+		}
+		arrayMembers[uuid] = append(arrayMembers[uuid], member)
+	}
+
+	var result []Partition
+	for _, uuid := range uuids {
+		arrayPartitions, err := mm.assembleArray(superblocks[uuid], arrayMembers[uuid])
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, arrayPartitions...)
+	}
+	return result, members, nil
+}
+
+// raidArrayName returns the name of an array without the host name mdadm
+// prefixes it with (e.g. "server:root" -> "root"). Arrays with old metadata
+// have no name, and are named after their UUID instead.
+func raidArrayName(superblock map[string]string) string {
+	name := superblock["MD_NAME"]
+	if _, after, ok := strings.Cut(name, ":"); ok {
+		name = after
+	}
+	if name == "" {
+		name, _, _ = strings.Cut(superblock["MD_UUID"], ":")
+	}
+	return sanitizeName(name)
+}
+
+// assembleArray assembles one array under a name of its own, so that it
+// cannot clash with the host's arrays (e.g. /dev/md/pmount-nbd0-root). The
+// array is started even if members are missing.
+func (mm *MountManager) assembleArray(superblock map[string]string, members []string) ([]Partition, error) {
+	name := raidArrayName(superblock)
+	array := &AssembledArray{
+		Name:    fmt.Sprintf("/dev/md/pmount-%s-%s", filepath.Base(mm.getActiveDevice()), name),
+		Members: members,
+	}
+
+	args := append([]string{"--assemble", "--readonly", "--run", array.Name}, members...)
+	if output, err := mm.runAction("mdadm", args...); err != nil {
+		return nil, fmt.Errorf("failed to assemble RAID array %s: %w", name, commandError(err, output))
+	}
+	array.Device = array.Name
+	if device, err := filepath.EvalSymlinks(array.Name); err == nil {
+		array.Device = device
+	}
+	mm.logger.Printf("assembled %s array %s as %s", superblock["MD_LEVEL"], name, array.Device)
+	if devices, err := strconv.Atoi(superblock["MD_DEVICES"]); err == nil && len(members) < devices {
+		mm.logger.Printf("warning: RAID array %s is degraded: found %d of %d members", name, len(members), devices)
+	}
+	mm.recordArray(array)
+	mm.pushUndo("stop RAID array "+array.Name, func() error {
+		return mm.stopArray(array)
+	})
+
+	// An array holds either a partition table or a single filesystem
+	var partitions []Partition
+	if table, err := readPartitionTable(array.Device); err == nil && len(table.Partitions) > 0 {
+		partitions = tablePartitions(array.Device, table)
+	} else {
+		partitions = []Partition{{Device: array.Device}}
+	}
+	for i := range partitions {
+		partitions[i].Array = name
+		partitions[i].ReadOnly = true
+	}
+	mm.probePartitions(partitions)
+	return partitions, nil
+}
+
+// stopArray stops an array assembled by assembleArray
+func (mm *MountManager) stopArray(array *AssembledArray) error {
+	if output, err := mm.runAction("mdadm", "--stop", array.Device); err != nil {
+		return fmt.Errorf("failed to stop RAID array %s: %w", array.Name, commandError(err, output))
+	}
+	mm.logger.Printf("stopped RAID array %s", array.Name)
+	return nil
+}
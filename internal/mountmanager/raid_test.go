@@ -0,0 +1,152 @@
+package mountmanager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const raidSuperblock = "MD_LEVEL=raid1\nMD_DEVICES=2\nMD_NAME=server:root\nMD_UUID=3b2a1c4d:5e6f7081:92a3b4c5:d6e7f809\n"
+
+func TestRAIDArrayName(t *testing.T) {
+	tests := []struct {
+		superblock map[string]string
+		want       string
+	}{
+		{map[string]string{"MD_NAME": "server:root", "MD_UUID": "3b2a1c4d:5e6f7081"}, "root"},
+		{map[string]string{"MD_NAME": "data", "MD_UUID": "3b2a1c4d:5e6f7081"}, "data"},
+		{map[string]string{"MD_UUID": "3b2a1c4d:5e6f7081"}, "3b2a1c4d"},
+	}
+	for _, tt := range tests {
+		if got := raidArrayName(tt.superblock); got != tt.want {
+			t.Errorf("raidArrayName(%v) = %q, want %q", tt.superblock, got, tt.want)
+		}
+	}
+}
+
+func TestPartitionDirsRAID(t *testing.T) {
+	partitions := []Partition{
+		{Device: "/dev/md127", Array: "root"},
+		{Device: "/dev/md126p1", Number: 1, Array: "data"},
+		{Device: "/dev/md126p2", Number: 2, Array: "data"},
+	}
+	mm := &MountManager{}
+	want := []string{"md-root", "md-data-1", "md-data-2"}
+	if got := mm.partitionDirs(partitions); !reflect.DeepEqual(got, want) {
+		t.Errorf("partitionDirs() = %q, want %q", got, want)
+	}
+}
+
+func TestMountAssemblesRAIDAcrossSources(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+	first := writeImage(t, nil)
+	second := writeImage(t, nil)
+	fakePartitionTable(t, "/dev/loop0", "/dev/loop0p1", "/dev/loop0p2")
+	fakePartitionTable(t, "/dev/loop1", "/dev/loop1p1", "/dev/loop1p2")
+
+	array := "/dev/md/pmount-loop0-root"
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/loop0p1", "TYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/loop0p2", "TYPE=linux_raid_member\n", nil).
+		On("blkid -p -o export /dev/loop1p1", "TYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/loop1p2", "TYPE=linux_raid_member\n", nil).
+		On("mdadm --examine --export /dev/loop0p2", raidSuperblock, nil).
+		On("mdadm --examine --export /dev/loop1p2", raidSuperblock, nil).
+		On("blkid -p -o export "+array, "TYPE=ext4\n", nil)
+	mm := newTestManager(t, first, targetDir, "default", runner, WithStateDir(stateDir), WithAdditionalSources(second))
+	loops := newFakeLoopController(0)
+	setLoopController(mm, loops)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	part1 := filepath.Join(targetDir, "partition1")
+	rootDir := filepath.Join(targetDir, "md-root")
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/loop0p1",
+		"blkid -p -o export /dev/loop0p2",
+		"blkid -p -o export /dev/loop1p1",
+		"blkid -p -o export /dev/loop1p2",
+		"mdadm --examine --export /dev/loop0p2",
+		"mdadm --examine --export /dev/loop1p2",
+		"mdadm --assemble --readonly --run " + array + " /dev/loop0p2 /dev/loop1p2",
+		"blkid -p -o export " + array,
+		"mount /dev/loop0p1 " + part1,
+		"mount -o ro " + array + " " + rootDir,
+	})
+	if _, err := os.Stat(filepath.Join(targetDir, "partition1_1")); !os.IsNotExist(err) {
+		t.Error("Partitions of additional sources that are not RAID members should not be mounted")
+	}
+
+	// The array is stopped before the sources are detached
+	runner = NewFakeRunner().
+		On("findmnt -J -M "+part1, findmntJSON(part1, "/dev/loop0p1"), nil).
+		On("findmnt -J -M "+rootDir, findmntJSON(rootDir, array), nil)
+	mm = newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+	setLoopController(mm, loops)
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + rootDir,
+		"umount " + rootDir,
+		"findmnt -J -M " + part1,
+		"umount " + part1,
+		"mdadm --stop " + array,
+	})
+	if want := []string{"/dev/loop1", "/dev/loop0"}; !reflect.DeepEqual(loops.detached, want) {
+		t.Errorf("Detached %v, want %v", loops.detached, want)
+	}
+}
+
+func TestRemoveHoldersStopsArrays(t *testing.T) {
+	fakeSysfs(t)
+	for _, dir := range []string{"nbd4/nbd4p2/holders/md127", "md127/md", "md127/holders/dm-0", "dm-0/dm", "dm-0/slaves/md127"} {
+		if err := os.MkdirAll(filepath.Join(sysBlockDir, dir), 0755); err != nil {
+			t.Fatalf("Failed to create fake sysfs: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(sysBlockDir, "dm-0", "dm", "name"), []byte("rhel-root\n"), 0644); err != nil {
+		t.Fatalf("Failed to create fake sysfs: %v", err)
+	}
+
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "", t.TempDir(), "default", runner)
+	if err := mm.removeHolders("/dev/nbd4"); err != nil {
+		t.Fatalf("removeHolders() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"dmsetup remove rhel-root",
+		"mdadm --stop /dev/md127",
+	})
+}
+
+func TestMountSingleRAIDArray(t *testing.T) {
+	targetDir := t.TempDir()
+	first := writeImage(t, nil)
+	second := writeImage(t, nil)
+	fakePartitionTable(t, "/dev/loop0", "/dev/loop0p1")
+	fakePartitionTable(t, "/dev/loop1", "/dev/loop1p1")
+
+	array := "/dev/md/pmount-loop0-root"
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/loop0p1", "TYPE=linux_raid_member\n", nil).
+		On("blkid -p -o export /dev/loop1p1", "TYPE=linux_raid_member\n", nil).
+		On("mdadm --examine --export /dev/loop0p1", raidSuperblock, nil).
+		On("mdadm --examine --export /dev/loop1p1", raidSuperblock, nil).
+		On("blkid -p -o export "+array, "TYPE=ext4\n", nil)
+	mm := newTestManager(t, first, targetDir, "single", runner, WithAdditionalSources(second))
+	setLoopController(mm, newFakeLoopController(0))
+
+	// The members give way to the array
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	want := "mount -o ro " + array + " " + targetDir
+	if commands := runner.Commands(); !containsCommand(commands, want) {
+		t.Errorf("Expected %q among %q", want, commands)
+	}
+}
@@ -0,0 +1,160 @@
+package mountmanager
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// CommandRunner executes external commands on behalf of a MountManager.
+// Replacing the runner allows mount and unmount flows to be exercised
+// without root privileges.
+type CommandRunner interface {
+	// Output runs the command and returns its standard output
+	Output(name string, args ...string) ([]byte, error)
+
+	// CombinedOutput runs the command and returns its combined standard output and standard error
+	CombinedOutput(name string, args ...string) ([]byte, error)
+
+	// CombinedOutputWithInput runs the command with input on its standard
+	// input and returns its combined standard output and standard error
+	CombinedOutputWithInput(input []byte, name string, args ...string) ([]byte, error)
+
+	// Interactive runs the command attached to pmount's standard input,
+	// output and error. The command is asked to terminate (with SIGTERM) if
+	// ctx is cancelled before it exits.
+	Interactive(ctx context.Context, name string, args ...string) error
+}
+
+// ExecRunner runs commands using os/exec
+type ExecRunner struct{}
+
+func (ExecRunner) Output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+func (ExecRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (ExecRunner) CombinedOutputWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.CombinedOutput()
+}
+
+func (ExecRunner) Interactive(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	return cmd.Run()
+}
+
+// FakeCall records a single command executed through a FakeRunner
+type FakeCall struct {
+	Name string
+	Args []string
+
+	// Input is what the command was given on its standard input
+	Input []byte
+}
+
+// String returns the command line for the call, e.g. "mount /dev/sda1 /mnt"
+func (c FakeCall) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// FakeResponse is the scripted result of a command run through a FakeRunner
+type FakeResponse struct {
+	Output []byte
+	Err    error
+}
+
+// FakeRunner is a CommandRunner that records every command it is asked to
+// run and returns scripted responses instead of executing anything.
+// Commands without a scripted response succeed with no output.
+type FakeRunner struct {
+	Calls     []FakeCall
+	responses map[string][]FakeResponse
+	handlers  map[string]func(args []string) ([]byte, error)
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		responses: make(map[string][]FakeResponse),
+		handlers:  make(map[string]func(args []string) ([]byte, error)),
+	}
+}
+
+// Handle registers a function that produces the response for any call to
+// the named command that has no scripted response. This is useful for
+// commands whose arguments are not known in advance, such as temporary
+// directories.
+func (f *FakeRunner) Handle(name string, handler func(args []string) ([]byte, error)) *FakeRunner {
+	f.handlers[name] = handler
+	return f
+}
+
+// On scripts the response for an exact command line. Multiple responses for
+// the same command line are returned in order; the last one is repeated
+// once the others have been consumed.
+func (f *FakeRunner) On(cmdline string, output string, err error) *FakeRunner {
+	f.responses[cmdline] = append(f.responses[cmdline], FakeResponse{
+		Output: []byte(output),
+		Err:    err,
+	})
+	return f
+}
+
+// Commands returns the command lines of all recorded calls, in order
+func (f *FakeRunner) Commands() []string {
+	commands := make([]string, len(f.Calls))
+	for i, call := range f.Calls {
+		commands[i] = call.String()
+	}
+	return commands
+}
+
+func (f *FakeRunner) run(input []byte, name string, args ...string) ([]byte, error) {
+	call := FakeCall{Name: name, Args: args, Input: input}
+	f.Calls = append(f.Calls, call)
+
+	cmdline := call.String()
+	queue := f.responses[cmdline]
+	if len(queue) == 0 {
+		if handler, ok := f.handlers[name]; ok {
+			return handler(args)
+		}
+		return nil, nil
+	}
+
+	response := queue[0]
+	if len(queue) > 1 {
+		f.responses[cmdline] = queue[1:]
+	}
+	return response.Output, response.Err
+}
+
+func (f *FakeRunner) Output(name string, args ...string) ([]byte, error) {
+	return f.run(nil, name, args...)
+}
+
+func (f *FakeRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return f.run(nil, name, args...)
+}
+
+func (f *FakeRunner) CombinedOutputWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	return f.run(input, name, args...)
+}
+
+func (f *FakeRunner) Interactive(ctx context.Context, name string, args ...string) error {
+	_, err := f.run(nil, name, args...)
+	return err
+}
@@ -0,0 +1,38 @@
+package mountmanager
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFakeRunner(t *testing.T) {
+	runner := NewFakeRunner().
+		On("mount /dev/sda1 /mnt", "busy", errors.New("exit status 32")).
+		On("mount /dev/sda1 /mnt", "", nil)
+
+	if _, err := runner.CombinedOutput("mount", "/dev/sda1", "/mnt"); err == nil {
+		t.Error("Expected first scripted response to fail")
+	}
+	if _, err := runner.CombinedOutput("mount", "/dev/sda1", "/mnt"); err != nil {
+		t.Errorf("Expected second scripted response to succeed, got %v", err)
+	}
+	if _, err := runner.CombinedOutput("mount", "/dev/sda1", "/mnt"); err != nil {
+		t.Errorf("Expected last scripted response to repeat, got %v", err)
+	}
+
+	output, err := runner.Output("findmnt", "-J")
+	if err != nil || output != nil {
+		t.Errorf("Expected unscripted command to succeed with no output, got %q, %v", output, err)
+	}
+
+	want := []string{
+		"mount /dev/sda1 /mnt",
+		"mount /dev/sda1 /mnt",
+		"mount /dev/sda1 /mnt",
+		"findmnt -J",
+	}
+	if got := runner.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Commands() = %q, want %q", got, want)
+	}
+}
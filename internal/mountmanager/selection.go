@@ -0,0 +1,193 @@
+package mountmanager
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PartitionRange is an inclusive range of partition numbers
+type PartitionRange struct {
+	First int
+	Last  int
+}
+
+func (r PartitionRange) contains(number int) bool {
+	return number >= r.First && number <= r.Last
+}
+
+// PartitionSelector matches partitions by attribute (fstype, label,
+// partlabel, type, uuid or partuuid). All attributes given must match.
+type PartitionSelector map[string]string
+
+// PartitionSelection restricts which partitions are mounted. A partition is
+// selected if it is in one of the Include ranges (or Include is empty), in
+// none of the Exclude ranges, and matches one of the Only selectors (or Only
+// is empty).
+type PartitionSelection struct {
+	Include []PartitionRange
+	Exclude []PartitionRange
+	Only    []PartitionSelector
+}
+
+// ParsePartitionRanges parses comma-separated partition numbers and ranges
+// (e.g. "1,3-5")
+func ParsePartitionRanges(specs []string) ([]PartitionRange, error) {
+	var ranges []PartitionRange
+	for _, spec := range specs {
+		for _, item := range splitOptions(spec) {
+			first, last, isRange := strings.Cut(item, "-")
+			if !isRange {
+				last = first
+			}
+			firstNumber, err1 := strconv.Atoi(first)
+			lastNumber, err2 := strconv.Atoi(last)
+			if err1 != nil || err2 != nil || firstNumber < 1 || lastNumber < firstNumber {
+				return nil, fmt.Errorf("invalid partition range %q (expected <number> or <first>-<last>)", item)
+			}
+			ranges = append(ranges, PartitionRange{First: firstNumber, Last: lastNumber})
+		}
+	}
+	return ranges, nil
+}
+
+// selectorKeys lists the attributes a PartitionSelector can match
+var selectorKeys = []string{"fstype", "label", "partlabel", "type", "uuid", "partuuid"}
+
+// ParsePartitionSelectors parses selectors of the form
+// "<key>=<value>[,<key>=<value>...]" (e.g. "fstype=ext4,label=rootfs")
+func ParsePartitionSelectors(specs []string) ([]PartitionSelector, error) {
+	var selectors []PartitionSelector
+	for _, spec := range specs {
+		selector := make(PartitionSelector)
+		for _, item := range splitOptions(spec) {
+			key, value, ok := strings.Cut(item, "=")
+			if !ok || !slices.Contains(selectorKeys, key) {
+				return nil, fmt.Errorf("invalid partition selector %q (expected <key>=<value> with key one of %s)",
+					item, strings.Join(selectorKeys, ", "))
+			}
+			selector[key] = value
+		}
+		if len(selector) > 0 {
+			selectors = append(selectors, selector)
+		}
+	}
+	return selectors, nil
+}
+
+// matches reports whether the partition has every attribute of the selector
+func (s PartitionSelector) matches(partition Partition) bool {
+	for key, value := range s {
+		var ok bool
+		switch key {
+		case "fstype":
+			ok = partition.FSType == value
+		case "label":
+			ok = partition.Label == value
+		case "partlabel":
+			ok = partition.PartLabel == value
+		case "type":
+			ok = strings.EqualFold(partition.Type, value)
+		case "uuid":
+			ok = strings.EqualFold(partition.UUID, value)
+		case "partuuid":
+			ok = strings.EqualFold(partition.PartUUID, value)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// selectsNumber reports whether a partition's number is selected, and if
+// not, why not
+func (s PartitionSelection) selectsNumber(partition Partition) (string, bool) {
+	if len(s.Include) > 0 && !inRanges(s.Include, partition.Number) {
+		return "not in --partitions", false
+	}
+	if inRanges(s.Exclude, partition.Number) {
+		return "excluded by --exclude-partitions", false
+	}
+	return "", true
+}
+
+// matchesOnly reports whether a partition matches one of the Only selectors
+func (s PartitionSelection) matchesOnly(partition Partition) bool {
+	if len(s.Only) == 0 {
+		return true
+	}
+	for _, selector := range s.Only {
+		if selector.matches(partition) {
+			return true
+		}
+	}
+	return false
+}
+
+func inRanges(ranges []PartitionRange, number int) bool {
+	for _, r := range ranges {
+		if r.contains(number) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectPartitions returns the partitions whose numbers are selected.
+// Logical volumes have no partition number; they are found on the selected
+// partitions and then filtered along with them by filterPartitions.
+func (mm *MountManager) selectPartitions(partitions []Partition) []Partition {
+	selected := []Partition{}
+	for _, partition := range partitions {
+		if reason, ok := mm.selection.selectsNumber(partition); !ok {
+			mm.logger.Printf("skipping %s: %s", partition.Device, reason)
+			continue
+		}
+		selected = append(selected, partition)
+	}
+	return selected
+}
+
+// filterPartitions returns the partitions that match the --only selectors
+func (mm *MountManager) filterPartitions(partitions []Partition) []Partition {
+	selected := []Partition{}
+	for _, partition := range partitions {
+		if !mm.selection.matchesOnly(partition) {
+			mm.logger.Printf("skipping %s: does not match --only", partition.Device)
+			continue
+		}
+		selected = append(selected, partition)
+	}
+	return selected
+}
+
+// Partition types that hold something other than a filesystem
+var (
+	extendedTypes = []string{"5", "f", "85"}
+	swapTypes     = []string{"82", "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"}
+	biosBootTypes = []string{"21686148-6449-6E6F-744E-656564454649"}
+	lvmTypes      = []string{"8e", "E6D6D379-F507-44C2-A23C-238F2A3DF928"}
+	raidTypes     = []string{"fd", "A19D880F-05FC-4D3B-A006-743F0F84911E"}
+)
+
+// unmountableReason describes why a partition cannot be mounted, or returns
+// an empty string if it might be
+func unmountableReason(partition Partition) string {
+	switch {
+	case slices.Contains(extendedTypes, partition.Type):
+		return "extended partition"
+	case partition.FSType == "swap" || slices.Contains(swapTypes, partition.Type):
+		return "swap space"
+	case slices.Contains(biosBootTypes, partition.Type):
+		return "BIOS boot partition"
+	case partition.FSType == "LVM2_member" || slices.Contains(lvmTypes, partition.Type):
+		return "LVM physical volume"
+	case partition.FSType == "linux_raid_member" || slices.Contains(raidTypes, partition.Type):
+		return "RAID member"
+	case partition.FSType == "crypto_LUKS":
+		return "LUKS encrypted volume"
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package mountmanager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/larsks/pmount/internal/parttable"
+)
+
+func TestParsePartitionRanges(t *testing.T) {
+	ranges, err := ParsePartitionRanges([]string{"1,3-5", "7"})
+	if err != nil {
+		t.Fatalf("ParsePartitionRanges() error = %v", err)
+	}
+	want := []PartitionRange{{1, 1}, {3, 5}, {7, 7}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ParsePartitionRanges() = %v, want %v", ranges, want)
+	}
+
+	for _, spec := range []string{"0", "one", "5-3", "1-", "-2"} {
+		if _, err := ParsePartitionRanges([]string{spec}); err == nil {
+			t.Errorf("Expected ParsePartitionRanges(%q) to fail", spec)
+		}
+	}
+}
+
+func TestParsePartitionSelectors(t *testing.T) {
+	selectors, err := ParsePartitionSelectors([]string{"fstype=ext4,label=rootfs", "partlabel=EFI"})
+	if err != nil {
+		t.Fatalf("ParsePartitionSelectors() error = %v", err)
+	}
+	want := []PartitionSelector{
+		{"fstype": "ext4", "label": "rootfs"},
+		{"partlabel": "EFI"},
+	}
+	if !reflect.DeepEqual(selectors, want) {
+		t.Errorf("ParsePartitionSelectors() = %v, want %v", selectors, want)
+	}
+
+	for _, spec := range []string{"ext4", "size=1G"} {
+		if _, err := ParsePartitionSelectors([]string{spec}); err == nil {
+			t.Errorf("Expected ParsePartitionSelectors(%q) to fail", spec)
+		}
+	}
+}
+
+func TestPartitionSelection(t *testing.T) {
+	boot := Partition{Number: 1, FSType: "vfat", Label: "bootfs"}
+	root := Partition{Number: 2, FSType: "ext4", Label: "rootfs"}
+	data := Partition{Number: 5, FSType: "ext4", Label: "data", Type: "83"}
+
+	tests := []struct {
+		name      string
+		selection PartitionSelection
+		want      []int
+	}{
+		{"everything", PartitionSelection{}, []int{1, 2, 5}},
+		{"include", PartitionSelection{Include: []PartitionRange{{1, 1}, {3, 5}}}, []int{1, 5}},
+		{"exclude", PartitionSelection{Exclude: []PartitionRange{{2, 2}}}, []int{1, 5}},
+		{"include and exclude", PartitionSelection{Include: []PartitionRange{{1, 5}}, Exclude: []PartitionRange{{1, 1}}}, []int{2, 5}},
+		{"only fstype", PartitionSelection{Only: []PartitionSelector{{"fstype": "ext4"}}}, []int{2, 5}},
+		{"only all attributes", PartitionSelection{Only: []PartitionSelector{{"fstype": "ext4", "label": "data"}}}, []int{5}},
+		{"only any selector", PartitionSelection{Only: []PartitionSelector{{"label": "bootfs"}, {"label": "data"}}}, []int{1, 5}},
+		{"only type", PartitionSelection{Only: []PartitionSelector{{"type": "83"}}}, []int{5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, partition := range []Partition{boot, root, data} {
+				if _, ok := tt.selection.selectsNumber(partition); ok && tt.selection.matchesOnly(partition) {
+					got = append(got, partition.Number)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selected %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmountableReason(t *testing.T) {
+	tests := []struct {
+		partition Partition
+		want      string
+	}{
+		{Partition{Type: "83", FSType: "ext4"}, ""},
+		{Partition{Type: "5"}, "extended partition"},
+		{Partition{Type: "f"}, "extended partition"},
+		{Partition{Type: "82"}, "swap space"},
+		{Partition{Type: "0FC63DAF-8483-4772-8E79-3D69D8477DE4", FSType: "swap"}, "swap space"},
+		{Partition{Type: "21686148-6449-6E6F-744E-656564454649"}, "BIOS boot partition"},
+		{Partition{Type: "8e"}, "LVM physical volume"},
+		{Partition{Type: "83", FSType: "LVM2_member"}, "LVM physical volume"},
+		{Partition{Type: "fd"}, "RAID member"},
+		{Partition{Type: "83", FSType: "linux_raid_member"}, "RAID member"},
+		{Partition{Type: "83", FSType: "crypto_LUKS"}, "LUKS encrypted volume"},
+	}
+	for _, tt := range tests {
+		if got := unmountableReason(tt.partition); got != tt.want {
+			t.Errorf("unmountableReason(%+v) = %q, want %q", tt.partition, got, tt.want)
+		}
+	}
+}
+
+func TestMountWithPartitionSelection(t *testing.T) {
+	targetDir := t.TempDir()
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2", "/dev/sdz3")
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz2", "TYPE=ext4\n", nil).
+		On("blkid -p -o export /dev/sdz3", "TYPE=ext4\n", nil)
+	mm := newTestManager(t, "/dev/sdz", targetDir, "default", runner,
+		WithPartitionSelection(PartitionSelection{
+			Exclude: []PartitionRange{{3, 3}},
+			Only:    []PartitionSelector{{"fstype": "ext4"}},
+		}))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"blkid -p -o export /dev/sdz3",
+		"mount /dev/sdz2 " + filepath.Join(targetDir, "partition2"),
+	})
+}
+
+func TestMountNothingSelected(t *testing.T) {
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", t.TempDir(), "default", runner,
+		WithPartitionSelection(PartitionSelection{Include: []PartitionRange{{2, 4}}}))
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail when no partition is selected")
+	}
+	assertCommands(t, runner, []string{"blkid -p -o export /dev/sdz1"})
+}
+
+func TestDefaultProfileSkipsUnmountable(t *testing.T) {
+	targetDir := t.TempDir()
+	table := &parttable.Table{
+		Label:      "dos",
+		ID:         "0x00000001",
+		SectorSize: 512,
+		Partitions: []parttable.Partition{
+			{Number: 1, Start: 1 << 20, Size: 1 << 20, Type: "83"},
+			{Number: 2, Start: 2 << 20, Size: 8 << 20, Type: "5", Extended: true},
+			{Number: 5, Start: 3 << 20, Size: 1 << 20, Type: "83"},
+			{Number: 6, Start: 5 << 20, Size: 1 << 20, Type: "83"},
+		},
+	}
+	fakeReadPartitionTable(t, "/dev/sdz", table, nil)
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz6", "TYPE=swap\n", nil)
+	mm := newTestManager(t, "/dev/sdz", targetDir, "default", runner)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"blkid -p -o export /dev/sdz5",
+		"blkid -p -o export /dev/sdz6",
+		"mount /dev/sdz1 " + filepath.Join(targetDir, "partition1"),
+		"mount /dev/sdz5 " + filepath.Join(targetDir, "partition5"),
+	})
+	for _, dir := range []string{"partition2", "partition6"} {
+		if _, err := os.Stat(filepath.Join(targetDir, dir)); !os.IsNotExist(err) {
+			t.Errorf("Expected no directory for skipped %s", dir)
+		}
+	}
+}
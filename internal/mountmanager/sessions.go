@@ -0,0 +1,204 @@
+package mountmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// sysBlockDir is where the kernel exposes block device attributes
+	sysBlockDir = "/sys/class/block"
+
+	// procDir is where the kernel exposes process information
+	procDir = "/proc"
+)
+
+// SessionPartition is a partition belonging to a pmount session
+type SessionPartition struct {
+	Device     string `json:"device"`
+	Mountpoint string `json:"mountpoint"`
+	Mounted    bool   `json:"mounted"`
+}
+
+// Session describes an image or device attached or mounted by pmount
+type Session struct {
+	Source     string             `json:"source"`
+	TargetDir  string             `json:"target_dir,omitempty"`
+	Backend    string             `json:"backend,omitempty"`
+	Device     string             `json:"device,omitempty"`
+	Profile    string             `json:"profile,omitempty"`
+	Recorded   bool               `json:"recorded"`
+	Attached   bool               `json:"attached"`
+	Partitions []SessionPartition `json:"partitions"`
+}
+
+// Active reports whether anything belonging to the session is still
+// attached or mounted
+func (s Session) Active() bool {
+	if s.Attached {
+		return true
+	}
+	for _, partition := range s.Partitions {
+		if partition.Mounted {
+			return true
+		}
+	}
+	return false
+}
+
+// ListSessions enumerates pmount sessions. Sessions recorded in stateDir
+// are reconciled with the mount table, and NBD devices that are connected
+// but have no recorded state are reported as well.
+func ListSessions(runner CommandRunner, stateDir string) ([]Session, error) {
+	states, err := LoadStates(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount state: %w", err)
+	}
+
+	mounts, err := listMounts(runner)
+	if err != nil {
+		return nil, err
+	}
+
+	attached := attachedNBDDevices()
+
+	var sessions []Session
+	for _, state := range states {
+		session := Session{
+			Source:    state.Source,
+			TargetDir: state.TargetDir,
+			Backend:   state.Backend,
+			Device:    state.Device,
+			Profile:   state.Profile,
+			Recorded:  true,
+		}
+		switch state.Backend {
+		case "nbd":
+			_, session.Attached = attached[state.Device]
+			delete(attached, state.Device)
+		case "loop":
+			session.Attached = loopAttached(state.Device)
+		}
+		for _, source := range state.AdditionalSources {
+			if source.Backend == "nbd" {
+				delete(attached, source.Device)
+			}
+		}
+		for _, partition := range state.Partitions {
+			if partition.Bind {
+				continue
+			}
+			session.Partitions = append(session.Partitions, SessionPartition{
+				Device:     partition.Device,
+				Mountpoint: partition.Mountpoint,
+				Mounted:    isMounted(mounts, partition.Device, partition.Mountpoint),
+			})
+		}
+		sessions = append(sessions, session)
+	}
+
+	for nbdDevice, source := range attached {
+		session := Session{
+			Source:   source,
+			Backend:  "nbd",
+			Device:   nbdDevice,
+			Attached: true,
+		}
+		for _, mount := range mounts {
+			if strings.HasPrefix(mount.Source, nbdDevice+"p") {
+				session.Partitions = append(session.Partitions, SessionPartition{
+					Device:     mount.Source,
+					Mountpoint: mount.Target,
+					Mounted:    true,
+				})
+			}
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].TargetDir != sessions[j].TargetDir {
+			return sessions[i].TargetDir < sessions[j].TargetDir
+		}
+		return sessions[i].Device < sessions[j].Device
+	})
+
+	return sessions, nil
+}
+
+// listMounts returns every entry in the mount table
+func listMounts(runner CommandRunner) ([]FindmntFilesystem, error) {
+	output, err := runner.Output("findmnt", "-J", "-l", "-o", "TARGET,SOURCE")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+
+	var findmntData FindmntOutput
+	if err := json.Unmarshal(output, &findmntData); err != nil {
+		return nil, fmt.Errorf("failed to parse findmnt output: %w", err)
+	}
+	return findmntData.Filesystems, nil
+}
+
+func isMounted(mounts []FindmntFilesystem, device, mountpoint string) bool {
+	for _, mount := range mounts {
+		if mount.Source == device && mount.Target == mountpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// attachedNBDDevices returns connected NBD devices mapped to the image
+// served by the owning qemu-nbd process (or an empty string if that
+// cannot be determined)
+func attachedNBDDevices() map[string]string {
+	devices := make(map[string]string)
+
+	pidFiles, _ := filepath.Glob(filepath.Join(sysBlockDir, "nbd*", "pid"))
+	for _, pidFile := range pidFiles {
+		device := "/dev/" + filepath.Base(filepath.Dir(pidFile))
+		devices[device] = ""
+
+		pid, err := os.ReadFile(pidFile)
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join(procDir, strings.TrimSpace(string(pid)), "cmdline"))
+		if err != nil {
+			continue
+		}
+		devices[device] = nbdSourceFromCmdline(cmdline)
+	}
+
+	return devices
+}
+
+// nbdAttached reports whether an NBD device is connected
+func nbdAttached(device string) bool {
+	_, err := os.Stat(filepath.Join(sysBlockDir, filepath.Base(device), "pid"))
+	return err == nil
+}
+
+// loopAttached reports whether a loop device has a backing file
+func loopAttached(device string) bool {
+	_, err := os.Stat(filepath.Join(sysBlockDir, filepath.Base(device), "loop", "backing_file"))
+	return err == nil
+}
+
+// nbdSourceFromCmdline extracts the image path from a qemu-nbd command line
+// as found in /proc/<pid>/cmdline
+func nbdSourceFromCmdline(cmdline []byte) string {
+	args := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+	for i := len(args) - 1; i > 0; i-- {
+		if !strings.HasPrefix(args[i], "-") {
+			return args[i]
+		}
+	}
+	return ""
+}
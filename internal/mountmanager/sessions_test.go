@@ -0,0 +1,155 @@
+package mountmanager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeNBD simulates an NBD device connected by a qemu-nbd process
+func fakeNBD(t *testing.T, name, pid string, cmdline ...string) {
+	t.Helper()
+	devDir := filepath.Join(sysBlockDir, name)
+	if err := os.MkdirAll(devDir, 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", devDir, err)
+	}
+	if err := os.WriteFile(filepath.Join(devDir, "pid"), []byte(pid+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write pid file: %v", err)
+	}
+
+	pidDir := filepath.Join(procDir, pid)
+	if err := os.MkdirAll(pidDir, 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", pidDir, err)
+	}
+	var data []byte
+	for _, arg := range cmdline {
+		data = append(data, arg...)
+		data = append(data, 0)
+	}
+	if err := os.WriteFile(filepath.Join(pidDir, "cmdline"), data, 0644); err != nil {
+		t.Fatalf("Failed to write cmdline: %v", err)
+	}
+}
+
+func fakeSysfs(t *testing.T) {
+	t.Helper()
+	oldSys, oldProc := sysBlockDir, procDir
+	sysBlockDir = t.TempDir()
+	procDir = t.TempDir()
+	t.Cleanup(func() {
+		sysBlockDir, procDir = oldSys, oldProc
+	})
+}
+
+func mountTableJSON(mounts ...FindmntFilesystem) string {
+	data, _ := json.Marshal(FindmntOutput{Filesystems: mounts})
+	return string(data)
+}
+
+func TestListSessions(t *testing.T) {
+	fakeSysfs(t)
+	fakeNBD(t, "nbd4", "100", "qemu-nbd", "--connect=/dev/nbd4", "--format=raw", "/images/disk.img")
+	fakeNBD(t, "nbd7", "200", "qemu-nbd", "-c", "/dev/nbd7", "/images/other.qcow2")
+
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+
+	runner := NewFakeRunner().
+		On("findmnt -J -l -o TARGET,SOURCE", mountTableJSON(
+			FindmntFilesystem{Target: "/", Source: "/dev/sda2"},
+			FindmntFilesystem{Target: filepath.Join(targetDir, "partition1"), Source: "/dev/nbd4p1"},
+			FindmntFilesystem{Target: "/srv/other", Source: "/dev/nbd7p1"},
+		), nil)
+
+	sessions, err := ListSessions(runner, stateDir)
+	if err != nil {
+		t.Fatalf("ListSessions() error = %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d: %+v", len(sessions), sessions)
+	}
+
+	// Unrecorded sessions have no target directory and sort first
+	other := sessions[0]
+	if other.Recorded || !other.Attached || other.Device != "/dev/nbd7" || other.Source != "/images/other.qcow2" {
+		t.Errorf("Unexpected unrecorded session: %+v", other)
+	}
+	if len(other.Partitions) != 1 || other.Partitions[0].Mountpoint != "/srv/other" {
+		t.Errorf("Unexpected partitions for unrecorded session: %+v", other.Partitions)
+	}
+
+	recorded := sessions[1]
+	if !recorded.Recorded || !recorded.Attached || recorded.Profile != "default" || recorded.TargetDir != targetDir {
+		t.Errorf("Unexpected recorded session: %+v", recorded)
+	}
+	if len(recorded.Partitions) != 2 {
+		t.Fatalf("Expected 2 partitions, got %d", len(recorded.Partitions))
+	}
+	if !recorded.Partitions[0].Mounted || recorded.Partitions[1].Mounted {
+		t.Errorf("Expected only partition1 to be mounted: %+v", recorded.Partitions)
+	}
+	if !recorded.Active() {
+		t.Error("Expected recorded session to be active")
+	}
+}
+
+func TestListSessionsStale(t *testing.T) {
+	fakeSysfs(t)
+
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+
+	runner := NewFakeRunner().
+		On("findmnt -J -l -o TARGET,SOURCE", mountTableJSON(), nil)
+
+	sessions, err := ListSessions(runner, stateDir)
+	if err != nil {
+		t.Fatalf("ListSessions() error = %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Active() {
+		t.Errorf("Expected a single inactive session, got %+v", sessions)
+	}
+}
+
+func TestNBDSourceFromCmdline(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    string
+	}{
+		{"qemu-nbd\x00--connect=/dev/nbd0\x00disk.img\x00", "disk.img"},
+		{"qemu-nbd\x00-c\x00/dev/nbd0\x00-f\x00qcow2\x00/images/vm.qcow2\x00", "/images/vm.qcow2"},
+		{"qemu-nbd\x00", ""},
+	}
+
+	for _, tt := range tests {
+		if got := nbdSourceFromCmdline([]byte(tt.cmdline)); got != tt.want {
+			t.Errorf("nbdSourceFromCmdline(%q) = %q, want %q", tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+func TestListSessionsAdditionalSources(t *testing.T) {
+	fakeSysfs(t)
+	fakeNBD(t, "nbd4", "100", "qemu-nbd", "--connect=/dev/nbd4", "--format=raw", "/images/disk.img")
+	fakeNBD(t, "nbd7", "200", "qemu-nbd", "-c", "/dev/nbd7", "/images/mirror.qcow2")
+
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	mm, stateDir := mountWithState(t, targetDir)
+	mm.recordSource(AttachedSource{Source: "/images/mirror.qcow2", Backend: "nbd", Device: "/dev/nbd7"})
+	if err := mm.saveState(); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+
+	runner := NewFakeRunner().
+		On("findmnt -J -l -o TARGET,SOURCE", mountTableJSON(), nil)
+	sessions, err := ListSessions(runner, stateDir)
+	if err != nil {
+		t.Fatalf("ListSessions() error = %v", err)
+	}
+
+	// The additional source belongs to the recorded session
+	if len(sessions) != 1 || !sessions[0].Recorded {
+		t.Errorf("Expected a single recorded session, got %+v", sessions)
+	}
+}
@@ -0,0 +1,547 @@
+package mountmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultStateDir is where mount session state files are recorded
+const DefaultStateDir = "/run/pmount"
+
+// MountedPartition records a partition mounted during a mount session
+type MountedPartition struct {
+	Device     string    `json:"device"`
+	Number     int       `json:"number"`
+	Mountpoint string    `json:"mountpoint"`
+	MountedAt  time.Time `json:"mounted_at"`
+
+	// Bind is set for a directory or file bind-mounted from the host (such
+	// as /dev for a chroot), where Device is the path that was bound
+	Bind bool `json:"bind,omitempty"`
+
+	// Created is set when pmount created the file a bind was mounted on,
+	// so that it is removed again once unmounted
+	Created bool `json:"created,omitempty"`
+
+	// Upper is set for an overlay (whose Device is "overlay"), to the
+	// directory holding the changes made through it
+	Upper string `json:"upper,omitempty"`
+}
+
+// MountState describes a mount session. It is written when Mount succeeds
+// and consulted by Unmount to undo exactly what was done.
+type MountState struct {
+	Source    string `json:"source"`
+	TargetDir string `json:"target_dir"`
+
+	// Backend is the name of the backend that attached Device
+	Backend string `json:"backend,omitempty"`
+	Device  string `json:"device,omitempty"`
+
+	// AdditionalSources are the other sources attached alongside Source
+	AdditionalSources []AttachedSource `json:"additional_sources,omitempty"`
+
+	// NBDDevice is only written by older versions, which always used NBD
+	NBDDevice string `json:"nbd_device,omitempty"`
+
+	Profile  string `json:"profile"`
+	Format   string `json:"format,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+
+	// Partitions are listed in the order in which they were mounted
+	Partitions []MountedPartition `json:"partitions"`
+
+	// Directories created by pmount, listed in the order in which they were created
+	Directories []string `json:"directories,omitempty"`
+
+	// Block devices pmount marked read-only, to be made writable again on unmount
+	ReadOnlyDevices []string `json:"read_only_devices,omitempty"`
+
+	// LVM volume groups activated from the source, to be deactivated on unmount
+	VolumeGroups []*ActiveVolumeGroup `json:"volume_groups,omitempty"`
+
+	// LUKS volumes unlocked from the source, to be closed on unmount
+	LUKSVolumes []OpenedLUKS `json:"luks_volumes,omitempty"`
+
+	// RAID arrays assembled from the sources, to be stopped on unmount
+	RAIDArrays []*AssembledArray `json:"raid_arrays,omitempty"`
+
+	// OverlayDir holds the read-only mounts beneath the session's overlays,
+	// to be removed on unmount
+	OverlayDir string `json:"overlay_dir,omitempty"`
+
+	MountedAt time.Time `json:"mounted_at"`
+}
+
+// stateFileName returns the name of the state file for a target directory
+func stateFileName(targetDir string) string {
+	return url.PathEscape(targetDir) + ".json"
+}
+
+// LoadStates returns all mount sessions recorded in stateDir
+func LoadStates(stateDir string) ([]*MountState, error) {
+	matches, err := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*MountState
+	for _, path := range matches {
+		state, err := readState(path)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func readState(path string) (*MountState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state MountState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if state.Backend == "" && state.NBDDevice != "" {
+		state.Backend = "nbd"
+		state.Device = state.NBDDevice
+		state.NBDDevice = ""
+	}
+	return &state, nil
+}
+
+// absTargetDir returns the absolute path of the target directory
+func (mm *MountManager) absTargetDir() string {
+	if abs, err := filepath.Abs(mm.targetDir); err == nil {
+		return abs
+	}
+	return mm.targetDir
+}
+
+func (mm *MountManager) statePath(targetDir string) string {
+	return filepath.Join(mm.stateDir, stateFileName(targetDir))
+}
+
+// beginState starts recording a new mount session
+func (mm *MountManager) beginState() {
+	mm.state = &MountState{
+		Source:    mm.sourceDevice,
+		TargetDir: mm.absTargetDir(),
+		Profile:   mm.profile.Name(),
+		Format:    mm.format,
+		ReadOnly:  mm.readOnly,
+	}
+	if abs, err := filepath.Abs(mm.sourceDevice); err == nil {
+		mm.state.Source = abs
+	}
+}
+
+// recordDirectory notes that a directory was created during the current session
+func (mm *MountManager) recordDirectory(dir string) {
+	if mm.state == nil {
+		return
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	mm.state.Directories = append(mm.state.Directories, dir)
+}
+
+// recordMount notes that a partition was mounted during the current session
+func (mm *MountManager) recordMount(partition Partition, dir string) {
+	if mm.state == nil {
+		return
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	mm.state.Partitions = append(mm.state.Partitions, MountedPartition{
+		Device:     partition.Device,
+		Number:     partition.Number,
+		Mountpoint: dir,
+		MountedAt:  time.Now(),
+	})
+}
+
+// recordBind notes that a host path was bind-mounted during the current
+// session, onto a file pmount created if created is set
+func (mm *MountManager) recordBind(source, dir string, created bool) {
+	if mm.state == nil {
+		return
+	}
+	mm.state.Partitions = append(mm.state.Partitions, MountedPartition{
+		Device:     source,
+		Mountpoint: dir,
+		MountedAt:  time.Now(),
+		Bind:       true,
+		Created:    created,
+	})
+}
+
+// recordFilesystem notes that a filesystem without a device of its own (an
+// overlay or a tmpfs) was mounted during the current session
+func (mm *MountManager) recordFilesystem(source, dir, upper string) {
+	if mm.state == nil {
+		return
+	}
+	mm.state.Partitions = append(mm.state.Partitions, MountedPartition{
+		Device:     source,
+		Mountpoint: dir,
+		MountedAt:  time.Now(),
+		Upper:      upper,
+	})
+}
+
+// recordReadOnly notes that a block device was marked read-only during the current session
+func (mm *MountManager) recordReadOnly(device string) {
+	if mm.state == nil {
+		return
+	}
+	mm.state.ReadOnlyDevices = append(mm.state.ReadOnlyDevices, device)
+}
+
+// recordVolumeGroup notes that a volume group was activated during the current session
+func (mm *MountManager) recordVolumeGroup(vg *ActiveVolumeGroup) {
+	if mm.state == nil {
+		return
+	}
+	mm.state.VolumeGroups = append(mm.state.VolumeGroups, vg)
+}
+
+// recordSource notes that an additional source was attached during the current session
+func (mm *MountManager) recordSource(source AttachedSource) {
+	if mm.state == nil {
+		return
+	}
+	mm.state.AdditionalSources = append(mm.state.AdditionalSources, source)
+}
+
+// recordArray notes that a RAID array was assembled during the current session
+func (mm *MountManager) recordArray(array *AssembledArray) {
+	if mm.state == nil {
+		return
+	}
+	mm.state.RAIDArrays = append(mm.state.RAIDArrays, array)
+}
+
+// recordLUKS notes that a LUKS volume was unlocked during the current session
+func (mm *MountManager) recordLUKS(volume OpenedLUKS) {
+	if mm.state == nil {
+		return
+	}
+	mm.state.LUKSVolumes = append(mm.state.LUKSVolumes, volume)
+}
+
+// saveState writes the current session to the state directory
+func (mm *MountManager) saveState() error {
+	if mm.state == nil || mm.dryRun {
+		return nil
+	}
+	mm.state.Device = mm.device
+	mm.state.MountedAt = time.Now()
+
+	data, err := json.MarshalIndent(mm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mm.stateDir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %w", mm.stateDir, err)
+	}
+
+	path := mm.statePath(mm.state.TargetDir)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", path, err)
+	}
+	mm.logger.Printf("recorded mount state in %s", path)
+	return nil
+}
+
+// stateActive reports whether anything recorded in a session is still
+// attached or mounted
+func (mm *MountManager) stateActive(state *MountState) bool {
+	sources := append([]AttachedSource{{Backend: state.Backend, Device: state.Device}}, state.AdditionalSources...)
+	for _, source := range sources {
+		switch source.Backend {
+		case "nbd":
+			if nbdAttached(source.Device) {
+				return true
+			}
+		case "loop":
+			if loopAttached(source.Device) {
+				return true
+			}
+		}
+	}
+	for _, partition := range state.Partitions {
+		if device, _ := mm.findMountedDevice(partition.Mountpoint); device != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTargetFree fails if a session recorded for the target directory is
+// still live: mounting again would overwrite its state, leaving its devices
+// and mounts for --unmount never to release. The state of a session that
+// is no longer live is discarded.
+func (mm *MountManager) checkTargetFree() error {
+	state, err := readState(mm.statePath(mm.absTargetDir()))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if mm.stateActive(state) {
+		return fmt.Errorf("%s is already mounted from %s; run --unmount first", state.TargetDir, state.Source)
+	}
+	mm.logger.Printf("discarding stale mount state for %s", state.TargetDir)
+	return nil
+}
+
+// removeState deletes the state file for a finished session
+func (mm *MountManager) removeState(state *MountState) {
+	if mm.dryRun {
+		return
+	}
+	path := mm.statePath(state.TargetDir)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		mm.logger.Printf("warning: failed to remove state file %s: %v", path, err)
+	}
+}
+
+// findState locates the recorded session for the target directory. If the
+// target directory was renamed after mounting, the session is located by
+// looking for its partitions in the mount table beneath the target directory.
+func (mm *MountManager) findState() (*MountState, error) {
+	targetDir := mm.absTargetDir()
+
+	state, err := readState(mm.statePath(targetDir))
+	if err == nil {
+		return state, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	states, err := LoadStates(mm.stateDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		for _, partition := range state.Partitions {
+			if partition.Bind {
+				continue
+			}
+			mountpoints, err := mm.findMountpoints(partition.Device)
+			if err != nil {
+				continue
+			}
+			if slices.ContainsFunc(mountpoints, func(mp string) bool { return isWithin(mp, targetDir) }) {
+				mm.logger.Printf("found state for %s recorded under %s", targetDir, state.TargetDir)
+				return state, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// isWithin reports whether path is dir or is located beneath dir
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// rebase moves path from beneath oldDir to beneath newDir
+func rebase(path, oldDir, newDir string) string {
+	if oldDir == newDir || !isWithin(path, oldDir) {
+		return path
+	}
+	rel, _ := filepath.Rel(oldDir, path)
+	return filepath.Join(newDir, rel)
+}
+
+// unmountMoved looks for the partitions that were not found where they were
+// mounted (as when a partition's directory is renamed), so that their
+// devices are never detached from under a live filesystem. Partitions found
+// beneath the target directory (or the overlay root) are unmounted there,
+// and the mountpoints that could not be unmounted are returned. A partition
+// mounted anywhere else is an error.
+func (mm *MountManager) unmountMoved(moved []MountedPartition, targetDir, overlayDir string) ([]string, error) {
+	var failed, outside []string
+	for _, partition := range moved {
+		// Overlays and tmpfs have no device of their own
+		if partition.Bind || !strings.HasPrefix(partition.Device, "/dev/") {
+			continue
+		}
+		mountpoints, err := mm.findMountpoints(partition.Device)
+		if err != nil {
+			return nil, fmt.Errorf("cannot tell whether %s is still mounted: %w", partition.Device, err)
+		}
+		for _, mountpoint := range mountpoints {
+			if !isWithin(mountpoint, targetDir) && (overlayDir == "" || !isWithin(mountpoint, overlayDir)) {
+				outside = append(outside, fmt.Sprintf("%s on %s", partition.Device, mountpoint))
+				continue
+			}
+			if err := mm.unmountDir(mountpoint); err != nil {
+				mm.logger.Printf("failed to unmount %s: %v", mountpoint, err)
+				failed = append(failed, mountpoint)
+				continue
+			}
+			mm.logger.Printf("unmounted %s from %s", partition.Device, mountpoint)
+		}
+	}
+	if len(outside) > 0 {
+		return nil, fmt.Errorf("not detaching: %s mounted outside %s; unmount it first", strings.Join(outside, ", "), targetDir)
+	}
+	return failed, nil
+}
+
+// unmountState undoes a recorded mount session: partitions are unmounted in
+// reverse order, directories pmount created are removed, LUKS volumes are
+// closed, volume groups deactivated and RAID arrays stopped, and the
+// backends that attached the devices detach them.
+func (mm *MountManager) unmountState(state *MountState) error {
+	targetDir := mm.absTargetDir()
+	if state.Profile != mm.profile.Name() {
+		mm.logger.Printf("using profile %s recorded at mount time", state.Profile)
+	}
+
+	// Changes are exported before the overlays holding them go away
+	if mm.exportTo != "" {
+		if err := mm.exportChanges(state, mm.exportTo); err != nil {
+			return err
+		}
+	}
+
+	var failed []string
+	var moved []MountedPartition
+	for i := len(state.Partitions) - 1; i >= 0; i-- {
+		partition := state.Partitions[i]
+		mountpoint := rebase(partition.Mountpoint, state.TargetDir, targetDir)
+
+		device, err := mm.findMountedDevice(mountpoint)
+		if err != nil {
+			mm.logger.Printf("warning: %v", err)
+		}
+		if device == "" {
+			mm.logger.Printf("%s is not mounted, skipping", mountpoint)
+			moved = append(moved, partition)
+			continue
+		}
+		if device != partition.Device && !partition.Bind {
+			mm.logger.Printf("warning: %s is mounted from %s, not %s; skipping", mountpoint, device, partition.Device)
+			moved = append(moved, partition)
+			continue
+		}
+
+		unmount := mm.unmountDir
+		if partition.Bind {
+			unmount = mm.unmountTree
+		}
+		if err := unmount(mountpoint); err != nil {
+			mm.logger.Printf("failed to unmount %s: %v", mountpoint, err)
+			failed = append(failed, mountpoint)
+			continue
+		}
+		mm.logger.Printf("unmounted %s", mountpoint)
+		if partition.Upper != "" && isWithin(partition.Upper, state.OverlayDir) {
+			mm.logger.Printf("discarded changes made to %s", mountpoint)
+		} else if partition.Upper != "" {
+			mm.logger.Printf("changes made to %s are kept in %s", mountpoint, partition.Upper)
+		}
+		if partition.Created {
+			if err := mm.removeFile(mountpoint); err != nil {
+				mm.logger.Printf("failed to remove %s: %v", mountpoint, err)
+			}
+		}
+	}
+
+	busy, err := mm.unmountMoved(moved, targetDir, state.OverlayDir)
+	if err != nil {
+		return err
+	}
+	failed = append(failed, busy...)
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to unmount %s", strings.Join(failed, ", "))
+	}
+
+	for i := len(state.Directories) - 1; i >= 0; i-- {
+		dir := rebase(state.Directories[i], state.TargetDir, targetDir)
+		// The target directory itself is left in place
+		if dir == targetDir || !isWithin(dir, targetDir) {
+			continue
+		}
+		if err := mm.removeDir(dir); err != nil {
+			mm.logger.Printf("failed to remove directory %s: %v", dir, err)
+		}
+	}
+
+	if state.OverlayDir != "" {
+		mm.removeOverlayRoot(state.OverlayDir)
+	}
+
+	// LUKS volumes inside logical volumes are closed before the volume
+	// groups are deactivated, and the others (which may hold physical
+	// volumes) after
+	if err := mm.closeLUKSVolumes(state.LUKSVolumes, true); err != nil {
+		return err
+	}
+	for i := len(state.VolumeGroups) - 1; i >= 0; i-- {
+		if err := mm.deactivateVolumeGroup(state.VolumeGroups[i]); err != nil {
+			return err
+		}
+	}
+	if err := mm.closeLUKSVolumes(state.LUKSVolumes, false); err != nil {
+		return err
+	}
+	for i := len(state.RAIDArrays) - 1; i >= 0; i-- {
+		if err := mm.stopArray(state.RAIDArrays[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := len(state.ReadOnlyDevices) - 1; i >= 0; i-- {
+		if err := mm.setReadWrite(state.ReadOnlyDevices[i]); err != nil {
+			mm.logger.Printf("warning: %v", err)
+		}
+	}
+
+	for i := len(state.AdditionalSources) - 1; i >= 0; i-- {
+		source := state.AdditionalSources[i]
+		backend := mm.findBackend(source.Backend)
+		if backend == nil {
+			return fmt.Errorf("unknown backend %q recorded for %s", source.Backend, source.Device)
+		}
+		if err := backend.Detach(mm, source.Device); err != nil {
+			return err
+		}
+	}
+
+	if state.Device != "" {
+		backend := mm.findBackend(state.Backend)
+		if backend == nil {
+			return fmt.Errorf("unknown backend %q recorded for %s", state.Backend, state.Device)
+		}
+		mm.backend = backend
+		mm.device = state.Device
+		if err := mm.detach(); err != nil {
+			return err
+		}
+	}
+
+	mm.removeState(state)
+	return nil
+}
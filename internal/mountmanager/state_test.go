@@ -0,0 +1,327 @@
+package mountmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mountWithState mounts a two-partition image using the default profile and
+// returns the manager and the recorded state directory
+func mountWithState(t *testing.T, targetDir string) (*MountManager, string) {
+	t.Helper()
+	stateDir := t.TempDir()
+	image := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	fakePartitionTable(t, "/dev/nbd4", "/dev/nbd4p1", "/dev/nbd4p2")
+	runner := NewFakeRunner()
+	mm, err := NewMountManager(image, targetDir, "raw", "/dev/nbd4", "default",
+		WithRunner(runner), WithStateDir(stateDir), WithLogger(discardLogger()))
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	return mm, stateDir
+}
+
+func TestMountRecordsState(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	mm, stateDir := mountWithState(t, targetDir)
+
+	states, err := LoadStates(stateDir)
+	if err != nil {
+		t.Fatalf("LoadStates() error = %v", err)
+	}
+	if len(states) != 1 {
+		t.Fatalf("Expected 1 recorded state, got %d", len(states))
+	}
+
+	state := states[0]
+	if state.Source != mm.sourceDevice {
+		t.Errorf("Expected source %s, got %s", mm.sourceDevice, state.Source)
+	}
+	if state.TargetDir != targetDir {
+		t.Errorf("Expected target %s, got %s", targetDir, state.TargetDir)
+	}
+	if state.Backend != "nbd" || state.Device != "/dev/nbd4" {
+		t.Errorf("Expected NBD device /dev/nbd4, got %s device %s", state.Backend, state.Device)
+	}
+	if state.Profile != "default" || state.Format != "raw" {
+		t.Errorf("Expected profile default and format raw, got %s and %s", state.Profile, state.Format)
+	}
+	if len(state.Partitions) != 2 {
+		t.Fatalf("Expected 2 recorded partitions, got %d", len(state.Partitions))
+	}
+	if state.Partitions[1].Device != "/dev/nbd4p2" || state.Partitions[1].Mountpoint != filepath.Join(targetDir, "partition2") {
+		t.Errorf("Unexpected partition record: %+v", state.Partitions[1])
+	}
+	if state.MountedAt.IsZero() || state.Partitions[0].MountedAt.IsZero() {
+		t.Error("Expected timestamps to be recorded")
+	}
+
+	wantDirs := []string{
+		targetDir,
+		filepath.Join(targetDir, "partition1"),
+		filepath.Join(targetDir, "partition2"),
+	}
+	if len(state.Directories) != len(wantDirs) {
+		t.Fatalf("Expected directories %v, got %v", wantDirs, state.Directories)
+	}
+	for i, dir := range wantDirs {
+		if state.Directories[i] != dir {
+			t.Errorf("Expected directory %s, got %s", dir, state.Directories[i])
+		}
+	}
+}
+
+func TestUnmountUsesStateRegardlessOfProfile(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+	part1 := filepath.Join(targetDir, "partition1")
+	part2 := filepath.Join(targetDir, "partition2")
+
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+part1, findmntJSON(part1, "/dev/nbd4p1"), nil).
+		On("findmnt -J -M "+part2, findmntJSON(part2, "/dev/nbd4p2"), nil)
+	// The wrong profile is given on purpose
+	mm := newTestManager(t, "", targetDir, "single", runner, WithStateDir(stateDir))
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + part2,
+		"umount " + part2,
+		"findmnt -J -M " + part1,
+		"umount " + part1,
+		"qemu-nbd --disconnect /dev/nbd4",
+	})
+	for _, dir := range []string{part1, part2} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Expected directory %s to be removed", dir)
+		}
+	}
+	if _, err := os.Stat(targetDir); err != nil {
+		t.Error("Target directory should not be removed")
+	}
+	if states, _ := LoadStates(stateDir); len(states) != 0 {
+		t.Errorf("Expected state to be removed, found %d", len(states))
+	}
+}
+
+func TestMountRefusesLiveTarget(t *testing.T) {
+	fakeSysfs(t)
+	fakeNBD(t, "nbd4", "100", "qemu-nbd", "--connect=/dev/nbd4", "--format=raw", "/images/disk.img")
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+
+	fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, writeImage(t, []byte("QFI\xfb")), targetDir, "default", runner, WithStateDir(stateDir))
+	mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd5"
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail onto a target that is already mounted")
+	}
+	if commands := runner.Commands(); len(commands) > 0 {
+		t.Errorf("Expected nothing to be attached, got %q", commands)
+	}
+	states, err := LoadStates(stateDir)
+	if err != nil || len(states) != 1 || states[0].Device != "/dev/nbd4" {
+		t.Errorf("Expected the first session's state to be kept, got %+v (%v)", states, err)
+	}
+}
+
+func TestMountReplacesStaleState(t *testing.T) {
+	fakeSysfs(t)
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+
+	// Nothing from the first session is attached or mounted any more
+	fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1")
+	mm := newTestManager(t, writeImage(t, []byte("QFI\xfb")), targetDir, "default", NewFakeRunner(), WithStateDir(stateDir))
+	mm.findBackend("nbd").(*NBDBackend).Device = "/dev/nbd5"
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	states, err := LoadStates(stateDir)
+	if err != nil || len(states) != 1 || states[0].Device != "/dev/nbd5" {
+		t.Errorf("Expected the new session's state, got %+v (%v)", states, err)
+	}
+}
+
+func TestUnmountRenamedTarget(t *testing.T) {
+	baseDir := t.TempDir()
+	targetDir := filepath.Join(baseDir, "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+
+	renamedDir := filepath.Join(baseDir, "renamed")
+	if err := os.Rename(targetDir, renamedDir); err != nil {
+		t.Fatalf("Failed to rename target: %v", err)
+	}
+	part1 := filepath.Join(renamedDir, "partition1")
+	part2 := filepath.Join(renamedDir, "partition2")
+
+	runner := NewFakeRunner().
+		On("findmnt -J -S /dev/nbd4p1", findmntJSON(part1, "/dev/nbd4p1"), nil).
+		On("findmnt -J -M "+part1, findmntJSON(part1, "/dev/nbd4p1"), nil).
+		On("findmnt -J -M "+part2, findmntJSON(part2, "/dev/nbd4p2"), nil)
+	mm := newTestManager(t, "", renamedDir, "default", runner, WithStateDir(stateDir))
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"findmnt -J -S /dev/nbd4p1",
+		"findmnt -J -M " + part2,
+		"umount " + part2,
+		"findmnt -J -M " + part1,
+		"umount " + part1,
+		"qemu-nbd --disconnect /dev/nbd4",
+	})
+	if _, err := os.Stat(part1); !os.IsNotExist(err) {
+		t.Error("Expected renamed partition directory to be removed")
+	}
+}
+
+func TestUnmountStateFailureKeepsState(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+	part1 := filepath.Join(targetDir, "partition1")
+	part2 := filepath.Join(targetDir, "partition2")
+
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+part1, findmntJSON(part1, "/dev/nbd4p1"), nil).
+		On("findmnt -J -M "+part2, findmntJSON(part2, "/dev/nbd4p2"), nil).
+		On("umount "+part2, "target is busy", errors.New("exit status 32"))
+	mm := newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+
+	if err := mm.Unmount(); err == nil {
+		t.Fatal("Expected Unmount() to fail")
+	}
+
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + part2,
+		"umount " + part2,
+		"findmnt -J -M " + part1,
+		"umount " + part1,
+	})
+	if states, _ := LoadStates(stateDir); len(states) != 1 {
+		t.Error("Expected state to be kept after a failed unmount")
+	}
+}
+
+func TestUnmountStateSkipsUnmountedPartitions(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+	part2 := filepath.Join(targetDir, "partition2")
+
+	// partition1 was unmounted by hand
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+part2, findmntJSON(part2, "/dev/nbd4p2"), nil)
+	mm := newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + part2,
+		"umount " + part2,
+		"findmnt -J -M " + filepath.Join(targetDir, "partition1"),
+		"findmnt -J -S /dev/nbd4p1",
+		"qemu-nbd --disconnect /dev/nbd4",
+	})
+}
+
+func TestUnmountStateFollowsMovedPartition(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+	part1 := filepath.Join(targetDir, "partition1")
+	part2 := filepath.Join(targetDir, "partition2")
+
+	// partition1's mount moves with its directory
+	moved := filepath.Join(targetDir, "renamed")
+	if err := os.Rename(part1, moved); err != nil {
+		t.Fatalf("Failed to rename %s: %v", part1, err)
+	}
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+part2, findmntJSON(part2, "/dev/nbd4p2"), nil).
+		On("findmnt -J -S /dev/nbd4p1", findmntJSON(moved, "/dev/nbd4p1"), nil)
+	mm := newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + part2,
+		"umount " + part2,
+		"findmnt -J -M " + part1,
+		"findmnt -J -S /dev/nbd4p1",
+		"umount " + moved,
+		"qemu-nbd --disconnect /dev/nbd4",
+	})
+}
+
+func TestUnmountStateRefusesToDetachMountedDevice(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	_, stateDir := mountWithState(t, targetDir)
+	part2 := filepath.Join(targetDir, "partition2")
+
+	// partition1 was moved out of the target directory
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+part2, findmntJSON(part2, "/dev/nbd4p2"), nil).
+		On("findmnt -J -S /dev/nbd4p1", findmntJSON("/srv/data", "/dev/nbd4p1"), nil)
+	mm := newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+
+	if err := mm.Unmount(); err == nil {
+		t.Fatal("Expected Unmount() to fail while a partition is mounted outside the target")
+	}
+	if commands := runner.Commands(); containsCommand(commands, "qemu-nbd --disconnect /dev/nbd4") {
+		t.Errorf("Expected the device to stay attached, got %q", commands)
+	}
+	if states, _ := LoadStates(stateDir); len(states) != 1 {
+		t.Error("Expected state to be kept after a failed unmount")
+	}
+}
+
+func TestUnmountLegacyState(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+	part1 := filepath.Join(targetDir, "partition1")
+
+	// State files written before backends were recorded only name the NBD device
+	legacy := `{"source": "/images/disk.img", "target_dir": "` + targetDir + `", "nbd_device": "/dev/nbd2",
+		"profile": "default", "partitions": [{"device": "/dev/nbd2p1", "number": 1, "mountpoint": "` + part1 + `"}]}`
+	if err := os.WriteFile(filepath.Join(stateDir, stateFileName(targetDir)), []byte(legacy), 0644); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+
+	runner := NewFakeRunner().
+		On("findmnt -J -M "+part1, findmntJSON(part1, "/dev/nbd2p1"), nil)
+	mm := newTestManager(t, "", targetDir, "default", runner, WithStateDir(stateDir))
+
+	if err := mm.Unmount(); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"findmnt -J -M " + part1,
+		"umount " + part1,
+		"qemu-nbd --disconnect /dev/nbd2",
+	})
+}
+
+func TestStateFileName(t *testing.T) {
+	if got := stateFileName("/mnt/a-b"); got == stateFileName("/mnt/a/b") {
+		t.Errorf("State file names collide: %s", got)
+	}
+}
@@ -0,0 +1,46 @@
+package mountmanager
+
+// undoAction reverses a single step taken while mounting
+type undoAction struct {
+	description string
+	undo        func() error
+}
+
+// pushUndo records how to reverse a step that has just succeeded
+func (mm *MountManager) pushUndo(description string, undo func() error) {
+	mm.undoStack = append(mm.undoStack, undoAction{
+		description: description,
+		undo:        undo,
+	})
+}
+
+// rollback reverses every recorded step in reverse order. Failures are
+// logged and do not stop the remaining steps from being undone.
+func (mm *MountManager) rollback() {
+	for i := len(mm.undoStack) - 1; i >= 0; i-- {
+		action := mm.undoStack[i]
+		if err := action.undo(); err != nil {
+			mm.logger.Printf("warning: rollback failed to %s: %v", action.description, err)
+			continue
+		}
+		mm.logger.Printf("rolled back: %s", action.description)
+	}
+	mm.undoStack = nil
+	mm.state = nil
+}
+
+// abortMount handles a failed mount. Normally everything done so far is
+// rolled back; with keep-going, whatever was mounted is left in place and
+// recorded so that it can be unmounted later.
+func (mm *MountManager) abortMount() {
+	if mm.keepGoing {
+		if err := mm.saveState(); err != nil {
+			mm.logger.Printf("warning: %v", err)
+		}
+		mm.undoStack = nil
+		return
+	}
+
+	mm.logger.Printf("mount failed, rolling back")
+	mm.rollback()
+}
@@ -0,0 +1,130 @@
+package mountmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMountRollsBackOnFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	targetDir := filepath.Join(tempDir, "mnt")
+	part1 := filepath.Join(targetDir, "partition1")
+	part2 := filepath.Join(targetDir, "partition2")
+	stateDir := t.TempDir()
+
+	fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1", "/dev/nbd5p2")
+	runner := NewFakeRunner().
+		On("mount /dev/nbd5p2 "+part2, "wrong fs type", errors.New("exit status 32"))
+	mm, err := NewMountManager(image, targetDir, "", "/dev/nbd5", "default",
+		WithRunner(runner), WithLogger(discardLogger()), WithStateDir(stateDir))
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail")
+	}
+
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 " + image,
+		"blkid -p -o export /dev/nbd5p1",
+		"blkid -p -o export /dev/nbd5p2",
+		"mount /dev/nbd5p1 " + part1,
+		"mount /dev/nbd5p2 " + part2,
+		"umount " + part1,
+		"qemu-nbd --disconnect /dev/nbd5",
+	})
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Error("Expected directories created during mount to be removed")
+	}
+	if states, _ := LoadStates(stateDir); len(states) != 0 {
+		t.Error("Expected no state to be recorded after rollback")
+	}
+}
+
+func TestMountValidationFailureDetachesNBD(t *testing.T) {
+	tempDir := t.TempDir()
+	image := filepath.Join(tempDir, "disk.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	fakePartitionTable(t, "/dev/nbd5", "/dev/nbd5p1", "/dev/nbd5p2")
+	runner := NewFakeRunner()
+	mm, err := NewMountManager(image, filepath.Join(tempDir, "mnt"), "", "/dev/nbd5", "single",
+		WithRunner(runner), WithLogger(discardLogger()), WithStateDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewMountManager() error = %v", err)
+	}
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail validation")
+	}
+
+	assertCommands(t, runner, []string{
+		"qemu-nbd --connect=/dev/nbd5 " + image,
+		"blkid -p -o export /dev/nbd5p1",
+		"blkid -p -o export /dev/nbd5p2",
+		"qemu-nbd --disconnect /dev/nbd5",
+	})
+}
+
+func TestMountKeepGoingRecordsPartialMount(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	stateDir := t.TempDir()
+	part1 := filepath.Join(targetDir, "partition1")
+	part2 := filepath.Join(targetDir, "partition2")
+
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner().
+		On("mount /dev/sdz1 "+part1, "wrong fs type", errors.New("exit status 32"))
+	mm := newTestManager(t, "/dev/sdz", targetDir, "default", runner, WithKeepGoing(), WithStateDir(stateDir))
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount /dev/sdz1 " + part1,
+		"mount /dev/sdz2 " + part2,
+	})
+	states, err := LoadStates(stateDir)
+	if err != nil || len(states) != 1 {
+		t.Fatalf("Expected one recorded state, got %d (%v)", len(states), err)
+	}
+	if len(states[0].Partitions) != 1 || states[0].Partitions[0].Device != "/dev/sdz2" {
+		t.Errorf("Expected only /dev/sdz2 to be recorded, got %+v", states[0].Partitions)
+	}
+}
+
+func TestMountKeepGoingDoesNotRollBack(t *testing.T) {
+	targetDir := t.TempDir()
+	stateDir := t.TempDir()
+
+	// raspberrypi fails after mounting the root partition because
+	// /boot/firmware is missing
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner()
+	mm := newTestManager(t, "/dev/sdz", targetDir, "raspberrypi", runner, WithKeepGoing(), WithStateDir(stateDir))
+
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail")
+	}
+
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount /dev/sdz2 " + targetDir,
+	})
+	if states, _ := LoadStates(stateDir); len(states) != 1 {
+		t.Error("Expected the partial mount to be recorded")
+	}
+}
@@ -1,43 +1,103 @@
 package mountmanager
 
 import (
+	"io"
 	"log"
+
+	"github.com/larsks/pmount/internal/parttable"
 )
 
 type Partition struct {
-	Device string
-	Number int
-	Size   string
+	Device string `json:"device,omitempty"`
+
+	// Number is the partition's number in the partition table, which is
+	// also the number in its device node (e.g. 5 for /dev/sda5)
+	Number int `json:"number"`
+
+	// Start and Size are in bytes
+	Start int64 `json:"start"`
+	Size  int64 `json:"size"`
+
+	// Type is the MBR partition type in hex (e.g. "83") or the GPT
+	// partition type GUID
+	Type string `json:"type"`
+
+	// PartLabel is the GPT partition name, and PartUUID identifies the
+	// partition as in /dev/disk/by-partuuid
+	PartLabel string `json:"partlabel,omitempty"`
+	PartUUID  string `json:"partuuid,omitempty"`
+
+	// FSType, Label and UUID are probed from the filesystem superblock
+	FSType string `json:"fstype,omitempty"`
+	Label  string `json:"label,omitempty"`
+	UUID   string `json:"uuid,omitempty"`
+
+	// VG and LV name the volume group and logical volume of an LVM logical
+	// volume; they are empty for partitions
+	VG string `json:"vg,omitempty"`
+	LV string `json:"lv,omitempty"`
+
+	// Array names the md RAID array a partition is on, or the array itself
+	// when it holds a filesystem rather than a partition table
+	Array string `json:"array,omitempty"`
+
+	// EncryptedDevice is the LUKS volume an unlocked device was opened from
+	EncryptedDevice string `json:"encrypted_device,omitempty"`
+
+	// ReadOnly is set for partitions that can only be used read-only, such
+	// as those on RAID arrays (which are always assembled read-only)
+	ReadOnly bool `json:"-"`
+
+	// Mountpoint is where a partition discovered during unmount is mounted
+	Mountpoint string `json:"-"`
+
+	MountOptions []string `json:"-"`
 }
 
-type SfdiskPartition struct {
-	Node  string `json:"node"`
-	Start int    `json:"start"`
-	Size  int    `json:"size"`
-	Type  string `json:"type"`
+// HumanSize returns the partition size in human readable form
+func (p Partition) HumanSize() string {
+	if p.Size == 0 {
+		return "unknown"
+	}
+	return formatSize(p.Size)
 }
 
-type SfdiskPartitionTable struct {
-	Label      string            `json:"label"`
-	ID         string            `json:"id"`
-	Device     string            `json:"device"`
-	Unit       string            `json:"unit"`
-	SectorSize int               `json:"sectorsize"`
-	Partitions []SfdiskPartition `json:"partitions"`
+type FindmntFilesystem struct {
+	Target string `json:"target"`
+	Source string `json:"source"`
 }
 
-type SfdiskOutput struct {
-	PartitionTable SfdiskPartitionTable `json:"partitiontable"`
+type FindmntOutput struct {
+	Filesystems []FindmntFilesystem `json:"filesystems"`
 }
 
 type MountManager struct {
-	sourceDevice      string
-	targetDir         string
-	nbdDevice         string
-	partitions        []Partition
-	logger            *log.Logger
-	format            string
-	nbdDeviceExplicit string
-	profileName       string
-	profile           MountProfile
+	sourceDevice string
+	extraSources []string
+	targetDir    string
+	device       string
+	partitions   []Partition
+	table        *parttable.Table
+	logger       *log.Logger
+	format       string
+	profileName  string
+	profile      MountProfile
+	runner       CommandRunner
+	dryRun       bool
+	planOutput   io.Writer
+	stateDir     string
+	state        *MountState
+	undoStack    []undoAction
+	keepGoing    bool
+	readOnly     bool
+	mountOptions MountOptions
+	selection    PartitionSelection
+	luksKeys     *LUKSKeys
+	overlay      bool
+	overlayDir   string
+	exportTo     string
+	nameTemplate string
+	backendName  string
+	backend      Backend
+	backends     []Backend
 }
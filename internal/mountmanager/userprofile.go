@@ -0,0 +1,323 @@
+package mountmanager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// profileDirs returns the directories searched for user-defined profiles.
+// Profiles in later directories override those in earlier ones.
+var profileDirs = func() []string {
+	dirs := []string{"/etc/pmount/profiles.d"}
+	if configDir := userConfigDir(); configDir != "" {
+		dirs = append(dirs, filepath.Join(configDir, "pmount", "profiles"))
+	}
+	return dirs
+}
+
+// lookupUser finds users by name. Tests replace it.
+var lookupUser = user.Lookup
+
+// userConfigDir returns the configuration directory of the user running
+// pmount. Under sudo this is ~/.config of the user who ran sudo, not root's.
+func userConfigDir() string {
+	if name := os.Getenv("SUDO_USER"); name != "" && name != "root" {
+		if u, err := lookupUser(name); err == nil && u.HomeDir != "" {
+			return filepath.Join(u.HomeDir, ".config")
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return dir
+	}
+	return ""
+}
+
+// profileLogger reports user-defined profiles that cannot be loaded, which
+// happens before there is a MountManager to log with
+var profileLogger = log.New(os.Stderr, "[pmount] ", log.LstdFlags)
+
+// ProfileRule maps the partition matching its criteria to a mountpoint.
+// All criteria that are set must match.
+type ProfileRule struct {
+	Partition int    `yaml:"partition,omitempty"`
+	Label     string `yaml:"label,omitempty"`
+	FSType    string `yaml:"fstype,omitempty"`
+	TypeGUID  string `yaml:"type_guid,omitempty"`
+
+	// Mountpoint is relative to the target directory ("/" is the target directory itself)
+	Mountpoint string `yaml:"mountpoint"`
+
+	// Required rules must match a partition for the profile to validate
+	Required bool `yaml:"required,omitempty"`
+
+	// Order controls mount order; rules with equal order are mounted
+	// parents first
+	Order int `yaml:"order,omitempty"`
+
+	Options []string `yaml:"options,omitempty"`
+}
+
+// String describes the rule's match criteria
+func (r ProfileRule) String() string {
+	var criteria []string
+	if r.Partition != 0 {
+		criteria = append(criteria, fmt.Sprintf("partition=%d", r.Partition))
+	}
+	if r.Label != "" {
+		criteria = append(criteria, "label="+r.Label)
+	}
+	if r.FSType != "" {
+		criteria = append(criteria, "fstype="+r.FSType)
+	}
+	if r.TypeGUID != "" {
+		criteria = append(criteria, "type_guid="+r.TypeGUID)
+	}
+	return strings.Join(criteria, ",")
+}
+
+func (r ProfileRule) matches(partition Partition) bool {
+	if r.Partition != 0 && r.Partition != partition.Number {
+		return false
+	}
+	if r.Label != "" && r.Label != partition.Label {
+		return false
+	}
+	if r.FSType != "" && r.FSType != partition.FSType {
+		return false
+	}
+	if r.TypeGUID != "" && !strings.EqualFold(r.TypeGUID, partition.Type) {
+		return false
+	}
+	return true
+}
+
+// UserProfile is a mount profile described by a YAML file:
+//
+//	description: Example board
+//	rules:
+//	  - partition: 2
+//	    mountpoint: /
+//	    required: true
+//	  - label: boot
+//	    mountpoint: /boot
+//	    options: [umask=022]
+type UserProfile struct {
+	ProfileName string        `yaml:"name,omitempty"`
+	Description string        `yaml:"description,omitempty"`
+	Rules       []ProfileRule `yaml:"rules"`
+}
+
+// profileAssignment pairs a rule with the partition it matched
+type profileAssignment struct {
+	rule      ProfileRule
+	partition Partition
+}
+
+// LoadUserProfile reads a profile from a YAML file. The profile is named
+// after the file unless the file sets a name.
+func LoadUserProfile(path string) (*UserProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile UserProfile
+	if err := yaml.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse profile %s: %w", path, err)
+	}
+	if profile.ProfileName == "" {
+		profile.ProfileName = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	if len(profile.Rules) == 0 {
+		return nil, fmt.Errorf("profile %s defines no rules", path)
+	}
+	for i, rule := range profile.Rules {
+		if rule.String() == "" {
+			return nil, fmt.Errorf("profile %s: rule %d has no match criteria", path, i+1)
+		}
+		if rule.Mountpoint == "" {
+			return nil, fmt.Errorf("profile %s: rule %d has no mountpoint", path, i+1)
+		}
+		if slices.Contains(strings.Split(filepath.ToSlash(rule.Mountpoint), "/"), "..") {
+			return nil, fmt.Errorf("profile %s: rule %d mountpoint %s escapes the target directory", path, i+1, rule.Mountpoint)
+		}
+	}
+
+	return &profile, nil
+}
+
+// LoadUserProfiles returns the user-defined profiles found in the profile
+// directories, indexed by name. Files that are not valid profiles are
+// skipped with a warning, so that one bad file does not break the others.
+func LoadUserProfiles() (map[string]*UserProfile, error) {
+	profiles := make(map[string]*UserProfile)
+	for _, dir := range profileDirs() {
+		var paths []string
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, matches...)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			profile, err := LoadUserProfile(path)
+			if err != nil {
+				profileLogger.Printf("warning: skipping profile %s: %v", path, err)
+				continue
+			}
+			profiles[profile.ProfileName] = profile
+		}
+	}
+	return profiles, nil
+}
+
+func (p *UserProfile) Name() string {
+	return p.ProfileName
+}
+
+// assign matches rules to partitions. Each partition is claimed by at most
+// one rule, in the order the rules are listed. The result is in mount order.
+func (p *UserProfile) assign(partitions []Partition) ([]profileAssignment, error) {
+	claimed := make(map[string]bool)
+	var assignments []profileAssignment
+
+	for i, rule := range p.Rules {
+		found := false
+		for _, partition := range partitions {
+			if claimed[partition.Device] || !rule.matches(partition) {
+				continue
+			}
+			claimed[partition.Device] = true
+			assignments = append(assignments, profileAssignment{rule: rule, partition: partition})
+			found = true
+			break
+		}
+		if !found && rule.Required {
+			return nil, fmt.Errorf("%s profile: no partition matches required rule %d (%s)", p.ProfileName, i+1, rule)
+		}
+	}
+
+	sort.SliceStable(assignments, func(i, j int) bool {
+		a, b := assignments[i].rule, assignments[j].rule
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return mountpointDepth(a.Mountpoint) < mountpointDepth(b.Mountpoint)
+	})
+
+	return assignments, nil
+}
+
+// mountpointDepth returns the number of path components in a mountpoint
+func mountpointDepth(mountpoint string) int {
+	mountpoint = strings.Trim(filepath.Clean("/"+mountpoint), "/")
+	if mountpoint == "" {
+		return 0
+	}
+	return strings.Count(mountpoint, "/") + 1
+}
+
+func (p *UserProfile) Validate(partitions []Partition) error {
+	_, err := p.assign(partitions)
+	return err
+}
+
+func (p *UserProfile) Mount(mm *MountManager, partitions []Partition) error {
+	assignments, err := p.assign(partitions)
+	if err != nil {
+		return err
+	}
+
+	var mounted []string
+	for _, assignment := range assignments {
+		partition := assignment.partition
+		partition.MountOptions = slices.Concat(partition.MountOptions, assignment.rule.Options)
+		dir := filepath.Join(mm.targetDir, assignment.rule.Mountpoint)
+
+		// Mountpoints within a filesystem mounted earlier must exist there:
+		// creating them would write to the image, and removing them at
+		// teardown would miss once the filesystem is unmounted. In dry-run
+		// mode nothing has been mounted, so there is nothing to check.
+		if parent := mountedParent(mounted, dir); parent != "" {
+			if _, err := os.Stat(dir); os.IsNotExist(err) && !mm.dryRun {
+				err := fmt.Errorf("%s does not exist in the filesystem mounted on %s", dir, parent)
+				if !mm.keepGoing {
+					return err
+				}
+				mm.logger.Printf("failed to mount %s: %v", partition.Device, err)
+				continue
+			}
+		} else if err := mm.mkdirAll(dir); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+		if err := mm.mountPartition(partition, dir); err != nil {
+			if !mm.keepGoing {
+				return fmt.Errorf("failed to mount %s to %s: %w", partition.Device, dir, err)
+			}
+			mm.logger.Printf("failed to mount %s to %s: %v", partition.Device, dir, err)
+			continue
+		}
+		mm.logger.Printf("mounted %s (%s) to %s", partition.Device, partition.HumanSize(), dir)
+		mounted = append(mounted, dir)
+	}
+	return nil
+}
+
+// mountedParent returns the innermost of the mounted directories that dir
+// lies beneath, or "" if there is none
+func mountedParent(mounted []string, dir string) string {
+	var parent string
+	for _, m := range mounted {
+		if m != dir && isWithin(dir, m) && len(m) > len(parent) {
+			parent = m
+		}
+	}
+	return parent
+}
+
+func (p *UserProfile) Unmount(mm *MountManager) error {
+	// Unmount in reverse mount order, using the rules' mountpoints
+	var dirs []string
+	for _, rule := range p.Rules {
+		dirs = append(dirs, filepath.Join(mm.targetDir, rule.Mountpoint))
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return mountpointDepth(dirs[i]) > mountpointDepth(dirs[j])
+	})
+
+	var failed []string
+	for _, dir := range dirs {
+		device, err := mm.findMountedDevice(dir)
+		if err != nil {
+			mm.logger.Printf("warning: %v", err)
+		}
+		if device == "" {
+			continue
+		}
+		mm.addPartition(device, 0)
+
+		if err := mm.unmountDir(dir); err != nil {
+			mm.logger.Printf("failed to unmount %s: %v", dir, err)
+			failed = append(failed, dir)
+			continue
+		}
+		mm.logger.Printf("unmounted %s", dir)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to unmount %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
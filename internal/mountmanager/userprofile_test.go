@@ -0,0 +1,293 @@
+package mountmanager
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeProfileDirs points profile discovery at temporary directories and
+// returns them (system directory first, user directory second)
+func fakeProfileDirs(t *testing.T) (string, string) {
+	t.Helper()
+	systemDir, userDir := t.TempDir(), t.TempDir()
+	old := profileDirs
+	profileDirs = func() []string { return []string{systemDir, userDir} }
+	t.Cleanup(func() { profileDirs = old })
+	return systemDir, userDir
+}
+
+func writeProfile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write profile: %v", err)
+	}
+	return path
+}
+
+const boardProfile = `
+description: Example board
+rules:
+  - label: boot
+    mountpoint: /boot
+    options: [umask=022]
+  - partition: 2
+    mountpoint: /
+    required: true
+  - fstype: swap
+    mountpoint: /swap
+`
+
+func TestLoadUserProfiles(t *testing.T) {
+	systemDir, userDir := fakeProfileDirs(t)
+	writeProfile(t, systemDir, "board.yaml", boardProfile)
+	writeProfile(t, systemDir, "other.yml", "rules:\n  - partition: 1\n    mountpoint: /\n")
+	// The user's copy of "other" overrides the system one
+	writeProfile(t, userDir, "mine.yaml", "name: other\nrules:\n  - partition: 3\n    mountpoint: /\n")
+
+	profiles, err := LoadUserProfiles()
+	if err != nil {
+		t.Fatalf("LoadUserProfiles() error = %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("Expected 2 profiles, got %d", len(profiles))
+	}
+	if profiles["board"].Description != "Example board" || len(profiles["board"].Rules) != 3 {
+		t.Errorf("Unexpected board profile: %+v", profiles["board"])
+	}
+	if profiles["other"].Rules[0].Partition != 3 {
+		t.Errorf("Expected user profile to override system profile, got %+v", profiles["other"])
+	}
+
+	want := []string{"default", "single", "raspberrypi", "board", "other"}
+	if got := ProfileNames(profiles); !reflect.DeepEqual(got, want) {
+		t.Errorf("ProfileNames() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadUserProfilesSkipsInvalid(t *testing.T) {
+	systemDir, _ := fakeProfileDirs(t)
+	writeProfile(t, systemDir, "board.yaml", boardProfile)
+	bad := writeProfile(t, systemDir, "broken.yaml", "rules: [")
+	var warnings bytes.Buffer
+	old := profileLogger
+	profileLogger = log.New(&warnings, "", 0)
+	t.Cleanup(func() { profileLogger = old })
+
+	profiles, err := LoadUserProfiles()
+	if err != nil {
+		t.Fatalf("LoadUserProfiles() error = %v", err)
+	}
+	if len(profiles) != 1 || profiles["board"] == nil {
+		t.Errorf("Expected only the board profile, got %v", profiles)
+	}
+	if !strings.Contains(warnings.String(), bad) {
+		t.Errorf("Expected a warning naming %s, got %q", bad, warnings.String())
+	}
+}
+
+func TestUserConfigDirUnderSudo(t *testing.T) {
+	old := lookupUser
+	lookupUser = func(name string) (*user.User, error) {
+		if name != "alice" {
+			return nil, user.UnknownUserError(name)
+		}
+		return &user.User{Username: name, HomeDir: "/home/alice"}, nil
+	}
+	t.Cleanup(func() { lookupUser = old })
+	t.Setenv("XDG_CONFIG_HOME", "/root/.config")
+
+	t.Setenv("SUDO_USER", "alice")
+	if got, want := userConfigDir(), "/home/alice/.config"; got != want {
+		t.Errorf("userConfigDir() = %q, want %q", got, want)
+	}
+	t.Setenv("SUDO_USER", "")
+	if got, want := userConfigDir(), "/root/.config"; got != want {
+		t.Errorf("userConfigDir() without sudo = %q, want %q", got, want)
+	}
+}
+
+func TestLoadUserProfileErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"empty.yaml":    "description: nothing\n",
+		"nomatch.yaml":  "rules:\n  - mountpoint: /\n",
+		"nomount.yaml":  "rules:\n  - partition: 1\n",
+		"escape.yaml":   "rules:\n  - partition: 1\n    mountpoint: ../etc\n",
+		"invalid.yaml":  "rules: [",
+		"badfield.yaml": "rules:\n  - partition: one\n    mountpoint: /\n",
+	}
+	for name, content := range tests {
+		path := writeProfile(t, dir, name, content)
+		if _, err := LoadUserProfile(path); err == nil {
+			t.Errorf("Expected LoadUserProfile(%s) to fail", name)
+		}
+	}
+}
+
+func TestNewProfileUserDefined(t *testing.T) {
+	systemDir, _ := fakeProfileDirs(t)
+	writeProfile(t, systemDir, "board.yaml", boardProfile)
+
+	profile, err := NewProfile("board")
+	if err != nil {
+		t.Fatalf("NewProfile() error = %v", err)
+	}
+	if profile.Name() != "board" {
+		t.Errorf("Expected profile name board, got %s", profile.Name())
+	}
+
+	if _, err := NewProfile("missing"); err == nil {
+		t.Error("Expected NewProfile() to fail for unknown profile")
+	}
+}
+
+func TestUserProfile_Validate(t *testing.T) {
+	systemDir, _ := fakeProfileDirs(t)
+	profile, err := LoadUserProfile(writeProfile(t, systemDir, "board.yaml", boardProfile))
+	if err != nil {
+		t.Fatalf("LoadUserProfile() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		partitions []Partition
+		wantErr    bool
+	}{
+		{
+			name: "all rules match",
+			partitions: []Partition{
+				{Device: "/dev/sda1", Number: 1, Label: "boot"},
+				{Device: "/dev/sda2", Number: 2},
+				{Device: "/dev/sda3", Number: 3, FSType: "swap"},
+			},
+		},
+		{
+			name: "optional rules missing",
+			partitions: []Partition{
+				{Device: "/dev/sda2", Number: 2},
+			},
+		},
+		{
+			name: "required rule missing",
+			partitions: []Partition{
+				{Device: "/dev/sda1", Number: 1, Label: "boot"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "partition claimed by an earlier rule",
+			partitions: []Partition{
+				{Device: "/dev/sda2", Number: 2, Label: "boot"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := profile.Validate(tt.partitions); (err != nil) != tt.wantErr {
+				t.Errorf("UserProfile.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUserProfile_MountUnmount(t *testing.T) {
+	systemDir, _ := fakeProfileDirs(t)
+	writeProfile(t, systemDir, "board.yaml", boardProfile)
+
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	bootDir := filepath.Join(targetDir, "boot")
+	if err := os.MkdirAll(bootDir, 0755); err != nil {
+		t.Fatalf("Failed to create boot directory: %v", err)
+	}
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz1", "LABEL=boot\nTYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/sdz2", "LABEL=root\nTYPE=ext4\n", nil).
+		On("findmnt -J -M "+bootDir, findmntJSON(bootDir, "/dev/sdz1"), nil).
+		On("findmnt -J -M "+targetDir, findmntJSON(targetDir, "/dev/sdz2"), nil)
+	mm := newTestManager(t, "/dev/sdz", targetDir, "board", runner)
+
+	if err := mm.Mount(); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	// Unmount using the profile rather than recorded state
+	if err := mm.profile.Unmount(mm); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+
+	// The root partition is mounted before the partition mounted beneath it
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount /dev/sdz2 " + targetDir,
+		"mount -o umask=022 /dev/sdz1 " + bootDir,
+		"findmnt -J -M " + bootDir,
+		"umount " + bootDir,
+		"findmnt -J -M " + filepath.Join(targetDir, "swap"),
+		"findmnt -J -M " + targetDir,
+		"umount " + targetDir,
+	})
+}
+
+func TestUserProfile_MountMissingMountpoint(t *testing.T) {
+	systemDir, _ := fakeProfileDirs(t)
+	writeProfile(t, systemDir, "board.yaml", boardProfile)
+
+	targetDir := filepath.Join(t.TempDir(), "mnt")
+	fakePartitionTable(t, "/dev/sdz", "/dev/sdz1", "/dev/sdz2")
+	runner := NewFakeRunner().
+		On("blkid -p -o export /dev/sdz1", "LABEL=boot\nTYPE=vfat\n", nil).
+		On("blkid -p -o export /dev/sdz2", "LABEL=root\nTYPE=ext4\n", nil)
+	mm := newTestManager(t, "/dev/sdz", targetDir, "board", runner)
+
+	// /boot is not created within the root filesystem
+	if err := mm.Mount(); err == nil {
+		t.Fatal("Expected Mount() to fail when /boot does not exist in the root filesystem")
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "boot")); !os.IsNotExist(err) {
+		t.Errorf("Expected boot directory not to be created, got %v", err)
+	}
+	assertCommands(t, runner, []string{
+		"blkid -p -o export /dev/sdz1",
+		"blkid -p -o export /dev/sdz2",
+		"mount /dev/sdz2 " + targetDir,
+		"umount " + targetDir,
+	})
+}
+
+func TestUserProfile_MountOrder(t *testing.T) {
+	profile := &UserProfile{
+		ProfileName: "ordered",
+		Rules: []ProfileRule{
+			{Partition: 1, Mountpoint: "/a/b"},
+			{Partition: 2, Mountpoint: "/"},
+			{Partition: 3, Mountpoint: "/c", Order: -1},
+		},
+	}
+	assignments, err := profile.assign([]Partition{
+		{Device: "/dev/sda1", Number: 1},
+		{Device: "/dev/sda2", Number: 2},
+		{Device: "/dev/sda3", Number: 3},
+	})
+	if err != nil {
+		t.Fatalf("assign() error = %v", err)
+	}
+
+	var got []string
+	for _, assignment := range assignments {
+		got = append(got, assignment.rule.Mountpoint)
+	}
+	want := []string{"/c", "/", "/a/b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mount order = %v, want %v", got, want)
+	}
+}
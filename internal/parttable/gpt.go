@@ -0,0 +1,169 @@
+package parttable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	gptSignature      = "EFI PART"
+	gptMinHeaderSize  = 92
+	gptMinEntrySize   = 128
+	gptMaxEntriesSize = 1 << 20
+)
+
+// errNoGPTHeader is returned when the GPT signature is missing
+var errNoGPTHeader = errors.New("no GPT header")
+
+// gptHeader is a validated GPT header together with its partition entries
+type gptHeader struct {
+	currentLBA   int64
+	alternateLBA int64
+	diskGUID     string
+	entries      []byte
+	numEntries   int
+	entrySize    int
+}
+
+// readGPTHeader reads and validates the GPT header at lba and the partition
+// entries it describes
+func readGPTHeader(r io.ReaderAt, lba int64, sectorSize int) (*gptHeader, error) {
+	sector, err := readSector(r, lba, sectorSize)
+	if err != nil {
+		return nil, err
+	}
+	if string(sector[:8]) != gptSignature {
+		return nil, errNoGPTHeader
+	}
+
+	headerSize := int(binary.LittleEndian.Uint32(sector[12:16]))
+	if headerSize < gptMinHeaderSize || headerSize > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size %d", headerSize)
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, sector)
+	wantCRC := binary.LittleEndian.Uint32(header[16:20])
+	binary.LittleEndian.PutUint32(header[16:20], 0)
+	if crc := crc32.ChecksumIEEE(header); crc != wantCRC {
+		return nil, fmt.Errorf("GPT header checksum mismatch (got %08x, want %08x)", crc, wantCRC)
+	}
+
+	h := &gptHeader{
+		currentLBA:   int64(binary.LittleEndian.Uint64(header[24:32])),
+		alternateLBA: int64(binary.LittleEndian.Uint64(header[32:40])),
+		diskGUID:     formatGUID(header[56:72]),
+		numEntries:   int(binary.LittleEndian.Uint32(header[80:84])),
+		entrySize:    int(binary.LittleEndian.Uint32(header[84:88])),
+	}
+	if h.currentLBA != lba {
+		return nil, fmt.Errorf("GPT header at sector %d claims to be at sector %d", lba, h.currentLBA)
+	}
+	// Each field is checked on its own, so that their product cannot overflow
+	if h.entrySize < gptMinEntrySize || h.entrySize%8 != 0 || h.entrySize > sectorSize {
+		return nil, fmt.Errorf("invalid GPT partition entry size %d", h.entrySize)
+	}
+	if h.numEntries > gptMaxEntriesSize/h.entrySize {
+		return nil, fmt.Errorf("GPT partition array of %d entries is too large", h.numEntries)
+	}
+
+	entriesLBA := int64(binary.LittleEndian.Uint64(header[72:80]))
+	h.entries = make([]byte, h.numEntries*h.entrySize)
+	if _, err := r.ReadAt(h.entries, entriesLBA*int64(sectorSize)); err != nil {
+		return nil, fmt.Errorf("failed to read GPT partition entries: %w", err)
+	}
+	wantCRC = binary.LittleEndian.Uint32(header[88:92])
+	if crc := crc32.ChecksumIEEE(h.entries); crc != wantCRC {
+		return nil, fmt.Errorf("GPT partition entries checksum mismatch (got %08x, want %08x)", crc, wantCRC)
+	}
+
+	return h, nil
+}
+
+// readGPT reads the GPT, falling back to the backup header at the end of the
+// device if the primary header is damaged
+func readGPT(r io.ReaderAt, size int64, sectorSize int) (*Table, error) {
+	lastLBA := size/int64(sectorSize) - 1
+
+	var warnings []string
+	primary, primaryErr := readGPTHeader(r, 1, sectorSize)
+	backupLBA := lastLBA
+	if primaryErr == nil {
+		backupLBA = primary.alternateLBA
+	}
+	backup, backupErr := readGPTHeader(r, backupLBA, sectorSize)
+
+	header := primary
+	switch {
+	case primaryErr == nil && backupErr != nil:
+		warnings = append(warnings, fmt.Sprintf("backup GPT header is invalid: %v", backupErr))
+	case primaryErr == nil:
+		if !bytes.Equal(primary.entries, backup.entries) {
+			warnings = append(warnings, "primary and backup GPT partition entries differ")
+		}
+	case backupErr == nil:
+		warnings = append(warnings, fmt.Sprintf("primary GPT header is invalid (%v); using backup", primaryErr))
+		header = backup
+	default:
+		return nil, primaryErr
+	}
+
+	table := &Table{
+		Label:      "gpt",
+		ID:         header.diskGUID,
+		SectorSize: sectorSize,
+		Warnings:   warnings,
+	}
+	for i := 0; i < header.numEntries; i++ {
+		entry := header.entries[i*header.entrySize : (i+1)*header.entrySize]
+		typeGUID := entry[0:16]
+		if bytes.Equal(typeGUID, make([]byte, 16)) {
+			continue
+		}
+
+		first := int64(binary.LittleEndian.Uint64(entry[32:40]))
+		last := int64(binary.LittleEndian.Uint64(entry[40:48]))
+		if last < first {
+			table.Warnings = append(table.Warnings, fmt.Sprintf("partition %d ends before it starts", i+1))
+			continue
+		}
+
+		table.Partitions = append(table.Partitions, Partition{
+			Number:     i + 1,
+			Start:      first * int64(sectorSize),
+			Size:       (last - first + 1) * int64(sectorSize),
+			Type:       formatGUID(typeGUID),
+			GUID:       formatGUID(entry[16:32]),
+			Attributes: binary.LittleEndian.Uint64(entry[48:56]),
+			Name:       decodeName(entry[56:128]),
+		})
+	}
+	return table, nil
+}
+
+// formatGUID formats a GUID stored in the mixed-endian on-disk layout
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+// decodeName decodes a NUL-terminated UTF-16LE partition name
+func decodeName(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := binary.LittleEndian.Uint16(b[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return string(utf16.Decode(units))
+}
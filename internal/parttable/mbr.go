@@ -0,0 +1,176 @@
+package parttable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	mbrSize         = 512
+	mbrEntriesStart = 446
+	mbrEntrySize    = 16
+
+	// maxLogicalPartitions bounds the walk of an extended partition chain
+	maxLogicalPartitions = 256
+
+	mbrTypeProtective = 0xee
+)
+
+// mbrEntry is a partition entry in an MBR or extended boot record
+type mbrEntry struct {
+	status  byte
+	typ     byte
+	start   uint32
+	sectors uint32
+}
+
+func (e mbrEntry) empty() bool {
+	return e.typ == 0 || e.sectors == 0
+}
+
+func (e mbrEntry) extended() bool {
+	switch e.typ {
+	case 0x05, 0x0f, 0x85:
+		return true
+	}
+	return false
+}
+
+// mbrHeader is the partition table of a master boot record
+type mbrHeader struct {
+	id      uint32
+	entries [4]mbrEntry
+}
+
+// parseBootRecord decodes the partition entries of an MBR or EBR sector.
+// It returns nil if the sector does not hold a partition table.
+func parseBootRecord(sector []byte) *mbrHeader {
+	if len(sector) < mbrSize || sector[510] != 0x55 || sector[511] != 0xaa {
+		return nil
+	}
+
+	header := &mbrHeader{id: binary.LittleEndian.Uint32(sector[440:444])}
+	for i := range header.entries {
+		entry := sector[mbrEntriesStart+i*mbrEntrySize:]
+		header.entries[i] = mbrEntry{
+			status:  entry[0],
+			typ:     entry[4],
+			start:   binary.LittleEndian.Uint32(entry[8:12]),
+			sectors: binary.LittleEndian.Uint32(entry[12:16]),
+		}
+
+		// FAT and NTFS boot sectors also end in 55 aa; their "status"
+		// bytes are not limited to these values
+		if status := header.entries[i].status; status != 0x00 && status != 0x80 {
+			return nil
+		}
+	}
+	return header
+}
+
+// readMBR reads the master boot record. It returns nil if there is none.
+func readMBR(r io.ReaderAt) (*mbrHeader, error) {
+	sector := make([]byte, mbrSize)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseBootRecord(sector), nil
+}
+
+// protective reports whether the MBR only exists to protect a GPT
+func (h *mbrHeader) protective() bool {
+	for _, entry := range h.entries {
+		if entry.typ == mbrTypeProtective {
+			return true
+		}
+	}
+	return false
+}
+
+// table converts the MBR to a partition table, following the chain of
+// extended boot records to find logical partitions
+func (h *mbrHeader) table(r io.ReaderAt, sectorSize int) *Table {
+	table := &Table{
+		Label:      "dos",
+		ID:         fmt.Sprintf("0x%08x", h.id),
+		SectorSize: sectorSize,
+	}
+
+	var extended *mbrEntry
+	for i, entry := range h.entries {
+		if entry.empty() {
+			continue
+		}
+		table.Partitions = append(table.Partitions, mbrPartition(i+1, entry, 0, sectorSize))
+		if entry.extended() && extended == nil {
+			extended = &h.entries[i]
+		}
+	}
+
+	if extended != nil {
+		table.readLogicalPartitions(r, int64(extended.start))
+	}
+
+	sort.Slice(table.Partitions, func(i, j int) bool {
+		return table.Partitions[i].Number < table.Partitions[j].Number
+	})
+	return table
+}
+
+// readLogicalPartitions walks the chain of extended boot records starting at
+// the extended partition. The first entry of each EBR is a logical partition
+// relative to the EBR; the second points to the next EBR relative to the
+// start of the extended partition.
+func (t *Table) readLogicalPartitions(r io.ReaderAt, extendedStart int64) {
+	number := 5
+	seen := make(map[int64]bool)
+	ebr := extendedStart
+
+	for len(seen) < maxLogicalPartitions {
+		if seen[ebr] {
+			t.Warnings = append(t.Warnings, fmt.Sprintf("extended partition chain loops back to sector %d", ebr))
+			return
+		}
+		seen[ebr] = true
+
+		sector, err := readSector(r, ebr, t.SectorSize)
+		if err != nil {
+			t.Warnings = append(t.Warnings, fmt.Sprintf("failed to read extended boot record at sector %d: %v", ebr, err))
+			return
+		}
+		record := parseBootRecord(sector)
+		if record == nil {
+			t.Warnings = append(t.Warnings, fmt.Sprintf("invalid extended boot record at sector %d", ebr))
+			return
+		}
+
+		if logical := record.entries[0]; !logical.empty() {
+			t.Partitions = append(t.Partitions, mbrPartition(number, logical, ebr, t.SectorSize))
+			number++
+		}
+
+		next := record.entries[1]
+		if next.empty() || !next.extended() {
+			return
+		}
+		ebr = extendedStart + int64(next.start)
+	}
+	t.Warnings = append(t.Warnings, fmt.Sprintf("more than %d logical partitions", maxLogicalPartitions))
+}
+
+func mbrPartition(number int, entry mbrEntry, base int64, sectorSize int) Partition {
+	return Partition{
+		Number:   number,
+		Start:    (base + int64(entry.start)) * int64(sectorSize),
+		Size:     int64(entry.sectors) * int64(sectorSize),
+		Type:     fmt.Sprintf("%x", entry.typ),
+		Bootable: entry.status == 0x80,
+		Extended: entry.extended(),
+	}
+}
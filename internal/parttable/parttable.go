@@ -0,0 +1,152 @@
+// Package parttable reads MBR and GPT partition tables from block devices
+// and disk image files without relying on external tools.
+package parttable
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSectorSize is the logical sector size assumed for image files
+const DefaultSectorSize = 512
+
+// ErrNoPartitionTable is returned when a device has neither an MBR nor a GPT
+var ErrNoPartitionTable = errors.New("no partition table found")
+
+// Table is a partition table read from a device or image
+type Table struct {
+	// Label is "dos" for MBR tables and "gpt" for GPT tables, as reported
+	// by sfdisk
+	Label string
+
+	// ID is the MBR disk signature (e.g. "0x7351b90c") or the GPT disk GUID
+	ID string
+
+	SectorSize int
+
+	// Partitions are listed in partition number order
+	Partitions []Partition
+
+	// Warnings describes problems that did not prevent the table from being
+	// read, such as a corrupt backup GPT header
+	Warnings []string
+}
+
+// Partition is an entry in a partition table
+type Partition struct {
+	// Number is the partition number used by the kernel: MBR primary
+	// partitions are 1-4 and logical partitions start at 5; GPT partitions
+	// are numbered by their entry in the partition array
+	Number int
+
+	// Start and Size are in bytes
+	Start int64
+	Size  int64
+
+	// Type is the MBR partition type in hex (e.g. "83") or the GPT
+	// partition type GUID (e.g. "0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	Type string
+
+	// GUID is the GPT unique partition GUID
+	GUID string
+
+	// Name is the GPT partition name
+	Name string
+
+	// Attributes are the GPT attribute flags
+	Attributes uint64
+
+	// Bootable is set for MBR partitions marked active
+	Bootable bool
+
+	// Extended is set for MBR extended partitions, which contain logical
+	// partitions rather than a filesystem
+	Extended bool
+}
+
+// Read reads the partition table from r, which holds size bytes with the
+// given logical sector size
+func Read(r io.ReaderAt, size int64, sectorSize int) (*Table, error) {
+	if sectorSize <= 0 {
+		sectorSize = DefaultSectorSize
+	}
+
+	mbr, err := readMBR(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case mbr == nil:
+		// A GPT without a protective MBR is unusual but readable
+		table, err := readGPT(r, size, sectorSize)
+		if err != nil {
+			return nil, ErrNoPartitionTable
+		}
+		return table, nil
+	case mbr.protective():
+		return readGPT(r, size, sectorSize)
+	default:
+		return mbr.table(r, sectorSize), nil
+	}
+}
+
+// ReadFile reads the partition table from a block device or image file.
+// The sector size of a block device is queried from the kernel; image files
+// are assumed to use 512-byte sectors unless a GPT is only found at 4096
+// bytes.
+func ReadFile(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine size of %s: %w", path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeDevice != 0 {
+		sectorSize, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKSSZGET)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine sector size of %s: %w", path, err)
+		}
+		return readTable(f, size, sectorSize, path)
+	}
+
+	table, err := readTable(f, size, DefaultSectorSize, path)
+	if err == nil || !errors.Is(err, errNoGPTHeader) {
+		return table, err
+	}
+	// Images of 4Kn disks place the GPT header at byte 4096
+	if table, err4k := readTable(f, size, 4096, path); err4k == nil {
+		return table, nil
+	}
+	return nil, err
+}
+
+func readTable(r io.ReaderAt, size int64, sectorSize int, path string) (*Table, error) {
+	table, err := Read(r, size, sectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partition table from %s: %w", path, err)
+	}
+	return table, nil
+}
+
+// readSector reads the sector at lba
+func readSector(r io.ReaderAt, lba int64, sectorSize int) ([]byte, error) {
+	buf := make([]byte, sectorSize)
+	if _, err := r.ReadAt(buf, lba*int64(sectorSize)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
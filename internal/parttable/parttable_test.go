@@ -0,0 +1,356 @@
+package parttable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+const (
+	linuxGUID = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	espGUID   = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+)
+
+// putMBREntry writes a partition entry into an MBR or EBR sector
+func putMBREntry(sector []byte, index int, status, typ byte, start, sectors uint32) {
+	entry := sector[mbrEntriesStart+index*mbrEntrySize:]
+	entry[0] = status
+	entry[4] = typ
+	binary.LittleEndian.PutUint32(entry[8:12], start)
+	binary.LittleEndian.PutUint32(entry[12:16], sectors)
+	sector[510], sector[511] = 0x55, 0xaa
+}
+
+// mbrImage returns a 16 MiB image with a DOS partition table holding a FAT
+// partition, a Linux partition and an extended partition containing two
+// logical partitions
+func mbrImage() []byte {
+	image := make([]byte, 16<<20)
+	binary.LittleEndian.PutUint32(image[440:444], 0x7351b90c)
+	putMBREntry(image, 0, 0x80, 0x0c, 2048, 8192)
+	putMBREntry(image, 1, 0x00, 0x83, 10240, 8192)
+	putMBREntry(image, 2, 0x00, 0x05, 18432, 12288)
+
+	// Logical partitions: each EBR describes one partition relative to
+	// itself and links to the next EBR relative to the extended partition
+	ebr1 := image[18432*512:]
+	putMBREntry(ebr1, 0, 0x00, 0x83, 2048, 2048)
+	putMBREntry(ebr1, 1, 0x00, 0x05, 6144, 6144)
+	ebr2 := image[(18432+6144)*512:]
+	putMBREntry(ebr2, 0, 0x00, 0x82, 2048, 4096)
+	return image
+}
+
+type gptTestPartition struct {
+	typeGUID   string
+	first      uint64
+	last       uint64
+	name       string
+	attributes uint64
+}
+
+// parseGUID converts a GUID string to its mixed-endian on-disk layout
+func parseGUID(t *testing.T, s string) []byte {
+	t.Helper()
+	var a uint32
+	var b, c uint16
+	var d [2]byte
+	var e [6]byte
+	var hexD, hexE uint64
+	if _, err := fmt.Sscanf(s, "%08X-%04X-%04X-%04X-%012X", &a, &b, &c, &hexD, &hexE); err != nil {
+		t.Fatalf("invalid GUID %s: %v", s, err)
+	}
+	binary.BigEndian.PutUint16(d[:], uint16(hexD))
+	for i := 5; i >= 0; i-- {
+		e[i] = byte(hexE)
+		hexE >>= 8
+	}
+	guid := make([]byte, 16)
+	binary.LittleEndian.PutUint32(guid[0:4], a)
+	binary.LittleEndian.PutUint16(guid[4:6], b)
+	binary.LittleEndian.PutUint16(guid[6:8], c)
+	copy(guid[8:10], d[:])
+	copy(guid[10:16], e[:])
+	return guid
+}
+
+// writeGPTHeader writes a GPT header and its partition entries
+func writeGPTHeader(image []byte, sectorSize int, lba, alternate, entriesLBA uint64, entries []byte) {
+	header := image[lba*uint64(sectorSize):]
+	copy(header, gptSignature)
+	binary.LittleEndian.PutUint32(header[8:12], 0x00010000)
+	binary.LittleEndian.PutUint32(header[12:16], gptMinHeaderSize)
+	binary.LittleEndian.PutUint64(header[24:32], lba)
+	binary.LittleEndian.PutUint64(header[32:40], alternate)
+	binary.LittleEndian.PutUint64(header[40:48], 34)
+	binary.LittleEndian.PutUint64(header[48:56], uint64(len(image)/sectorSize)-34)
+	copy(header[56:72], []byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
+	binary.LittleEndian.PutUint64(header[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(header[80:84], uint32(len(entries)/gptMinEntrySize))
+	binary.LittleEndian.PutUint32(header[84:88], gptMinEntrySize)
+	binary.LittleEndian.PutUint32(header[88:92], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:gptMinHeaderSize]))
+	copy(image[entriesLBA*uint64(sectorSize):], entries)
+}
+
+// gptImage returns an 8 MiB image with a protective MBR, primary and backup
+// GPT headers and the given partitions
+func gptImage(t *testing.T, sectorSize int, partitions map[int]gptTestPartition) []byte {
+	t.Helper()
+	image := make([]byte, 8<<20)
+	lastLBA := uint64(len(image)/sectorSize) - 1
+	putMBREntry(image, 0, 0x00, mbrTypeProtective, 1, uint32(lastLBA))
+
+	entries := make([]byte, 128*gptMinEntrySize)
+	for number, p := range partitions {
+		entry := entries[(number-1)*gptMinEntrySize:]
+		copy(entry[0:16], parseGUID(t, p.typeGUID))
+		copy(entry[16:32], parseGUID(t, "01234567-89AB-CDEF-0123-456789ABCDEF"))
+		entry[16] = byte(number)
+		binary.LittleEndian.PutUint64(entry[32:40], p.first)
+		binary.LittleEndian.PutUint64(entry[40:48], p.last)
+		binary.LittleEndian.PutUint64(entry[48:56], p.attributes)
+		for i, unit := range utf16.Encode([]rune(p.name)) {
+			binary.LittleEndian.PutUint16(entry[56+2*i:], unit)
+		}
+	}
+
+	entrySectors := uint64(len(entries) / sectorSize)
+	writeGPTHeader(image, sectorSize, 1, lastLBA, 2, entries)
+	writeGPTHeader(image, sectorSize, lastLBA, 1, lastLBA-entrySectors, entries)
+	return image
+}
+
+func standardGPT(t *testing.T) []byte {
+	return gptImage(t, 512, map[int]gptTestPartition{
+		1: {typeGUID: espGUID, first: 2048, last: 4095, name: "EFI system", attributes: 1},
+		3: {typeGUID: linuxGUID, first: 4096, last: 14335, name: "root"},
+	})
+}
+
+func TestReadMBR(t *testing.T) {
+	image := mbrImage()
+	table, err := Read(bytes.NewReader(image), int64(len(image)), 512)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	if table.Label != "dos" || table.ID != "0x7351b90c" {
+		t.Errorf("Expected dos table 0x7351b90c, got %s %s", table.Label, table.ID)
+	}
+	if len(table.Warnings) != 0 {
+		t.Errorf("Unexpected warnings: %v", table.Warnings)
+	}
+
+	want := []Partition{
+		{Number: 1, Start: 2048 * 512, Size: 8192 * 512, Type: "c", Bootable: true},
+		{Number: 2, Start: 10240 * 512, Size: 8192 * 512, Type: "83"},
+		{Number: 3, Start: 18432 * 512, Size: 12288 * 512, Type: "5", Extended: true},
+		{Number: 5, Start: (18432 + 2048) * 512, Size: 2048 * 512, Type: "83"},
+		{Number: 6, Start: (18432 + 6144 + 2048) * 512, Size: 4096 * 512, Type: "82"},
+	}
+	if len(table.Partitions) != len(want) {
+		t.Fatalf("Expected %d partitions, got %+v", len(want), table.Partitions)
+	}
+	for i := range want {
+		if table.Partitions[i] != want[i] {
+			t.Errorf("partition %d = %+v, want %+v", i, table.Partitions[i], want[i])
+		}
+	}
+}
+
+func TestReadMBRExtendedLoop(t *testing.T) {
+	image := mbrImage()
+	// Point the second EBR back at the first
+	putMBREntry(image[(18432+6144)*512:], 1, 0x00, 0x05, 0, 6144)
+
+	table, err := Read(bytes.NewReader(image), int64(len(image)), 512)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if len(table.Partitions) != 5 {
+		t.Errorf("Expected 5 partitions, got %d", len(table.Partitions))
+	}
+	if len(table.Warnings) != 1 {
+		t.Errorf("Expected a warning about the loop, got %v", table.Warnings)
+	}
+}
+
+func TestReadGPT(t *testing.T) {
+	image := standardGPT(t)
+	table, err := Read(bytes.NewReader(image), int64(len(image)), 512)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	if table.Label != "gpt" || table.ID != "EFBEADDE-0201-0403-0506-0708090A0B0C" {
+		t.Errorf("Expected gpt table with disk GUID, got %s %s", table.Label, table.ID)
+	}
+	if len(table.Warnings) != 0 {
+		t.Errorf("Unexpected warnings: %v", table.Warnings)
+	}
+	if len(table.Partitions) != 2 {
+		t.Fatalf("Expected 2 partitions, got %+v", table.Partitions)
+	}
+
+	esp, root := table.Partitions[0], table.Partitions[1]
+	if esp.Number != 1 || esp.Type != espGUID || esp.Name != "EFI system" || esp.Attributes != 1 {
+		t.Errorf("Unexpected ESP: %+v", esp)
+	}
+	if esp.Start != 2048*512 || esp.Size != 2048*512 {
+		t.Errorf("Unexpected ESP extent: start %d size %d", esp.Start, esp.Size)
+	}
+	// Numbers follow the entry index, so gaps are preserved
+	if root.Number != 3 || root.Type != linuxGUID || root.Name != "root" {
+		t.Errorf("Unexpected root partition: %+v", root)
+	}
+	if root.GUID != "01234503-89AB-CDEF-0123-456789ABCDEF" {
+		t.Errorf("Unexpected partition GUID %s", root.GUID)
+	}
+}
+
+func TestReadGPTCorruptPrimary(t *testing.T) {
+	image := standardGPT(t)
+	image[512+20] ^= 0xff // reserved, but covered by the header checksum
+
+	table, err := Read(bytes.NewReader(image), int64(len(image)), 512)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if len(table.Partitions) != 2 {
+		t.Errorf("Expected partitions from the backup header, got %+v", table.Partitions)
+	}
+	if len(table.Warnings) != 1 {
+		t.Errorf("Expected a warning about the primary header, got %v", table.Warnings)
+	}
+}
+
+func TestReadGPTCorruptEntries(t *testing.T) {
+	image := standardGPT(t)
+	// Damage the primary partition array; the backup is intact
+	image[2*512+60] ^= 0xff
+
+	table, err := Read(bytes.NewReader(image), int64(len(image)), 512)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if len(table.Partitions) != 2 || table.Partitions[0].Name != "EFI system" {
+		t.Errorf("Expected partitions from the backup entries, got %+v", table.Partitions)
+	}
+	if len(table.Warnings) != 1 {
+		t.Errorf("Expected a warning, got %v", table.Warnings)
+	}
+}
+
+func TestReadGPTCorruptBackup(t *testing.T) {
+	image := standardGPT(t)
+	image[len(image)-512+20] ^= 0xff
+
+	table, err := Read(bytes.NewReader(image), int64(len(image)), 512)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if len(table.Partitions) != 2 {
+		t.Errorf("Expected 2 partitions, got %+v", table.Partitions)
+	}
+	if len(table.Warnings) != 1 {
+		t.Errorf("Expected a warning about the backup header, got %v", table.Warnings)
+	}
+}
+
+func TestReadGPTBothCorrupt(t *testing.T) {
+	image := standardGPT(t)
+	image[512+20] ^= 0xff
+	image[len(image)-512+20] ^= 0xff
+
+	if _, err := Read(bytes.NewReader(image), int64(len(image)), 512); err == nil {
+		t.Error("Expected an error when both GPT headers are corrupt")
+	}
+}
+
+func TestReadGPTOversizedEntries(t *testing.T) {
+	image := standardGPT(t)
+	// A product of the entry count and size that overflows must not be
+	// taken for a small partition array
+	for _, lba := range []int{1, len(image)/512 - 1} {
+		header := image[lba*512:]
+		binary.LittleEndian.PutUint32(header[80:84], 0xFFFFFFFF)
+		binary.LittleEndian.PutUint32(header[84:88], 0xFFFFFFF8)
+		binary.LittleEndian.PutUint32(header[16:20], 0)
+		binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:gptMinHeaderSize]))
+	}
+
+	if _, err := Read(bytes.NewReader(image), int64(len(image)), 512); err == nil {
+		t.Error("Expected an error for an oversized GPT partition array")
+	}
+}
+
+func TestReadNoPartitionTable(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":      make([]byte, 1<<20),
+		"too small":  make([]byte, 100),
+		"FAT volume": fatBootSector(),
+	}
+	for name, image := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Read(bytes.NewReader(image), int64(len(image)), 512)
+			if !errors.Is(err, ErrNoPartitionTable) {
+				t.Errorf("Read() error = %v, want ErrNoPartitionTable", err)
+			}
+		})
+	}
+}
+
+// fatBootSector returns an image starting with a FAT boot sector, which
+// carries the same 55 aa signature as an MBR
+func fatBootSector() []byte {
+	image := make([]byte, 1<<20)
+	copy(image, []byte{0xeb, 0x3c, 0x90, 'm', 'k', 'f', 's', '.', 'f', 'a', 't'})
+	for i := mbrEntriesStart; i < 510; i++ {
+		image[i] = 0xf4 // boot code
+	}
+	image[510], image[511] = 0x55, 0xaa
+	return image
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, standardGPT(t), 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+
+	table, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if table.SectorSize != 512 || len(table.Partitions) != 2 {
+		t.Errorf("Unexpected table: %+v", table)
+	}
+}
+
+func TestReadFile4KSectors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	image := gptImage(t, 4096, map[int]gptTestPartition{
+		1: {typeGUID: linuxGUID, first: 256, last: 1791, name: "data"},
+	})
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+
+	table, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if table.SectorSize != 4096 {
+		t.Errorf("Expected 4096-byte sectors, got %d", table.SectorSize)
+	}
+	if len(table.Partitions) != 1 || table.Partitions[0].Start != 256*4096 {
+		t.Errorf("Unexpected partitions: %+v", table.Partitions)
+	}
+}